@@ -0,0 +1,359 @@
+package applier
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/rwynn/gtm"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// maps a source namespace to the namespace written in the target.
+// returning false skips ops for the namespace. for dropDatabase the
+// mapper receives and returns a database name
+type NamespaceMapper func(ns string) (string, bool)
+
+type Options struct {
+	// renames keyed by "db.collection" or by "db" to rename a whole database.
+	// a collection rule wins over a database rule
+	Rename         map[string]string
+	MapNamespace   NamespaceMapper
+	SkipDrops      bool
+	SkipCreates    bool
+	SkipIndexes    bool
+	MaxBulkSize    int
+	CheckpointDB   string
+	CheckpointC    string
+	CheckpointName string
+	Log            *log.Logger
+}
+
+// applies ops to a target cluster. Applier implements sink.Sink so it is
+// normally driven by a sink.Runner which supplies batching, retries and
+// checkpointing. every write is idempotent so replaying a batch is safe
+type Applier struct {
+	session *mgo.Session
+	options *Options
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Rename:         nil,
+		MapNamespace:   nil,
+		SkipDrops:      false,
+		SkipCreates:    false,
+		SkipIndexes:    false,
+		MaxBulkSize:    1000,
+		CheckpointDB:   "gtm",
+		CheckpointC:    "checkpoints",
+		CheckpointName: "applier",
+		Log:            log.New(os.Stdout, "INFO ", log.Flags()),
+	}
+}
+
+func (this *Options) SetDefaults() {
+	defaultOpts := DefaultOptions()
+	if this.MaxBulkSize < 1 {
+		this.MaxBulkSize = defaultOpts.MaxBulkSize
+	}
+	if this.CheckpointDB == "" {
+		this.CheckpointDB = defaultOpts.CheckpointDB
+	}
+	if this.CheckpointC == "" {
+		this.CheckpointC = defaultOpts.CheckpointC
+	}
+	if this.CheckpointName == "" {
+		this.CheckpointName = defaultOpts.CheckpointName
+	}
+	if this.Log == nil {
+		this.Log = defaultOpts.Log
+	}
+}
+
+func New(target *mgo.Session, options *Options) *Applier {
+	if options == nil {
+		options = DefaultOptions()
+	} else {
+		options.SetDefaults()
+	}
+	return &Applier{
+		session: target,
+		options: options,
+	}
+}
+
+// returns a checkpoint store kept in the target cluster so that the
+// checkpoint lives alongside the data it describes
+func (this *Applier) Checkpoint() *MongoCheckpoint {
+	return &MongoCheckpoint{
+		Session:    this.session,
+		Database:   this.options.CheckpointDB,
+		Collection: this.options.CheckpointC,
+		Name:       this.options.CheckpointName,
+	}
+}
+
+func (this *Applier) mapNamespace(ns string) (string, bool) {
+	if this.options.MapNamespace != nil {
+		return this.options.MapNamespace(ns)
+	}
+	if target, ok := this.options.Rename[ns]; ok {
+		return target, true
+	}
+	parts := strings.SplitN(ns, ".", 2)
+	if target, ok := this.options.Rename[parts[0]]; ok {
+		if len(parts) == 2 {
+			return target + "." + parts[1], true
+		}
+		return target, true
+	}
+	return ns, true
+}
+
+func (this *Applier) mapDatabase(db string) (string, bool) {
+	if this.options.MapNamespace != nil {
+		return this.options.MapNamespace(db)
+	}
+	if target, ok := this.options.Rename[db]; ok {
+		return target, true
+	}
+	return db, true
+}
+
+func splitNamespace(ns string) (string, string, error) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Invalid ns: %s :expecting db.collection", ns)
+	}
+	return parts[0], parts[1], nil
+}
+
+func isNamespaceNotFound(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 26 {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "ns not found")
+}
+
+type bulkWriter struct {
+	session *mgo.Session
+	ns      string
+	bulk    *mgo.Bulk
+	size    int
+	max     int
+}
+
+func (this *bulkWriter) collection(ns string) (*mgo.Bulk, error) {
+	if this.bulk != nil && this.ns == ns && this.size < this.max {
+		this.size++
+		return this.bulk, nil
+	}
+	if err := this.run(); err != nil {
+		return nil, err
+	}
+	db, col, err := splitNamespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	// ordered so that several changes to one document apply in oplog order
+	this.bulk = this.session.DB(db).C(col).Bulk()
+	this.ns = ns
+	this.size = 1
+	return this.bulk, nil
+}
+
+func (this *bulkWriter) run() error {
+	if this.bulk == nil {
+		return nil
+	}
+	bulk, ns := this.bulk, this.ns
+	this.bulk, this.ns, this.size = nil, "", 0
+	if _, err := bulk.Run(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error applying ops to %s", ns))
+	}
+	return nil
+}
+
+func (this *Applier) WriteBatch(ops []*gtm.Op) error {
+	s := this.session.Copy()
+	defer s.Close()
+	w := &bulkWriter{session: s, max: this.options.MaxBulkSize}
+	for _, op := range ops {
+		if op.IsCommand() {
+			if err := w.run(); err != nil {
+				return err
+			}
+			if err := this.applyCommand(s, op); err != nil {
+				return err
+			}
+			continue
+		}
+		ns, ok := this.mapNamespace(op.Namespace)
+		if !ok {
+			continue
+		}
+		var doc interface{}
+		if op.Data != nil {
+			doc = op.Data
+		} else if op.Doc != nil {
+			doc = op.Doc
+		} else if !op.IsDelete() {
+			// the document was deleted before it could be fetched. a
+			// later delete op removes it from the target
+			continue
+		}
+		bulk, err := w.collection(ns)
+		if err != nil {
+			return err
+		}
+		sel := bson.M{"_id": op.Id}
+		switch {
+		case op.IsInsert():
+			bulk.Upsert(sel, doc)
+		case op.IsUpdate():
+			if op.Data == nil || gtm.UpdateIsReplace(op.Data) {
+				bulk.Upsert(sel, doc)
+			} else if gtm.UpdateIsDiff(op.Data) {
+				mods, err := diffModifiers(op.Data)
+				if err != nil {
+					return errors.Wrap(err, fmt.Sprintf("Error applying update to %s", ns))
+				}
+				for _, mod := range mods {
+					bulk.Update(sel, mod)
+				}
+			} else {
+				bulk.Update(sel, modifier(op.Data))
+			}
+		case op.IsDelete():
+			bulk.Remove(sel)
+		}
+	}
+	return w.run()
+}
+
+// removes oplog metadata such as the $v version field from a $v 1 update delta
+func modifier(delta map[string]interface{}) bson.M {
+	mod := bson.M{}
+	for k, v := range delta {
+		if k == "$v" {
+			continue
+		}
+		mod[k] = v
+	}
+	return mod
+}
+
+func (this *Applier) applyCommand(s *mgo.Session, op *gtm.Op) error {
+	if _, drop := op.IsDropDatabase(); drop {
+		if this.options.SkipDrops {
+			return nil
+		}
+		db, ok := this.mapDatabase(op.GetDatabase())
+		if !ok {
+			return nil
+		}
+		if err := s.DB(db).DropDatabase(); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Error dropping database %s", db))
+		}
+		return nil
+	}
+	if col, drop := op.IsDropCollection(); drop {
+		if this.options.SkipDrops {
+			return nil
+		}
+		ns, ok := this.mapNamespace(op.GetDatabase() + "." + col)
+		if !ok {
+			return nil
+		}
+		db, c, err := splitNamespace(ns)
+		if err != nil {
+			return err
+		}
+		if err = s.DB(db).C(c).DropCollection(); err != nil && !isNamespaceNotFound(err) {
+			return errors.Wrap(err, fmt.Sprintf("Error dropping collection %s", ns))
+		}
+		return nil
+	}
+	if col, ok := op.Data["create"].(string); ok {
+		if this.options.SkipCreates {
+			return nil
+		}
+		ns, ok := this.mapNamespace(op.GetDatabase() + "." + col)
+		if !ok {
+			return nil
+		}
+		db, c, err := splitNamespace(ns)
+		if err != nil {
+			return err
+		}
+		cmd := bson.D{{Name: "create", Value: c}}
+		for k, v := range op.Data {
+			if k != "create" && k != "idIndex" {
+				cmd = append(cmd, bson.DocElem{Name: k, Value: v})
+			}
+		}
+		err = s.DB(db).Run(cmd, nil)
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return errors.Wrap(err, fmt.Sprintf("Error creating collection %s", ns))
+		}
+		return nil
+	}
+	if _, ok := op.Data["renameCollection"]; ok {
+		return this.renameCollection(s, op)
+	}
+	if isIndexCommand(op) {
+		if this.options.SkipIndexes {
+			return nil
+		}
+		return this.applyIndexCommand(s, op)
+	}
+	this.options.Log.Printf("Skipping command %s on %s: not applied to the target", commandName(op), op.Namespace)
+	return nil
+}
+
+func (this *Applier) Close() error {
+	return nil
+}
+
+// a sink.CheckpointStore which keeps the timestamp in a MongoDB collection
+type MongoCheckpoint struct {
+	Session    *mgo.Session
+	Database   string
+	Collection string
+	Name       string
+}
+
+type checkpointDoc struct {
+	Id        string              `bson:"_id"`
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Updated   time.Time           `bson:"updated"`
+}
+
+func (this *MongoCheckpoint) Load() (bson.MongoTimestamp, error) {
+	s := this.Session.Copy()
+	defer s.Close()
+	var doc checkpointDoc
+	err := s.DB(this.Database).C(this.Collection).FindId(this.Name).One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return doc.Timestamp, nil
+}
+
+func (this *MongoCheckpoint) Save(ts bson.MongoTimestamp) error {
+	s := this.Session.Copy()
+	defer s.Close()
+	doc := checkpointDoc{
+		Id:        this.Name,
+		Timestamp: ts,
+		Updated:   time.Now(),
+	}
+	_, err := s.DB(this.Database).C(this.Collection).UpsertId(this.Name, &doc)
+	return err
+}
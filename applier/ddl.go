@@ -0,0 +1,151 @@
+package applier
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/rwynn/gtm"
+	"sort"
+	"strings"
+)
+
+// commands which create or drop indexes. startIndexBuild and abortIndexBuild
+// are part of a two phase build on MongoDB 4.4+ and only commitIndexBuild is
+// applied
+var indexCommands = []string{
+	"createIndexes", "commitIndexBuild", "startIndexBuild", "abortIndexBuild", "dropIndexes", "deleteIndexes",
+}
+
+// other commands named when they are skipped
+var knownCommands = []string{
+	"collMod", "convertToCapped", "emptycapped", "applyOps", "commitTransaction", "abortTransaction",
+}
+
+func isIndexCommand(op *gtm.Op) bool {
+	for _, name := range indexCommands {
+		if _, ok := op.Data[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func commandName(op *gtm.Op) string {
+	for _, name := range knownCommands {
+		if _, ok := op.Data[name]; ok {
+			return name
+		}
+	}
+	var fields []string
+	for k := range op.Data {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+func isIndexNotFound(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 27 {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "index not found")
+}
+
+// renames within or across databases. a rename out of the replicated
+// namespaces drops the source in the target and a rename into them is ignored
+// since the documents were never replicated
+func (this *Applier) renameCollection(s *mgo.Session, op *gtm.Op) error {
+	from, _ := op.Data["renameCollection"].(string)
+	to, _ := op.Data["to"].(string)
+	if from == "" || to == "" {
+		return fmt.Errorf("Invalid renameCollection command: expecting renameCollection and to namespaces")
+	}
+	source, ok := this.mapNamespace(from)
+	if !ok {
+		return nil
+	}
+	target, ok := this.mapNamespace(to)
+	if !ok {
+		if this.options.SkipDrops {
+			return nil
+		}
+		db, c, err := splitNamespace(source)
+		if err != nil {
+			return err
+		}
+		if err = s.DB(db).C(c).DropCollection(); err != nil && !isNamespaceNotFound(err) {
+			return errors.Wrap(err, fmt.Sprintf("Error dropping renamed collection %s", source))
+		}
+		return nil
+	}
+	// newer servers record the UUID of the dropped target instead of true
+	dropTarget := false
+	switch v := op.Data["dropTarget"].(type) {
+	case nil:
+	case bool:
+		dropTarget = v
+	default:
+		dropTarget = true
+	}
+	cmd := bson.D{
+		{Name: "renameCollection", Value: source},
+		{Name: "to", Value: target},
+		{Name: "dropTarget", Value: dropTarget},
+	}
+	// a replayed rename finds the source already gone
+	if err := s.DB("admin").Run(cmd, nil); err != nil && !isNamespaceNotFound(err) {
+		return errors.Wrap(err, fmt.Sprintf("Error renaming collection %s to %s", source, target))
+	}
+	return nil
+}
+
+func (this *Applier) applyIndexCommand(s *mgo.Session, op *gtm.Op) error {
+	var col string
+	var specs []interface{}
+	drop := false
+	if c, ok := op.Data["createIndexes"].(string); ok {
+		col = c
+		spec := bson.M{}
+		for k, v := range op.Data {
+			if k != "createIndexes" && k != "ns" {
+				spec[k] = v
+			}
+		}
+		specs = append(specs, spec)
+	} else if c, ok := op.Data["commitIndexBuild"].(string); ok {
+		col = c
+		specs, _ = op.Data["indexes"].([]interface{})
+	} else if c, ok := op.Data["dropIndexes"].(string); ok {
+		col, drop = c, true
+	} else if c, ok := op.Data["deleteIndexes"].(string); ok {
+		col, drop = c, true
+	} else {
+		return nil
+	}
+	ns, ok := this.mapNamespace(op.GetDatabase() + "." + col)
+	if !ok {
+		return nil
+	}
+	db, c, err := splitNamespace(ns)
+	if err != nil {
+		return err
+	}
+	if drop {
+		cmd := bson.D{{Name: "dropIndexes", Value: c}, {Name: "index", Value: op.Data["index"]}}
+		err = s.DB(db).Run(cmd, nil)
+		if err != nil && !isIndexNotFound(err) && !isNamespaceNotFound(err) {
+			return errors.Wrap(err, fmt.Sprintf("Error dropping index on %s", ns))
+		}
+		return nil
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+	// creating an index which already exists with the same options succeeds
+	cmd := bson.D{{Name: "createIndexes", Value: c}, {Name: "indexes", Value: specs}}
+	if err = s.DB(db).Run(cmd, nil); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Error creating index on %s", ns))
+	}
+	return nil
+}
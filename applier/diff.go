@@ -0,0 +1,154 @@
+package applier
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"strconv"
+	"strings"
+)
+
+// translates a $v 2 update diff, written to the oplog by MongoDB 5.0+, into
+// update documents applied in order. fields become $set and $unset. arrays
+// which changed length get a second update trimming them with $push $slice
+func diffModifiers(delta map[string]interface{}) ([]bson.M, error) {
+	diff, ok := asMap(delta["diff"])
+	if !ok {
+		return nil, fmt.Errorf("Invalid update diff: expecting a document")
+	}
+	t := &diffTranslator{set: bson.M{}, unset: bson.M{}}
+	if err := t.object("", diff); err != nil {
+		return nil, err
+	}
+	var mods []bson.M
+	mod := bson.M{}
+	if len(t.set) > 0 {
+		mod["$set"] = t.set
+	}
+	if len(t.unset) > 0 {
+		mod["$unset"] = t.unset
+	}
+	if len(mod) > 0 {
+		mods = append(mods, mod)
+	}
+	for _, resize := range t.resizes {
+		mods = append(mods, bson.M{
+			"$push": bson.M{resize.field: bson.M{"$each": []interface{}{}, "$slice": resize.length}},
+		})
+	}
+	return mods, nil
+}
+
+type arrayResize struct {
+	field  string
+	length int
+}
+
+type diffTranslator struct {
+	set     bson.M
+	unset   bson.M
+	resizes []arrayResize
+}
+
+// a diff of a document. u and i hold updated and inserted fields, d holds
+// deleted fields and s<field> holds the diff of a nested document or array
+func (this *diffTranslator) object(prefix string, diff map[string]interface{}) error {
+	for k, v := range diff {
+		switch {
+		case k == "u" || k == "i":
+			fields, ok := asMap(v)
+			if !ok {
+				return fmt.Errorf("Invalid update diff at %s: expecting a document for %s", diffPath(prefix), k)
+			}
+			for f, val := range fields {
+				this.set[prefix+f] = val
+			}
+		case k == "d":
+			fields, ok := asMap(v)
+			if !ok {
+				return fmt.Errorf("Invalid update diff at %s: expecting a document for d", diffPath(prefix))
+			}
+			for f := range fields {
+				this.unset[prefix+f] = ""
+			}
+		case strings.HasPrefix(k, "s") && len(k) > 1:
+			if err := this.nested(prefix+k[1:], v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unsupported update diff field %s at %s", k, diffPath(prefix))
+		}
+	}
+	return nil
+}
+
+// a diff of an array. l is the new length, u<index> replaces an element
+// and s<index> holds the diff of a nested document or array
+func (this *diffTranslator) array(field string, diff map[string]interface{}) error {
+	for k, v := range diff {
+		switch {
+		case k == "a":
+		case k == "l":
+			length, ok := asInt(v)
+			if !ok {
+				return fmt.Errorf("Invalid update diff at %s: expecting a number for l", field)
+			}
+			this.resizes = append(this.resizes, arrayResize{field: field, length: length})
+		case strings.HasPrefix(k, "u") || strings.HasPrefix(k, "s"):
+			index, err := strconv.Atoi(k[1:])
+			if err != nil {
+				return fmt.Errorf("Unsupported update diff field %s at %s", k, field)
+			}
+			path := field + "." + strconv.Itoa(index)
+			if k[0] == 'u' {
+				this.set[path] = v
+			} else if err := this.nested(path, v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unsupported update diff field %s at %s", k, field)
+		}
+	}
+	return nil
+}
+
+func (this *diffTranslator) nested(field string, v interface{}) error {
+	sub, ok := asMap(v)
+	if !ok {
+		return fmt.Errorf("Invalid update diff at %s: expecting a document", field)
+	}
+	if isArray, _ := sub["a"].(bool); isArray {
+		return this.array(field, sub)
+	}
+	return this.object(field+".", sub)
+}
+
+func diffPath(prefix string) string {
+	if prefix == "" {
+		return "the top level"
+	}
+	return strings.TrimSuffix(prefix, ".")
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return m, true
+	}
+	return nil, false
+}
+
+func asInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
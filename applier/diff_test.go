@@ -0,0 +1,65 @@
+package applier
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestDiffModifiers(t *testing.T) {
+	tests := []struct {
+		name string
+		diff bson.M
+		mods []bson.M
+		err  bool
+	}{
+		{
+			name: "set and unset",
+			diff: bson.M{"u": bson.M{"a": 1}, "i": bson.M{"b": "x"}, "d": bson.M{"c": false}},
+			mods: []bson.M{{"$set": bson.M{"a": 1, "b": "x"}, "$unset": bson.M{"c": ""}}},
+		},
+		{
+			name: "nested document",
+			diff: bson.M{"saddress": bson.M{"u": bson.M{"city": "Oslo"}, "sgeo": bson.M{"d": bson.M{"lat": false}}}},
+			mods: []bson.M{{"$set": bson.M{"address.city": "Oslo"}, "$unset": bson.M{"address.geo.lat": ""}}},
+		},
+		{
+			name: "array elements",
+			diff: bson.M{"stags": bson.M{"a": true, "u0": "red", "s2": bson.M{"u": bson.M{"n": 3}}}},
+			mods: []bson.M{{"$set": bson.M{"tags.0": "red", "tags.2.n": 3}}},
+		},
+		{
+			name: "array resize",
+			diff: bson.M{"stags": bson.M{"a": true, "l": 1}},
+			mods: []bson.M{{"$push": bson.M{"tags": bson.M{"$each": []interface{}{}, "$slice": 1}}}},
+		},
+		{
+			name: "array append",
+			diff: bson.M{"stags": bson.M{"a": true, "l": 3, "u2": "blue"}},
+			mods: []bson.M{
+				{"$set": bson.M{"tags.2": "blue"}},
+				{"$push": bson.M{"tags": bson.M{"$each": []interface{}{}, "$slice": 3}}},
+			},
+		},
+		{name: "unknown field", diff: bson.M{"x": bson.M{}}, err: true},
+		{name: "bad array index", diff: bson.M{"stags": bson.M{"a": true, "uz": 1}}, err: true},
+		{name: "bad update", diff: bson.M{"u": 1}, err: true},
+	}
+	for _, test := range tests {
+		mods, err := diffModifiers(map[string]interface{}{"$v": 2, "diff": test.diff})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(mods, test.mods) {
+			t.Errorf("%s: got %v, want %v", test.name, mods, test.mods)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/rwynn/gtm"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dir holds the segments. a segment is finished once it reaches
+// MaxSegmentBytes of oplog entries or is older than MaxSegmentAge.
+// finished segments whose last entry is older than RetainAge are removed,
+// as are the oldest segments while the archive is larger than RetainBytes.
+// zero retention keeps everything. the newest segment is always kept so the
+// archiver knows where to resume. the open segment is flushed and synced to
+// disk every FlushInterval. OpLog selects the oplog and where to start when
+// the archive is empty. it defaults to the start of the oplog
+type Options struct {
+	Dir             string
+	MaxSegmentBytes int64
+	MaxSegmentAge   time.Duration
+	RetainAge       time.Duration
+	RetainBytes     int64
+	Uncompressed    bool
+	FlushInterval   time.Duration
+	OpLog           *gtm.Options
+	Log             *log.Logger
+}
+
+// tails the oplog into segment files in Options.Dir
+type Archiver struct {
+	ErrC    chan error // errors which do not fit in the buffer are logged instead
+	session *mgo.Session
+	options *Options
+	lock    *sync.Mutex
+	wg      *sync.WaitGroup
+	stopC   chan bool
+	stopped bool
+	last    bson.MongoTimestamp
+	seg     *segmentWriter
+}
+
+// the segment being written
+type segmentWriter struct {
+	file    *os.File
+	gz      *gzip.Writer
+	w       io.Writer
+	path    string
+	first   bson.MongoTimestamp
+	last    bson.MongoTimestamp
+	size    int64
+	opened  time.Time
+	flushed bool
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Dir:             "oplog-archive",
+		MaxSegmentBytes: 64 * 1024 * 1024,
+		MaxSegmentAge:   time.Duration(1) * time.Hour,
+		RetainAge:       0,
+		RetainBytes:     0,
+		Uncompressed:    false,
+		FlushInterval:   time.Duration(1) * time.Second,
+		OpLog:           nil,
+		Log:             log.New(os.Stdout, "INFO ", log.Flags()),
+	}
+}
+
+func (this *Options) SetDefaults() {
+	defaultOpts := DefaultOptions()
+	if this.Dir == "" {
+		this.Dir = defaultOpts.Dir
+	}
+	if this.MaxSegmentBytes <= 0 {
+		this.MaxSegmentBytes = defaultOpts.MaxSegmentBytes
+	}
+	if this.MaxSegmentAge <= 0 {
+		this.MaxSegmentAge = defaultOpts.MaxSegmentAge
+	}
+	if this.FlushInterval <= 0 {
+		this.FlushInterval = defaultOpts.FlushInterval
+	}
+	if this.OpLog == nil {
+		this.OpLog = gtm.DefaultOptions()
+		this.OpLog.After = gtm.StartOfOpLog
+	} else {
+		this.OpLog.SetDefaults()
+		if this.OpLog.After == nil {
+			this.OpLog.After = gtm.StartOfOpLog
+		}
+	}
+	if this.Log == nil {
+		this.Log = defaultOpts.Log
+	}
+}
+
+// creates the archive directory and finishes any segment left open by a
+// previous run. the archiver resumes after the newest archived entry
+func NewArchiver(session *mgo.Session, options *Options) (*Archiver, error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	options.SetDefaults()
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Error creating archive directory")
+	}
+	this := &Archiver{
+		ErrC:    make(chan error, 10),
+		session: session,
+		options: options,
+		lock:    &sync.Mutex{},
+		wg:      &sync.WaitGroup{},
+		stopC:   make(chan bool),
+	}
+	if err := this.recover(); err != nil {
+		return nil, err
+	}
+	_, last, err := Bounds(options.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing archive segments")
+	}
+	this.last = last
+	return this, nil
+}
+
+func (this *Archiver) Start() {
+	this.wg.Add(1)
+	go this.run()
+}
+
+// stops tailing and finishes the open segment
+func (this *Archiver) Stop() {
+	this.lock.Lock()
+	if !this.stopped {
+		this.stopped = true
+		close(this.stopC)
+	}
+	this.lock.Unlock()
+	this.wg.Wait()
+}
+
+// the timestamp of the newest entry written to the archive
+func (this *Archiver) Last() bson.MongoTimestamp {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.last
+}
+
+// never blocks so that an undrained ErrC cannot hold up Stop
+func (this *Archiver) sendErr(err error) {
+	select {
+	case this.ErrC <- err:
+	default:
+		this.options.Log.Printf("Dropped archive error: %s", err)
+	}
+}
+
+func (this *Archiver) isStopped() bool {
+	select {
+	case <-this.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+// copies the readable entries of segments left open by a crash into
+// finished segments. entries after the last sync are lost and archived
+// again from the oplog
+func (this *Archiver) recover() error {
+	parts, err := listParts(this.options.Dir)
+	if err != nil {
+		return errors.Wrap(err, "Error listing archive segments")
+	}
+	for _, part := range parts {
+		if _, err := this.recoverPart(part); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Error recovering archive segment %s", part))
+		}
+	}
+	return nil
+}
+
+// returns the timestamp of the last entry recovered from part
+func (this *Archiver) recoverPart(part string) (bson.MongoTimestamp, error) {
+	if strings.HasSuffix(part, tmpExt) {
+		// a recovery interrupted before its rename. the part is still there
+		if err := os.Remove(part); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	reader, err := gtm.OpenOpLogFile(part)
+	if err != nil {
+		// nothing was synced before the crash
+		return 0, os.Remove(part)
+	}
+	defer reader.Close()
+	var seg *segmentWriter
+	for {
+		doc, err := reader.NextRaw()
+		if err != nil {
+			if err != io.EOF {
+				this.options.Log.Printf("Discarding the unsynced end of archive segment %s: %s", part, err)
+			}
+			break
+		}
+		ts, err := entryTimestamp(doc)
+		if err != nil {
+			break
+		}
+		if seg == nil {
+			tmp := strings.TrimSuffix(part, partExt) + tmpExt
+			if seg, err = createSegment(tmp, ts, !this.options.Uncompressed); err != nil {
+				return 0, err
+			}
+		}
+		if err = seg.write(doc, ts); err != nil {
+			seg.file.Close()
+			return 0, err
+		}
+	}
+	if seg != nil {
+		if err = this.finishSegment(seg); err != nil {
+			return 0, err
+		}
+		return seg.last, os.Remove(part)
+	}
+	return 0, os.Remove(part)
+}
+
+func createSegment(path string, first bson.MongoTimestamp, compressed bool) (*segmentWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segmentWriter{
+		file:   f,
+		w:      f,
+		path:   path,
+		first:  first,
+		opened: time.Now(),
+	}
+	if compressed {
+		seg.gz = gzip.NewWriter(f)
+		seg.w = seg.gz
+	}
+	return seg, nil
+}
+
+func entryTimestamp(doc []byte) (bson.MongoTimestamp, error) {
+	var entry struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+	if err := bson.Unmarshal(doc, &entry); err != nil {
+		return 0, errors.Wrap(err, "Invalid oplog entry")
+	}
+	return entry.Timestamp, nil
+}
+
+func (this *segmentWriter) write(doc []byte, ts bson.MongoTimestamp) error {
+	if _, err := this.w.Write(doc); err != nil {
+		return err
+	}
+	this.last = ts
+	this.size += int64(len(doc))
+	this.flushed = false
+	return nil
+}
+
+// appends a raw oplog entry, opening a segment if needed
+func (this *Archiver) write(doc []byte) error {
+	ts, err := entryTimestamp(doc)
+	if err != nil {
+		return err
+	}
+	if this.seg == nil {
+		compressed := !this.options.Uncompressed
+		path := filepath.Join(this.options.Dir, partName(ts, compressed))
+		if this.seg, err = createSegment(path, ts, compressed); err != nil {
+			return err
+		}
+	}
+	return this.seg.write(doc, ts)
+}
+
+// makes everything written so far durable
+func (this *Archiver) flush() error {
+	seg := this.seg
+	if seg == nil || seg.flushed {
+		return nil
+	}
+	if seg.gz != nil {
+		if err := seg.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+	seg.flushed = true
+	this.lock.Lock()
+	if gtm.CompareTimestamps(seg.last, this.last) > 0 {
+		this.last = seg.last
+	}
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *Archiver) shouldRotate() bool {
+	seg := this.seg
+	if seg == nil {
+		return false
+	}
+	return seg.size >= this.options.MaxSegmentBytes || time.Since(seg.opened) >= this.options.MaxSegmentAge
+}
+
+// closes the open segment and renames it to its final name
+func (this *Archiver) finish() error {
+	seg := this.seg
+	if seg == nil {
+		return nil
+	}
+	this.seg = nil
+	if err := this.finishSegment(seg); err != nil {
+		return err
+	}
+	this.lock.Lock()
+	if gtm.CompareTimestamps(seg.last, this.last) > 0 {
+		this.last = seg.last
+	}
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *Archiver) finishSegment(seg *segmentWriter) error {
+	if seg.gz != nil {
+		if err := seg.gz.Close(); err != nil {
+			seg.file.Close()
+			return err
+		}
+	}
+	if err := seg.file.Sync(); err != nil {
+		seg.file.Close()
+		return err
+	}
+	if err := seg.file.Close(); err != nil {
+		return err
+	}
+	name := segmentName(seg.first, seg.last, seg.gz != nil)
+	return os.Rename(seg.path, filepath.Join(this.options.Dir, name))
+}
+
+// removes finished segments outside of RetainAge and RetainBytes
+func (this *Archiver) retain() error {
+	if this.options.RetainAge <= 0 && this.options.RetainBytes <= 0 {
+		return nil
+	}
+	segments, err := ListSegments(this.options.Dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, segment := range segments {
+		total += segment.Size
+	}
+	var cutoff time.Time
+	if this.options.RetainAge > 0 {
+		cutoff = time.Now().Add(-this.options.RetainAge)
+	}
+	for i := 0; i < len(segments)-1; i++ {
+		segment := segments[i]
+		tooOld := !cutoff.IsZero() && gtm.TimestampTime(segment.Last).Before(cutoff)
+		tooBig := this.options.RetainBytes > 0 && total > this.options.RetainBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.Remove(segment.Path); err != nil {
+			return err
+		}
+		total -= segment.Size
+	}
+	return nil
+}
+
+func (this *Archiver) rotate() {
+	if err := this.finish(); err != nil {
+		this.sendErr(errors.Wrap(err, "Error finishing archive segment"))
+		return
+	}
+	if err := this.retain(); err != nil {
+		this.sendErr(errors.Wrap(err, "Error removing expired archive segments"))
+	}
+}
+
+func (this *Archiver) backoff(attempt int) time.Duration {
+	policy := this.options.OpLog.RetryPolicy
+	if policy == nil {
+		policy = gtm.DefaultRetryPolicy()
+	}
+	d := policy.InitialBackoff
+	for i := 0; i < attempt && d < policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > policy.MaxBackoff {
+		d = policy.MaxBackoff
+	}
+	return d
+}
+
+func (this *Archiver) run() {
+	defer this.wg.Done()
+	defer func() {
+		if err := this.finish(); err != nil {
+			this.sendErr(errors.Wrap(err, "Error finishing archive segment"))
+		}
+	}()
+	options := this.options.OpLog
+	last := this.Last()
+	for attempt := 0; ; attempt++ {
+		if progress := this.Last(); gtm.CompareTimestamps(progress, last) > 0 {
+			last = progress
+			attempt = 0
+		}
+		if attempt > 0 {
+			wait := this.backoff(attempt - 1)
+			this.options.Log.Printf("Resuming the oplog archive in %s", wait)
+			select {
+			case <-this.stopC:
+				return
+			case <-time.After(wait):
+			}
+		}
+		if this.tail(options) {
+			return
+		}
+	}
+}
+
+// archives the oplog until stopped or an error. returns true when stopped
+func (this *Archiver) tail(options *gtm.Options) bool {
+	s := this.session.Copy()
+	defer s.Close()
+	if err := s.Ping(); err != nil {
+		this.sendErr(errors.Wrap(err, "Error connecting to archive the oplog"))
+		return false
+	}
+	options.Fill(s)
+	after := this.last
+	if seg := this.seg; seg != nil {
+		after = seg.last
+	}
+	if after == 0 {
+		after = options.After(s, options)
+	} else if first := gtm.FirstOpTimestamp(s, options); gtm.CompareTimestamps(first, after+1) > 0 {
+		this.sendErr(fmt.Errorf("The oplog starts at %s after the end of the archive at %s. Ops in between are missing",
+			gtm.TimestampTime(first), gtm.TimestampTime(after)))
+	}
+	iter := gtm.GetOpLogQuery(s, after, options).Tail(this.options.FlushInterval)
+	defer iter.Close()
+	flushed := time.Now()
+	for {
+		var raw bson.Raw
+		if iter.Next(&raw) {
+			if err := this.write(raw.Data); err != nil {
+				this.sendErr(errors.Wrap(err, "Error writing archive segment"))
+				this.abandon()
+				return false
+			}
+		} else if !iter.Timeout() {
+			if err := iter.Close(); err != nil {
+				this.sendErr(errors.Wrap(err, "Error tailing the oplog archive"))
+			}
+			return this.isStopped()
+		}
+		if this.isStopped() {
+			return true
+		}
+		if time.Since(flushed) >= this.options.FlushInterval {
+			if err := this.flush(); err != nil {
+				this.sendErr(errors.Wrap(err, "Error syncing archive segment"))
+				this.abandon()
+				return false
+			}
+			flushed = time.Now()
+		}
+		if this.shouldRotate() {
+			this.rotate()
+		}
+	}
+}
+
+// closes a segment which could not be written and finishes it with the
+// entries which made it to disk. tailing resumes after those
+func (this *Archiver) abandon() {
+	seg := this.seg
+	if seg == nil {
+		return
+	}
+	this.seg = nil
+	seg.file.Close()
+	last, err := this.recoverPart(seg.path)
+	if err != nil {
+		this.sendErr(errors.Wrap(err, fmt.Sprintf("Error recovering archive segment %s", seg.path)))
+		return
+	}
+	this.lock.Lock()
+	if gtm.CompareTimestamps(last, this.last) > 0 {
+		this.last = last
+	}
+	this.lock.Unlock()
+}
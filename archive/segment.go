@@ -0,0 +1,187 @@
+package archive
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	segmentPrefix = "oplog-"
+	segmentExt    = ".bson"
+	gzipExt       = ".gz"
+	partExt       = ".part"
+	tmpExt        = ".tmp"
+)
+
+// a finished archive file holding the oplog entries from First to Last
+// inclusive. names are oplog-<first>-<last>.bson with .gz appended when
+// compressed. timestamps are 16 hex digits so names sort in oplog order
+type Segment struct {
+	Path  string
+	First bson.MongoTimestamp
+	Last  bson.MongoTimestamp
+	Size  int64
+}
+
+func segmentName(first, last bson.MongoTimestamp, compressed bool) string {
+	name := fmt.Sprintf("%s%016x-%016x%s", segmentPrefix, uint64(first), uint64(last), segmentExt)
+	if compressed {
+		name += gzipExt
+	}
+	return name
+}
+
+func partName(first bson.MongoTimestamp, compressed bool) string {
+	name := fmt.Sprintf("%s%016x%s", segmentPrefix, uint64(first), segmentExt)
+	if compressed {
+		name += gzipExt
+	}
+	return name + partExt
+}
+
+func parseTimestampHex(s string) (bson.MongoTimestamp, bool) {
+	if len(s) != 16 {
+		return 0, false
+	}
+	ts, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return bson.MongoTimestamp(ts), true
+}
+
+func parseSegmentName(name string) (first, last bson.MongoTimestamp, ok bool) {
+	if !strings.HasPrefix(name, segmentPrefix) {
+		return
+	}
+	name = strings.TrimPrefix(name, segmentPrefix)
+	name = strings.TrimSuffix(name, gzipExt)
+	if !strings.HasSuffix(name, segmentExt) {
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(name, segmentExt), "-")
+	if len(parts) != 2 {
+		return
+	}
+	if first, ok = parseTimestampHex(parts[0]); !ok {
+		return
+	}
+	last, ok = parseTimestampHex(parts[1])
+	return
+}
+
+// returns the finished segments in dir ordered by timestamp. segments still
+// being written are not included
+func ListSegments(dir string) ([]*Segment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var segments []*Segment
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		first, last, ok := parseSegmentName(info.Name())
+		if !ok {
+			continue
+		}
+		segments = append(segments, &Segment{
+			Path:  filepath.Join(dir, info.Name()),
+			First: first,
+			Last:  last,
+			Size:  info.Size(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return gtm.CompareTimestamps(segments[i].First, segments[j].First) < 0
+	})
+	return segments, nil
+}
+
+func listParts(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var parts []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), segmentPrefix) &&
+			(strings.HasSuffix(info.Name(), partExt) || strings.HasSuffix(info.Name(), tmpExt)) {
+			parts = append(parts, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(parts)
+	return parts, nil
+}
+
+// returns the paths of the segments in dir holding entries after ts, in
+// order. a zero ts returns every segment
+func Files(dir string, after bson.MongoTimestamp) ([]string, error) {
+	segments, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, segment := range segments {
+		if segment.Last > after {
+			paths = append(paths, segment.Path)
+		}
+	}
+	return paths, nil
+}
+
+// returns the oldest and newest timestamps in the archive or zeros when empty
+func Bounds(dir string) (first, last bson.MongoTimestamp, err error) {
+	segments, err := ListSegments(dir)
+	if err != nil || len(segments) == 0 {
+		return
+	}
+	return segments[0].First, segments[len(segments)-1].Last, nil
+}
+
+// replays the archive in dir through the OpCtx api starting after
+// options.After. with a session tailing hands over to the live oplog once
+// the archive is exhausted, otherwise OpC is closed at the end of the archive
+// as with gtm.StartFiles. options.After is called once to pick the segments.
+// a nil After replays the whole archive. without a session use a generator
+// which does not query the oplog, e.g. gtm.AfterTimestamp(gtm.TimestampForTime(t))
+func Replay(session *mgo.Session, dir string, options *gtm.Options) (*gtm.OpCtx, error) {
+	if options == nil {
+		options = gtm.DefaultOptions()
+	}
+	var after bson.MongoTimestamp
+	if options.After != nil {
+		if session != nil {
+			s := session.Copy()
+			options.Fill(s)
+			after = options.After(s, options)
+			s.Close()
+		} else {
+			after = options.After(nil, options)
+		}
+	}
+	paths, err := Files(dir, after)
+	if err != nil {
+		return nil, err
+	}
+	options.After = gtm.AfterTimestamp(after)
+	if session == nil {
+		return gtm.StartFiles(nil, paths, options), nil
+	}
+	return gtm.StartFromFiles(session, paths, options), nil
+}
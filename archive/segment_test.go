@@ -0,0 +1,254 @@
+package archive
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gtm-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func touch(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func entryDoc(t *testing.T, ts bson.MongoTimestamp) []byte {
+	doc, err := bson.Marshal(bson.M{"ts": ts, "op": "i", "ns": "db.c", "o": bson.M{"_id": int64(ts)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseSegmentName(t *testing.T) {
+	tests := []struct {
+		name  string
+		first bson.MongoTimestamp
+		last  bson.MongoTimestamp
+		ok    bool
+	}{
+		{name: segmentName(1, 2, false), first: 1, last: 2, ok: true},
+		{name: segmentName(5<<32|1, 9<<32, true), first: 5<<32 | 1, last: 9 << 32, ok: true},
+		{name: "oplog-0000000000000001-0000000000000002.bson.gz", first: 1, last: 2, ok: true},
+		{name: partName(1, true)},
+		{name: "oplog-0000000000000001.bson.tmp"},
+		{name: "oplog-0000000000000001-0000000000000002.json"},
+		{name: "oplog-1-2.bson"},
+		{name: "oplog-000000000000000g-0000000000000002.bson"},
+		{name: "oplog-0000000000000001-0000000000000002-0000000000000003.bson"},
+		{name: "dump-0000000000000001-0000000000000002.bson"},
+	}
+	for _, test := range tests {
+		first, last, ok := parseSegmentName(test.name)
+		if ok != test.ok || (ok && (first != test.first || last != test.last)) {
+			t.Errorf("%s: got %d %d %t, want %d %d %t", test.name, first, last, ok, test.first, test.last, test.ok)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	touch(t, dir,
+		segmentName(30, 40, true),
+		segmentName(10, 20, false),
+		segmentName(21, 29, true),
+		partName(41, true),
+		"oplog-0000000000000041.bson.tmp",
+		"notes.txt",
+	)
+	tests := []struct {
+		after bson.MongoTimestamp
+		files []string
+	}{
+		{after: 0, files: []string{segmentName(10, 20, false), segmentName(21, 29, true), segmentName(30, 40, true)}},
+		{after: 15, files: []string{segmentName(10, 20, false), segmentName(21, 29, true), segmentName(30, 40, true)}},
+		{after: 20, files: []string{segmentName(21, 29, true), segmentName(30, 40, true)}},
+		{after: 39, files: []string{segmentName(30, 40, true)}},
+		{after: 40, files: nil},
+	}
+	for _, test := range tests {
+		paths, err := Files(dir, test.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, path := range paths {
+			files = append(files, filepath.Base(path))
+		}
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("after %d: got %v, want %v", test.after, files, test.files)
+		}
+	}
+	first, last, err := Bounds(dir)
+	if err != nil || first != 10 || last != 40 {
+		t.Errorf("bounds %d %d %v, want 10 40", first, last, err)
+	}
+	if paths, err := Files(filepath.Join(dir, "missing"), 0); err != nil || paths != nil {
+		t.Errorf("missing directory: got %v %v", paths, err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name string
+		// entries synced to the part before the crash
+		synced []bson.MongoTimestamp
+		// bytes of a partially written entry after the synced ones
+		torn         bool
+		compressed   bool
+		uncompressed bool
+		segments     []string
+	}{
+		{
+			name:       "compressed part",
+			synced:     []bson.MongoTimestamp{5, 6, 7},
+			compressed: true,
+			segments:   []string{segmentName(5, 7, true)},
+		},
+		{
+			name:       "torn last entry",
+			synced:     []bson.MongoTimestamp{5, 6},
+			torn:       true,
+			compressed: true,
+			segments:   []string{segmentName(5, 6, true)},
+		},
+		{
+			name:         "uncompressed part",
+			synced:       []bson.MongoTimestamp{8},
+			uncompressed: true,
+			segments:     []string{segmentName(8, 8, false)},
+		},
+		{
+			name:       "nothing synced",
+			compressed: true,
+		},
+	}
+	for _, test := range tests {
+		dir := tempDir(t)
+		part := filepath.Join(dir, partName(5, test.compressed))
+		f, err := os.Create(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w io.Writer = f
+		var gz *gzip.Writer
+		if test.compressed && len(test.synced) > 0 {
+			gz = gzip.NewWriter(f)
+			w = gz
+		}
+		for _, ts := range test.synced {
+			w.Write(entryDoc(t, ts))
+		}
+		if test.torn {
+			w.Write(entryDoc(t, 99)[:7])
+		}
+		if gz != nil {
+			// a crash leaves a flushed but unterminated gzip stream
+			gz.Flush()
+		}
+		f.Close()
+		// an interrupted recovery leaves a .tmp beside its part
+		touch(t, dir, "oplog-0000000000000001.bson.gz.tmp")
+
+		a, err := NewArchiver(nil, &Options{
+			Dir:          dir,
+			Uncompressed: test.uncompressed,
+			Log:          log.New(ioutil.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if parts, _ := listParts(dir); len(parts) != 0 {
+			t.Errorf("%s: parts left after recovery: %v", test.name, parts)
+		}
+		segments, err := ListSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, segment := range segments {
+			names = append(names, filepath.Base(segment.Path))
+		}
+		if !reflect.DeepEqual(names, test.segments) {
+			t.Errorf("%s: got segments %v, want %v", test.name, names, test.segments)
+		}
+		var want bson.MongoTimestamp
+		if len(test.synced) > 0 {
+			want = test.synced[len(test.synced)-1]
+		}
+		if a.Last() != want {
+			t.Errorf("%s: resumes after %d, want %d", test.name, a.Last(), want)
+		}
+		for _, segment := range segments {
+			reader, err := gtm.OpenOpLogFile(segment.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []bson.MongoTimestamp
+			for {
+				var entry gtm.OpLog
+				if err := reader.Next(&entry); err != nil {
+					if err != io.EOF {
+						t.Errorf("%s: %s", test.name, err)
+					}
+					break
+				}
+				got = append(got, entry.Timestamp)
+			}
+			reader.Close()
+			if !reflect.DeepEqual(got, test.synced) {
+				t.Errorf("%s: recovered entries %v, want %v", test.name, got, test.synced)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestErrorsDoNotBlock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	archiver, err := NewArchiver(nil, &Options{Dir: dir, Log: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(archiver.ErrC) < cap(archiver.ErrC) {
+		archiver.ErrC <- nil
+	}
+	f, err := os.Create(filepath.Join(dir, "gone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the part has gone so recovering the abandoned segment fails
+	archiver.seg = &segmentWriter{file: f, path: filepath.Join(dir, partName(5, true))}
+	done := make(chan bool)
+	go func() {
+		archiver.abandon()
+		archiver.rotate()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("an undrained ErrC blocked the archiver")
+	}
+}
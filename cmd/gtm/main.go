@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+type config struct {
+	url            string
+	includes       stringList
+	excludes       stringList
+	since          string
+	until          string
+	directReadNs   stringList
+	ordering       string
+	workers        int
+	delta          bool
+	out            string
+	directReadOnly bool
+	jsonMode       string
+	pushdown       bool
+}
+
+func parseFlags() *config {
+	c := &config{}
+	flag.StringVar(&c.url, "url", "localhost", "MongoDB connection string")
+	flag.Var(&c.includes, "include", "regex of namespaces to include. may be repeated")
+	flag.Var(&c.excludes, "exclude", "regex of namespaces to exclude. may be repeated")
+	flag.StringVar(&c.since, "since", "now", "where to start: now, start, a duration such as 2h, an RFC3339 time, seconds:ordinal or a raw 64 bit timestamp")
+	flag.StringVar(&c.until, "until", "", "exit after the oplog reaches this point: an RFC3339 time, seconds:ordinal or a raw 64 bit timestamp")
+	flag.Var(&c.directReadNs, "direct-read-ns", "namespace to read directly in addition to tailing. may be repeated")
+	flag.StringVar(&c.ordering, "ordering", "oplog", "ordering guarantee: oplog, namespace or document")
+	flag.IntVar(&c.workers, "workers", 1, "number of workers fetching documents when ordering is not oplog")
+	flag.BoolVar(&c.delta, "delta", false, "emit the oplog delta for updates instead of fetching the full document")
+	flag.StringVar(&c.out, "out", "", "file to append ops to. defaults to stdout")
+	flag.BoolVar(&c.directReadOnly, "direct-read-only", false, "exit once direct reads complete")
+	flag.StringVar(&c.jsonMode, "json", "canonical", "extended json mode: canonical or relaxed")
+	flag.BoolVar(&c.pushdown, "pushdown", false, "also send -include patterns, rewritten in a syntax the server accepts, as regular expressions on the oplog query")
+	flag.Parse()
+	return c
+}
+
+func parseOrdering(ordering string) (gtm.OrderingGuarantee, error) {
+	switch strings.ToLower(ordering) {
+	case "oplog":
+		return gtm.Oplog, nil
+	case "namespace":
+		return gtm.Namespace, nil
+	case "document":
+		return gtm.Document, nil
+	default:
+		return gtm.Oplog, fmt.Errorf("Invalid ordering %s: expecting oplog, namespace or document", ordering)
+	}
+}
+
+func parseJSONMode(mode string) (gtm.ExtJSONMode, error) {
+	switch strings.ToLower(mode) {
+	case "canonical":
+		return gtm.CanonicalExtJSON, nil
+	case "relaxed":
+		return gtm.RelaxedExtJSON, nil
+	default:
+		return gtm.CanonicalExtJSON, fmt.Errorf("Invalid json mode %s: expecting canonical or relaxed", mode)
+	}
+}
+
+// timestamps are tried before durations so that a raw timestamp such as 0
+// is not read as a zero duration
+func parseSince(since string) (gtm.TimestampGenerator, error) {
+	if since == "" || since == "now" {
+		return nil, nil
+	} else if since == "start" {
+		return gtm.StartOfOpLog, nil
+	} else if ts, err := parseTimestamp(since); err == nil {
+		return gtm.AfterTimestamp(ts), nil
+	} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return gtm.AfterTime(t), nil
+	}
+	d, err := time.ParseDuration(since)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid since %s: expecting now, start, a duration, an RFC3339 time or a timestamp", since)
+	}
+	return gtm.AfterDuration(d), nil
+}
+
+// sets Until or UntilTime from the -until flag
+func parseUntil(until string, options *gtm.Options) error {
+	if until == "" {
+		return nil
+	} else if t, err := time.Parse(time.RFC3339, until); err == nil {
+		options.UntilTime = t
+		return nil
+	}
+	ts, err := parseTimestamp(until)
+	if err != nil {
+		return fmt.Errorf("Invalid until %s: %s", until, err)
+	}
+	options.Until = ts
+	return nil
+}
+
+// parses seconds:ordinal or a raw 64 bit timestamp
+func parseTimestamp(value string) (bson.MongoTimestamp, error) {
+	if parts := strings.SplitN(value, ":", 2); len(parts) == 2 {
+		t, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		i, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return bson.MongoTimestamp(t<<32 | i), nil
+	}
+	raw, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bson.MongoTimestamp(raw), nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %s: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// the server matches with PCRE rather than Go's RE2. patterns are rewritten
+// from the parsed form, which expands Unicode classes such as \pL to ranges and
+// uses only group, class and flag syntax both engines read the same way
+func pushdownPatterns(patterns []string) ([]string, error) {
+	var rewritten []string
+	for _, pattern := range patterns {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %s: %s", pattern, err)
+		}
+		if err = checkPushdown(re); err != nil {
+			return nil, fmt.Errorf("Unable to push down namespace pattern %s: %s", pattern, err)
+		}
+		rewritten = append(rewritten, re.Simplify().String())
+	}
+	return rewritten, nil
+}
+
+func checkPushdown(re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch, syntax.OpEmptyMatch, syntax.OpLiteral, syntax.OpCharClass,
+		syntax.OpAnyCharNotNL, syntax.OpAnyChar, syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary,
+		syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat,
+		syntax.OpConcat, syntax.OpAlternate:
+	default:
+		return fmt.Errorf("%s has no server equivalent", re)
+	}
+	for _, sub := range re.Sub {
+		if err := checkPushdown(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func namespaceOf(op *gtm.Op) string {
+	if col, drop := op.IsDropCollection(); drop {
+		return op.GetDatabase() + "." + col
+	}
+	return op.Namespace
+}
+
+func namespaceFilter(includes, excludes []*regexp.Regexp) gtm.OpFilter {
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+	return func(op *gtm.Op) bool {
+		ns := namespaceOf(op)
+		for _, re := range excludes {
+			if re.MatchString(ns) {
+				return false
+			}
+		}
+		if len(includes) == 0 {
+			return true
+		}
+		for _, re := range includes {
+			if re.MatchString(ns) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func formatTimestamp(ts bson.MongoTimestamp) string {
+	t, i := gtm.ParseTimestamp(ts)
+	return fmt.Sprintf("%d:%d", uint32(t), uint32(i))
+}
+
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+func writeLine(w *bufio.Writer, b []byte) error {
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+func main() {
+	errLog := log.New(os.Stderr, "ERROR ", log.Flags())
+	infoLog := log.New(os.Stderr, "INFO ", log.Flags())
+	if err := run(parseFlags(), errLog, infoLog); err != nil {
+		errLog.Fatalln(err)
+	}
+}
+
+// returns instead of exiting so that the deferred closes run
+func run(c *config, errLog *log.Logger, infoLog *log.Logger) error {
+	ordering, err := parseOrdering(c.ordering)
+	if err != nil {
+		return err
+	}
+	jsonMode, err := parseJSONMode(c.jsonMode)
+	if err != nil {
+		return err
+	}
+	after, err := parseSince(c.since)
+	if err != nil {
+		return err
+	}
+	includes, err := compilePatterns(c.includes)
+	if err != nil {
+		return err
+	}
+	excludes, err := compilePatterns(c.excludes)
+	if err != nil {
+		return err
+	}
+	out, err := openOutput(c.out)
+	if err != nil {
+		return fmt.Errorf("Unable to open output %s: %s", c.out, err)
+	}
+	defer out.Close()
+	session, err := mgo.Dial(c.url)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to %s: %s", c.url, err)
+	}
+	defer session.Close()
+	session.SetMode(mgo.Monotonic, true)
+
+	var queryFilter *gtm.OpLogQueryFilter
+	if c.pushdown && len(c.includes) > 0 {
+		regexes, err := pushdownPatterns(c.includes)
+		if err != nil {
+			return err
+		}
+		queryFilter = &gtm.OpLogQueryFilter{NamespaceRegexes: regexes}
+	}
+
+	options := &gtm.Options{
+		After:             after,
+		NamespaceFilter:   namespaceFilter(includes, excludes),
+		OpLogQueryFilter:  queryFilter,
+		Ordering:          ordering,
+		WorkerCount:       c.workers,
+		UpdateDataAsDelta: c.delta,
+		DirectReadNs:      c.directReadNs,
+		Log:               infoLog,
+	}
+	if err = parseUntil(c.until, options); err != nil {
+		return err
+	}
+	ctx := gtm.Start(session, options)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	readsDone := make(chan bool)
+	if c.directReadOnly {
+		go func() {
+			ctx.DirectReadWg.Wait()
+			close(readsDone)
+		}()
+	}
+	stopped := make(chan bool)
+	stop := func() {
+		signal.Stop(sigs)
+		// keep draining while stopping so producers blocked on OpC can exit
+		go func() {
+			ctx.Stop()
+			close(stopped)
+		}()
+	}
+
+	w := bufio.NewWriter(out)
+	// with several workers ops arrive out of oplog order so the resume point
+	// is the highest checkpoint written rather than the last timestamp
+	var last bson.MongoTimestamp
+	// the checkpoint of ops still in the buffer. it becomes the resume point
+	// only once they are flushed
+	var buffered bson.MongoTimestamp
+	// ops cannot be written once the output fails so the run stops and
+	// returns the error
+	var writeErr error
+	stopping := false
+	opC := ctx.OpC
+	for {
+		select {
+		case <-sigs:
+			if !stopping {
+				stopping = true
+				stop()
+			}
+		case <-readsDone:
+			readsDone = nil
+			if !stopping {
+				stopping = true
+				stop()
+			}
+		case <-stopped:
+			if writeErr == nil {
+				if writeErr = w.Flush(); writeErr == nil {
+					last = buffered
+				}
+			}
+			if last != 0 {
+				fmt.Fprintf(os.Stderr, "last timestamp: %s (resume with -since %s)\n",
+					formatTimestamp(last), formatTimestamp(last))
+			}
+			if writeErr != nil {
+				return fmt.Errorf("Unable to write ops: %s", writeErr)
+			}
+			return nil
+		case err := <-ctx.ErrC:
+			errLog.Println(err)
+		case op, open := <-opC:
+			if !open {
+				// a bounded replay reached -until
+				opC = nil
+				if !stopping {
+					stopping = true
+					stop()
+				}
+				continue
+			}
+			if writeErr != nil {
+				continue
+			}
+			b, err := op.MarshalExtJSON(jsonMode)
+			if err != nil {
+				errLog.Println(err)
+				continue
+			}
+			if writeErr = writeLine(w, b); writeErr != nil {
+				if !stopping {
+					stopping = true
+					stop()
+				}
+				continue
+			}
+			if op.IsSourceOplog() && gtm.CompareTimestamps(op.Checkpoint, buffered) > 0 {
+				buffered = op.Checkpoint
+			}
+			if len(opC) == 0 {
+				if writeErr = w.Flush(); writeErr == nil {
+					last = buffered
+				} else if !stopping {
+					stopping = true
+					stop()
+				}
+			}
+		}
+	}
+}
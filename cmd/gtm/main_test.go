@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+)
+
+func TestParseSince(t *testing.T) {
+	tests := []struct {
+		since string
+		ts    bson.MongoTimestamp // expected for timestamp forms
+		isTs  bool
+		nil   bool
+		err   bool
+	}{
+		{since: "now", nil: true},
+		{since: "", nil: true},
+		{since: "start"},
+		{since: "0", ts: 0, isTs: true},
+		{since: "1500000000:3", ts: gtm.NewTimestamp(1500000000, 3), isTs: true},
+		{since: "6442450945", ts: bson.MongoTimestamp(6442450945), isTs: true},
+		{since: "2h"},
+		{since: "2019-01-02T15:04:05Z"},
+		{since: "yesterday", err: true},
+		{since: "1:x", err: true},
+	}
+	for _, test := range tests {
+		after, err := parseSince(test.since)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.since)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.since, err)
+			continue
+		}
+		if test.nil != (after == nil) {
+			t.Errorf("%q: got generator %v", test.since, after != nil)
+			continue
+		}
+		if test.isTs {
+			if got := after(nil, nil); got != test.ts {
+				t.Errorf("%q: got timestamp %d, want %d", test.since, got, test.ts)
+			}
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value string
+		ts    bson.MongoTimestamp
+		err   bool
+	}{
+		{value: "0", ts: 0},
+		{value: "1:2", ts: bson.MongoTimestamp(1<<32 | 2)},
+		{value: "2147483647:1", ts: bson.MongoTimestamp(2147483647<<32 | 1)},
+		{value: "4294967296:1", err: true},
+		{value: "abc", err: true},
+	}
+	for _, test := range tests {
+		ts, err := parseTimestamp(test.value)
+		if test.err != (err != nil) {
+			t.Errorf("%q: unexpected error state %v", test.value, err)
+			continue
+		}
+		if !test.err && ts != test.ts {
+			t.Errorf("%q: got %d, want %d", test.value, ts, test.ts)
+		}
+	}
+}
+
+func TestPushdownPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		matches []string
+		misses  []string
+		err     bool
+	}{
+		{pattern: `^mydb\.`, want: `\Amydb\.`, matches: []string{"mydb.a"}, misses: []string{"other.mydb.a"}},
+		{pattern: `\.sessions$`, matches: []string{"db.sessions"}, misses: []string{"db.sessions2"}},
+		{pattern: `(?U)^db\.a+`, want: `\Adb\.a+?`, matches: []string{"db.aa"}},
+		{pattern: `^db\.\pL+$`, matches: []string{"db.é"}, misses: []string{"db.1"}},
+		{pattern: `(?i)^DB\.users$`, matches: []string{"db.USERS"}},
+		{pattern: `(`, err: true},
+	}
+	for _, test := range tests {
+		got, err := pushdownPatterns([]string{test.pattern})
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.pattern, err)
+			continue
+		}
+		if test.want != "" && got[0] != test.want {
+			t.Errorf("%q: got %q, want %q", test.pattern, got[0], test.want)
+		}
+		re := regexp.MustCompile(got[0])
+		for _, ns := range test.matches {
+			if !re.MatchString(ns) {
+				t.Errorf("%q: rewritten %q does not match %s", test.pattern, got[0], ns)
+			}
+		}
+		for _, ns := range test.misses {
+			if re.MatchString(ns) {
+				t.Errorf("%q: rewritten %q matches %s", test.pattern, got[0], ns)
+			}
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteLineError(t *testing.T) {
+	w := bufio.NewWriterSize(failingWriter{}, 16)
+	if err := writeLine(w, []byte("short")); err != nil {
+		t.Fatalf("a buffered line should not fail: %s", err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Errorf("expected the flush to fail")
+	}
+	if err := writeLine(w, []byte("{}")); err == nil {
+		t.Errorf("expected writes after a failed flush to fail")
+	}
+}
@@ -0,0 +1,223 @@
+package gtm
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"reflect"
+	"time"
+)
+
+// how a direct read pages through a namespace
+type readStrategy int
+
+const (
+	idOrderRead    readStrategy = iota // find in _id order, or the order of DirectReadQuery.Sort
+	naturalRead                        // find in $natural order. capped collections
+	viewRead                           // aggregate on a view
+	timeSeriesRead                     // aggregate on a time series collection in time order
+)
+
+// the Err of the DirectReadDone of a namespace which direct reads cannot
+// read. the namespace is logged and skipped
+type UnsupportedCollectionError struct {
+	Namespace string
+	Type      string
+}
+
+// where an interrupted direct read resumes
+type readPosition struct {
+	lastId   interface{}
+	read     int
+	lastTime interface{}
+	ties     int // documents read with a time equal to lastTime
+}
+
+func (this *UnsupportedCollectionError) Error() string {
+	return fmt.Sprintf("Direct reads of %s are not supported: collection type %s", this.Namespace, this.Type)
+}
+
+func (this readStrategy) String() string {
+	switch this {
+	case naturalRead:
+		return "natural order"
+	case viewRead:
+		return "view aggregation"
+	case timeSeriesRead:
+		return "time series aggregation"
+	default:
+		return "_id order"
+	}
+}
+
+// returns the listCollections entry for a namespace or nil when the
+// collection does not exist
+func FindCollection(session *mgo.Session, db string, col string) (*CollectionInfo, error) {
+	infos, err := listCollections(session, db, bson.M{"name": col})
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+func (this *CollectionInfo) IsCapped() bool {
+	capped, _ := this.Options["capped"].(bool)
+	return capped
+}
+
+// the name of the time field of a time series collection
+func (this *CollectionInfo) TimeField() string {
+	if ts, ok := this.Options["timeseries"].(bson.M); ok {
+		field, _ := ts["timeField"].(string)
+		return field
+	}
+	return ""
+}
+
+// picks how to read a collection. a missing collection is read in _id order
+// and yields nothing
+func (this *CollectionInfo) readStrategy(ns string) (readStrategy, error) {
+	if this == nil {
+		return idOrderRead, nil
+	}
+	switch this.Type {
+	case "collection", "":
+		if this.IsCapped() {
+			return naturalRead, nil
+		}
+		return idOrderRead, nil
+	case "view":
+		return viewRead, nil
+	case "timeseries":
+		if this.TimeField() == "" {
+			return idOrderRead, &UnsupportedCollectionError{Namespace: ns, Type: "timeseries without a timeField"}
+		}
+		return timeSeriesRead, nil
+	default:
+		return idOrderRead, &UnsupportedCollectionError{Namespace: ns, Type: this.Type}
+	}
+}
+
+// looks up the strategy for ns. when the collection cannot be listed it is
+// read as a normal collection
+func (ctx *OpCtx) directReadStrategy(s *mgo.Session, n *N, ns string) (readStrategy, *CollectionInfo, error) {
+	info, err := FindCollection(s, n.database, n.collection)
+	if err != nil {
+		ctx.log.Printf("Unable to determine the type of %s. Reading it as a collection: %s", ns, err)
+		return idOrderRead, nil, nil
+	}
+	strategy, err := info.readStrategy(ns)
+	return strategy, info, err
+}
+
+// the query of a read in $natural order, unless sorted otherwise
+func (this *DirectReadQuery) natural() *DirectReadQuery {
+	if !this.idOrdered() {
+		return this
+	}
+	natural := *this
+	natural.Sort = []string{"$natural"}
+	return &natural
+}
+
+// an aggregation which reads a view or a time series collection from pos
+func (this *DirectReadQuery) pipeline(strategy readStrategy, info *CollectionInfo, pos *readPosition, projection bson.M) []bson.M {
+	var pipeline []bson.M
+	match := this.Query
+	if strategy == timeSeriesRead {
+		timeField := info.TimeField()
+		if pos.lastTime != nil {
+			resume := bson.M{timeField: bson.M{"$gte": pos.lastTime}}
+			if len(match) == 0 {
+				match = resume
+			} else {
+				match = bson.M{"$and": []bson.M{match, resume}}
+			}
+		}
+		if len(match) > 0 {
+			pipeline = append(pipeline, bson.M{"$match": match})
+		}
+		pipeline = append(pipeline, bson.M{"$sort": bson.D{{Name: timeField, Value: 1}, {Name: "_id", Value: 1}}})
+		if pos.ties > 0 {
+			pipeline = append(pipeline, bson.M{"$skip": pos.ties})
+		}
+	} else {
+		if len(match) > 0 {
+			pipeline = append(pipeline, bson.M{"$match": match})
+		}
+		if !this.idOrdered() {
+			pipeline = append(pipeline, bson.M{"$sort": keyDoc(this.Sort)})
+		}
+		if pos.read > 0 {
+			pipeline = append(pipeline, bson.M{"$skip": pos.read})
+		}
+	}
+	if projection != nil {
+		pipeline = append(pipeline, bson.M{"$project": projection})
+	}
+	return pipeline
+}
+
+// opens a read of c from pos without a snapshot
+func (this *DirectReadQuery) iter(c *mgo.Collection, strategy readStrategy, info *CollectionInfo, pos *readPosition, projection bson.M, batchSize int) *mgo.Iter {
+	switch strategy {
+	case viewRead, timeSeriesRead:
+		return c.Pipe(this.pipeline(strategy, info, pos, projection)).Batch(batchSize).Iter()
+	case naturalRead:
+		return this.natural().query(c, pos.lastId, pos.read, projection, batchSize).Iter()
+	default:
+		return this.query(c, pos.lastId, pos.read, projection, batchSize).Iter()
+	}
+}
+
+// records a document read
+func (this *readPosition) advance(strategy readStrategy, info *CollectionInfo, id interface{}, raw *bson.Raw) {
+	this.lastId = id
+	this.read++
+	if strategy != timeSeriesRead {
+		return
+	}
+	var doc bson.M
+	if err := raw.Unmarshal(&doc); err != nil {
+		return
+	}
+	t := doc[info.TimeField()]
+	if sameTime(t, this.lastTime) {
+		this.ties++
+	} else {
+		this.lastTime = t
+		this.ties = 1
+	}
+}
+
+func sameTime(a interface{}, b interface{}) bool {
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			return ta.Equal(tb)
+		}
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// true when ns can be read by a parallel collection scan. views, time series
+// and capped collections and reads with a DirectReadQuery cannot
+func (ctx *OpCtx) scanSupported(session *mgo.Session, n *N, ns string, options *Options) bool {
+	if options.hasDirectReadQuery(ns) {
+		return false
+	}
+	s := session.Copy()
+	defer s.Close()
+	info, err := FindCollection(s, n.database, n.collection)
+	return canScan(info, err, ns)
+}
+
+// err is the error listing the collection. a collection which cannot be
+// listed, or does not exist yet, is scanned as a plain collection
+func canScan(info *CollectionInfo, err error, ns string) bool {
+	if err != nil || info == nil {
+		return true
+	}
+	strategy, err := info.readStrategy(ns)
+	return err == nil && strategy == idOrderRead
+}
@@ -0,0 +1,140 @@
+package gtm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestReadStrategy(t *testing.T) {
+	tests := []struct {
+		name        string
+		info        *CollectionInfo
+		want        readStrategy
+		unsupported string
+	}{
+		{name: "missing", want: idOrderRead},
+		{name: "collection", info: &CollectionInfo{Type: "collection"}, want: idOrderRead},
+		{name: "no type", info: &CollectionInfo{}, want: idOrderRead},
+		{name: "capped", info: &CollectionInfo{Type: "collection", Options: bson.M{"capped": true}}, want: naturalRead},
+		{name: "view", info: &CollectionInfo{Type: "view", Options: bson.M{"viewOn": "c"}}, want: viewRead},
+		{
+			name: "time series",
+			info: &CollectionInfo{Type: "timeseries", Options: bson.M{"timeseries": bson.M{"timeField": "at"}}},
+			want: timeSeriesRead,
+		},
+		{
+			name:        "time series without a time field",
+			info:        &CollectionInfo{Type: "timeseries"},
+			want:        idOrderRead,
+			unsupported: "timeseries without a timeField",
+		},
+		{name: "unknown type", info: &CollectionInfo{Type: "queue"}, want: idOrderRead, unsupported: "queue"},
+	}
+	for _, test := range tests {
+		got, err := test.info.readStrategy("db.c")
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+		if test.unsupported == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		if uerr, ok := err.(*UnsupportedCollectionError); !ok || uerr.Namespace != "db.c" || uerr.Type != test.unsupported {
+			t.Errorf("%s: got %v, want an UnsupportedCollectionError for %s", test.name, err, test.unsupported)
+		}
+	}
+}
+
+func TestScanSupported(t *testing.T) {
+	tests := []struct {
+		name string
+		info *CollectionInfo
+		err  error
+		want bool
+	}{
+		{name: "collection", info: &CollectionInfo{Type: "collection"}, want: true},
+		{name: "not created yet", want: true},
+		{name: "listing failed", err: errors.New("unauthorized"), want: true},
+		{name: "capped", info: &CollectionInfo{Type: "collection", Options: bson.M{"capped": true}}},
+		{name: "view", info: &CollectionInfo{Type: "view"}},
+		{name: "time series", info: &CollectionInfo{Type: "timeseries", Options: bson.M{"timeseries": bson.M{"timeField": "at"}}}},
+		{name: "unsupported", info: &CollectionInfo{Type: "queue"}},
+	}
+	for _, test := range tests {
+		if got := canScan(test.info, test.err, "db.c"); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+	// a query is sent to the server so the collection is not looked up
+	ctx := &OpCtx{}
+	options := &Options{DirectReadQueries: map[string]*DirectReadQuery{"db.c": {Query: bson.M{"a": 1}}}}
+	if ctx.scanSupported(nil, &N{database: "db", collection: "c"}, "db.c", options) {
+		t.Errorf("expected a read with a DirectReadQuery not to be scanned")
+	}
+}
+
+func TestReadPipeline(t *testing.T) {
+	series := &CollectionInfo{Type: "timeseries", Options: bson.M{"timeseries": bson.M{"timeField": "at"}}}
+	bySeries := bson.M{"$sort": bson.D{{Name: "at", Value: 1}, {Name: "_id", Value: 1}}}
+	tests := []struct {
+		name     string
+		spec     DirectReadQuery
+		strategy readStrategy
+		pos      readPosition
+		want     []bson.M
+	}{
+		{name: "view", strategy: viewRead},
+		{
+			name:     "view resumed",
+			spec:     DirectReadQuery{Query: bson.M{"a": 1}, Sort: []string{"-b"}},
+			strategy: viewRead,
+			pos:      readPosition{read: 4},
+			want:     []bson.M{{"$match": bson.M{"a": 1}}, {"$sort": bson.D{{Name: "b", Value: -1}}}, {"$skip": 4}},
+		},
+		{name: "time series", strategy: timeSeriesRead, want: []bson.M{bySeries}},
+		{
+			name:     "time series resumed after ties",
+			spec:     DirectReadQuery{Query: bson.M{"a": 1}},
+			strategy: timeSeriesRead,
+			pos:      readPosition{lastTime: 10, ties: 2},
+			want: []bson.M{
+				{"$match": bson.M{"$and": []bson.M{{"a": 1}, {"at": bson.M{"$gte": 10}}}}},
+				bySeries,
+				{"$skip": 2},
+			},
+		},
+	}
+	for _, test := range tests {
+		pos := test.pos
+		if got := test.spec.pipeline(test.strategy, series, &pos, nil); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+	if got := (&DirectReadQuery{}).natural().Sort; !reflect.DeepEqual(got, []string{"$natural"}) {
+		t.Errorf("got sort %v for a capped collection, want $natural", got)
+	}
+	sorted := &DirectReadQuery{Sort: []string{"b"}}
+	if sorted.natural() != sorted {
+		t.Errorf("expected a sorted query to keep its sort")
+	}
+}
+
+func TestReadPositionTies(t *testing.T) {
+	info := &CollectionInfo{Type: "timeseries", Options: bson.M{"timeseries": bson.M{"timeField": "at"}}}
+	pos := &readPosition{}
+	for i, at := range []int{1, 2, 2, 2} {
+		data, err := bson.Marshal(bson.M{"_id": i, "at": at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos.advance(timeSeriesRead, info, i, &bson.Raw{Kind: 0x03, Data: data})
+	}
+	if pos.read != 4 || pos.lastId != 3 || pos.lastTime != 2 || pos.ties != 3 {
+		t.Errorf("got %+v, want 4 read up to id 3 with 3 ties at 2", *pos)
+	}
+}
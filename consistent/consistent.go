@@ -1,21 +1,49 @@
 package consistent
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+
 	"github.com/BurntSushi/toml"
 	"github.com/globalsign/mgo/bson"
 	"github.com/rwynn/gtm"
 	"github.com/serialx/hashring"
 )
 
+const (
+	PartitionById        = "id"
+	PartitionByNamespace = "namespace"
+	PartitionByField     = "field"
+)
+
+// the number of document ids whose partition key is remembered by default
+const DefaultKeyCacheSize = 100000
+
+// returns the string used to place an operation on the hash ring.
+// ok should be false if a key cannot be determined for the operation.
+type KeyFunc func(*gtm.Op) (key string, ok bool)
+
 type ConfigOptions struct {
-	Workers []string
+	Workers        []string
+	Weights        map[string]int
+	PartitionKey   string
+	PartitionField string
+	CommandWorker  string
+	KeyCacheSize   int
+	KeyFunc        KeyFunc `toml:"-"`
 }
 
 var EmptyWorkers = errors.New("config not found or workers empty")
 var InvalidWorkers = errors.New("workers must be an array of string")
 var WorkerMissing = errors.New("the specified worker was not found in the config")
+var InvalidWeight = errors.New("worker weights must be positive and refer to a configured worker")
+var InvalidPartitionKey = errors.New("partition key must be one of id, namespace or field")
+var PartitionFieldMissing = errors.New("a partition field is required when partitioning by field")
+var CommandWorkerMissing = errors.New("the command worker was not found in the config")
+var InvalidKeyCacheSize = errors.New("the key cache size must not be negative")
 
 // returns an operation filter which uses a consistent hash to determine
 // if the operation will be accepted for processing. can be used to distribute work.
@@ -23,12 +51,15 @@ var WorkerMissing = errors.New("the specified worker was not found in the config
 // configFile:	a file path to a TOML document.  the document should contain
 // a property named 'Workers' which is a list of all the workers participating. e.g.
 // workers = [ "Tom", "Dick", "Harry" ]
+// the document may also contain the optional properties 'Weights', 'PartitionKey',
+// 'PartitionField', 'CommandWorker' and 'KeyCacheSize' described in
+// ConsistentHashFilterFromOptions
 func ConsistentHashFilterFromFile(name string, configFile string) (gtm.OpFilter, error) {
 	var config ConfigOptions
 	if _, err := toml.DecodeFile(configFile, &config); err != nil {
 		return nil, EmptyWorkers
 	} else {
-		return ConsistentHashFilter(name, config.Workers)
+		return ConsistentHashFilterFromOptions(name, &config)
 	}
 }
 
@@ -36,10 +67,36 @@ func ConsistentHashFilterFromFile(name string, configFile string) (gtm.OpFilter,
 // if the operation will be accepted for processing. can be used to distribute work.
 // name:	the name of the worker creating this filter. e.g. "Harry"
 // document:	a map with a string key 'workers' which has a corresponding
-//				slice of string representing the available workers
+// slice of string representing the available workers
+// the optional keys 'weights', 'partitionKey', 'partitionField', 'commandWorker'
+// and 'keyCacheSize' map to the fields of ConfigOptions
 func ConsistentHashFilterFromDocument(name string, document map[string]interface{}) (gtm.OpFilter, error) {
-	workers := document["workers"]
-	return ConsistentHashFilter(name, workers.([]string))
+	config := &ConfigOptions{}
+	workers, err := toStrings(document["workers"])
+	if err != nil {
+		return nil, err
+	}
+	config.Workers = workers
+	if weights, ok := document["weights"]; ok {
+		if config.Weights, err = toWeights(weights); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := document["partitionKey"].(string); ok {
+		config.PartitionKey = key
+	}
+	if field, ok := document["partitionField"].(string); ok {
+		config.PartitionField = field
+	}
+	if worker, ok := document["commandWorker"].(string); ok {
+		config.CommandWorker = worker
+	}
+	if size, ok := document["keyCacheSize"]; ok {
+		if config.KeyCacheSize, ok = toInt(size); !ok {
+			return nil, InvalidKeyCacheSize
+		}
+	}
+	return ConsistentHashFilterFromOptions(name, config)
 }
 
 // returns an operation filter which uses a consistent hash to determine
@@ -47,36 +104,293 @@ func ConsistentHashFilterFromDocument(name string, document map[string]interface
 // name:	the name of the worker creating this filter. e.g. "Harry"
 // workers:	a slice of strings representing the available worker names
 func ConsistentHashFilter(name string, workers []string) (gtm.OpFilter, error) {
-	if len(workers) == 0 {
+	return ConsistentHashFilterFromOptions(name, &ConfigOptions{Workers: workers})
+}
+
+// returns an operation filter which uses a consistent hash to determine
+// if the operation will be accepted for processing. can be used to distribute work.
+// name:	the name of the worker creating this filter. e.g. "Harry"
+// config:	the workers participating plus optional tuning.
+// Weights gives each worker a relative share of the ring. workers not listed get a weight of 1.
+// PartitionKey "id" (default) hashes op.Id, "namespace" hashes op.Namespace and
+// "field" hashes the value at PartitionField, a dotted path into op.Data.
+// partitioning by field needs the full document. deletes and updates read with
+// UpdateDataAsDelta carry no document so they follow the key last seen for
+// their document id. the keys of the last KeyCacheSize ids are remembered,
+// DefaultKeyCacheSize when zero. an id not seen since the filter was created
+// is placed by op.Id, which may be another worker than the one which got the
+// earlier ops of the document.
+// KeyFunc is a custom key function and takes precedence over PartitionKey.
+// ops it returns no key for are placed in the same way.
+// CommandWorker is the single worker which accepts ops without an id such as drops.
+// when empty these ops are accepted by every worker
+func ConsistentHashFilterFromOptions(name string, config *ConfigOptions) (gtm.OpFilter, error) {
+	if config == nil || len(config.Workers) == 0 {
 		return nil, EmptyWorkers
 	}
-	found := false
-	ring := hashring.New(workers)
-	for _, worker := range workers {
-		if worker == name {
-			found = true
-		}
-	}
-	if !found {
+	if !contains(config.Workers, name) {
 		return nil, WorkerMissing
 	}
+	if config.CommandWorker != "" && !contains(config.Workers, config.CommandWorker) {
+		return nil, CommandWorkerMissing
+	}
+	if config.KeyCacheSize < 0 {
+		return nil, InvalidKeyCacheSize
+	}
+	keyFunc, err := partitionKeyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := newRing(config)
+	if err != nil {
+		return nil, err
+	}
+	var keys *keyCache
+	if config.KeyFunc != nil || strings.ToLower(config.PartitionKey) == PartitionByField {
+		size := config.KeyCacheSize
+		if size == 0 {
+			size = DefaultKeyCacheSize
+		}
+		keys = newKeyCache(size)
+	}
+	commandWorker := config.CommandWorker
 	return func(op *gtm.Op) bool {
-		if op.Id != nil {
-			var idStr string
-			switch op.Id.(type) {
-			case bson.ObjectId:
-				idStr = op.Id.(bson.ObjectId).Hex()
-			default:
-				idStr = fmt.Sprintf("%v", op.Id)
+		if op.Id == nil {
+			if commandWorker != "" {
+				return name == commandWorker
 			}
-			who, ok := ring.GetNode(idStr)
-			if ok {
-				return name == who
-			} else {
-				return false
+			return true
+		}
+		key, ok := keyFunc(op)
+		if ok {
+			if keys != nil && !op.IsDelete() {
+				keys.put(idKey(op), key)
 			}
 		} else {
-			return true
+			if op.IsUpdate() && op.Data == nil {
+				// the document has not been fetched yet. defer the
+				// decision until the filter runs against the full document
+				return true
+			}
+			if key, ok = keys.get(idKey(op)); !ok {
+				key = idKey(op)
+			}
+			if op.IsDelete() {
+				keys.remove(idKey(op))
+			}
+		}
+		who, ok := ring.GetNode(key)
+		if ok {
+			return name == who
+		} else {
+			return false
 		}
 	}, nil
 }
+
+// remembers the partition key of recently seen document ids so that ops
+// without a document follow the earlier ops of the same document. the least
+// recently used ids are forgotten first
+type keyCache struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+type cachedKey struct {
+	id  string
+	key string
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{size: size, order: list.New(), ids: make(map[string]*list.Element)}
+}
+
+func (this *keyCache) put(id string, key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if e, ok := this.ids[id]; ok {
+		e.Value.(*cachedKey).key = key
+		this.order.MoveToFront(e)
+		return
+	}
+	this.ids[id] = this.order.PushFront(&cachedKey{id: id, key: key})
+	if this.order.Len() > this.size {
+		oldest := this.order.Back()
+		this.order.Remove(oldest)
+		delete(this.ids, oldest.Value.(*cachedKey).id)
+	}
+}
+
+func (this *keyCache) get(id string) (string, bool) {
+	if this == nil {
+		return "", false
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if e, ok := this.ids[id]; ok {
+		this.order.MoveToFront(e)
+		return e.Value.(*cachedKey).key, true
+	}
+	return "", false
+}
+
+func (this *keyCache) remove(id string) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if e, ok := this.ids[id]; ok {
+		this.order.Remove(e)
+		delete(this.ids, id)
+	}
+}
+
+func newRing(config *ConfigOptions) (*hashring.HashRing, error) {
+	if len(config.Weights) == 0 {
+		return hashring.New(config.Workers), nil
+	}
+	weights := make(map[string]int)
+	for _, worker := range config.Workers {
+		weights[worker] = 1
+	}
+	for worker, weight := range config.Weights {
+		if weight < 1 || !contains(config.Workers, worker) {
+			return nil, InvalidWeight
+		}
+		weights[worker] = weight
+	}
+	return hashring.NewWithWeights(weights), nil
+}
+
+func partitionKeyFunc(config *ConfigOptions) (KeyFunc, error) {
+	if config.KeyFunc != nil {
+		return config.KeyFunc, nil
+	}
+	switch strings.ToLower(config.PartitionKey) {
+	case "", PartitionById:
+		return func(op *gtm.Op) (string, bool) {
+			return idKey(op), true
+		}, nil
+	case PartitionByNamespace:
+		return func(op *gtm.Op) (string, bool) {
+			return op.Namespace, true
+		}, nil
+	case PartitionByField:
+		if config.PartitionField == "" {
+			return nil, PartitionFieldMissing
+		}
+		path := strings.Split(config.PartitionField, ".")
+		return func(op *gtm.Op) (string, bool) {
+			if val, ok := lookup(op.Data, path); ok {
+				return keyString(val), true
+			}
+			return "", false
+		}, nil
+	default:
+		return nil, InvalidPartitionKey
+	}
+}
+
+func idKey(op *gtm.Op) string {
+	return keyString(op.Id)
+}
+
+func keyString(val interface{}) string {
+	switch v := val.(type) {
+	case bson.ObjectId:
+		return v.Hex()
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func lookup(data map[string]interface{}, path []string) (interface{}, bool) {
+	var current interface{} = data
+	for _, field := range path {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			current = m[field]
+		case bson.M:
+			current = m[field]
+		default:
+			return nil, false
+		}
+		if current == nil {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func contains(workers []string, name string) bool {
+	for _, worker := range workers {
+		if worker == name {
+			return true
+		}
+	}
+	return false
+}
+
+func toStrings(val interface{}) ([]string, error) {
+	switch v := val.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		workers := make([]string, 0, len(v))
+		for _, w := range v {
+			s, ok := w.(string)
+			if !ok {
+				return nil, InvalidWorkers
+			}
+			workers = append(workers, s)
+		}
+		return workers, nil
+	case nil:
+		return nil, EmptyWorkers
+	default:
+		return nil, InvalidWorkers
+	}
+}
+
+func toInt(val interface{}) (int, bool) {
+	switch n := val.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	default:
+		return 0, false
+	}
+}
+
+func toWeights(val interface{}) (map[string]int, error) {
+	weights := make(map[string]int)
+	var m map[string]interface{}
+	switch v := val.(type) {
+	case map[string]int:
+		return v, nil
+	case map[string]interface{}:
+		m = v
+	case bson.M:
+		m = v
+	default:
+		return nil, InvalidWeight
+	}
+	for worker, w := range m {
+		n, ok := toInt(w)
+		if !ok {
+			return nil, InvalidWeight
+		}
+		weights[worker] = n
+	}
+	return weights, nil
+}
@@ -0,0 +1,276 @@
+package consistent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+)
+
+var testWorkers = []string{"a", "b", "c"}
+
+// builds one filter per worker from the same config
+func testFilters(t *testing.T, config ConfigOptions) map[string]gtm.OpFilter {
+	filters := make(map[string]gtm.OpFilter)
+	for _, worker := range config.Workers {
+		c := config
+		filter, err := ConsistentHashFilterFromOptions(worker, &c)
+		if err != nil {
+			t.Fatalf("filter for %s: %s", worker, err)
+		}
+		filters[worker] = filter
+	}
+	return filters
+}
+
+// returns the workers which accept the op, in worker order
+func accepted(config ConfigOptions, filters map[string]gtm.OpFilter, op *gtm.Op) []string {
+	var workers []string
+	for _, worker := range config.Workers {
+		if filters[worker](op) {
+			workers = append(workers, worker)
+		}
+	}
+	return workers
+}
+
+func acceptedBy(t *testing.T, config ConfigOptions, filters map[string]gtm.OpFilter, op *gtm.Op) string {
+	workers := accepted(config, filters, op)
+	if len(workers) != 1 {
+		t.Fatalf("op %v accepted by %v, want exactly one worker", op.Id, workers)
+	}
+	return workers[0]
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		worker string
+		config ConfigOptions
+		err    error
+	}{
+		{"no workers", "a", ConfigOptions{}, EmptyWorkers},
+		{"unknown worker", "d", ConfigOptions{Workers: testWorkers}, WorkerMissing},
+		{"zero weight", "a", ConfigOptions{Workers: testWorkers, Weights: map[string]int{"a": 0}}, InvalidWeight},
+		{"weight for unknown worker", "a", ConfigOptions{Workers: testWorkers, Weights: map[string]int{"d": 2}}, InvalidWeight},
+		{"bad partition key", "a", ConfigOptions{Workers: testWorkers, PartitionKey: "other"}, InvalidPartitionKey},
+		{"field without name", "a", ConfigOptions{Workers: testWorkers, PartitionKey: "field"}, PartitionFieldMissing},
+		{"unknown command worker", "a", ConfigOptions{Workers: testWorkers, CommandWorker: "d"}, CommandWorkerMissing},
+		{"negative key cache", "a", ConfigOptions{Workers: testWorkers, KeyCacheSize: -1}, InvalidKeyCacheSize},
+		{"valid", "a", ConfigOptions{Workers: testWorkers, PartitionKey: "Field", PartitionField: "tenant"}, nil},
+	}
+	for _, test := range tests {
+		c := test.config
+		if _, err := ConsistentHashFilterFromOptions(test.worker, &c); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestFromDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		document map[string]interface{}
+		err      error
+	}{
+		{"no workers", map[string]interface{}{}, EmptyWorkers},
+		{"workers not strings", map[string]interface{}{"workers": []interface{}{1}}, InvalidWorkers},
+		{"weights not numbers", map[string]interface{}{"workers": []interface{}{"a"}, "weights": map[string]interface{}{"a": "x"}}, InvalidWeight},
+		{"key cache not a number", map[string]interface{}{"workers": []interface{}{"a"}, "keyCacheSize": "x"}, InvalidKeyCacheSize},
+		{"full", map[string]interface{}{
+			"workers":        []interface{}{"a", "b"},
+			"weights":        map[string]interface{}{"a": float64(2)},
+			"partitionKey":   "field",
+			"partitionField": "tenant",
+			"commandWorker":  "b",
+			"keyCacheSize":   int64(10),
+		}, nil},
+	}
+	for _, test := range tests {
+		if _, err := ConsistentHashFilterFromDocument("a", test.document); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestPartitionById(t *testing.T) {
+	config := ConfigOptions{Workers: testWorkers}
+	filters := testFilters(t, config)
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		id := bson.NewObjectId()
+		insert := &gtm.Op{Id: id, Operation: "i", Namespace: "db.c", Data: map[string]interface{}{"_id": id}}
+		worker := acceptedBy(t, config, filters, insert)
+		del := &gtm.Op{Id: id, Operation: "d", Namespace: "db.c"}
+		if got := acceptedBy(t, config, filters, del); got != worker {
+			t.Errorf("delete of %v went to %s, insert to %s", id, got, worker)
+		}
+		counts[worker]++
+	}
+	for _, worker := range testWorkers {
+		if counts[worker] == 0 {
+			t.Errorf("worker %s got no ops", worker)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	config := ConfigOptions{Workers: []string{"a", "b"}, Weights: map[string]int{"a": 9}}
+	filters := testFilters(t, config)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		op := &gtm.Op{Id: fmt.Sprintf("doc%d", i), Operation: "i", Namespace: "db.c"}
+		counts[acceptedBy(t, config, filters, op)]++
+	}
+	if counts["a"] <= counts["b"]*3 {
+		t.Errorf("expected the heavier worker to get most ops, got %v", counts)
+	}
+}
+
+func TestPartitionByNamespace(t *testing.T) {
+	config := ConfigOptions{Workers: testWorkers, PartitionKey: "namespace"}
+	filters := testFilters(t, config)
+	tests := []struct {
+		namespace string
+	}{
+		{"db.a"}, {"db.b"}, {"other.c"},
+	}
+	for _, test := range tests {
+		worker := ""
+		for i := 0; i < 20; i++ {
+			op := &gtm.Op{Id: i, Operation: "i", Namespace: test.namespace}
+			got := acceptedBy(t, config, filters, op)
+			if worker == "" {
+				worker = got
+			} else if got != worker {
+				t.Errorf("%s: op %d went to %s, want %s", test.namespace, i, got, worker)
+			}
+		}
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	config := ConfigOptions{
+		Workers: testWorkers,
+		KeyFunc: func(op *gtm.Op) (string, bool) {
+			if tenant, ok := op.Data["tenant"].(string); ok {
+				return tenant, true
+			}
+			return "", false
+		},
+	}
+	filters := testFilters(t, config)
+	want := make(map[string]string)
+	tests := []struct {
+		id     int
+		tenant string
+	}{
+		{1, "x"}, {2, "x"}, {3, "y"}, {4, "y"}, {5, "x"},
+	}
+	for _, test := range tests {
+		op := &gtm.Op{Id: test.id, Operation: "i", Namespace: "db.c", Data: map[string]interface{}{"tenant": test.tenant}}
+		got := acceptedBy(t, config, filters, op)
+		if w, ok := want[test.tenant]; ok && w != got {
+			t.Errorf("tenant %s: doc %d went to %s, want %s", test.tenant, test.id, got, w)
+		}
+		want[test.tenant] = got
+	}
+	// an op without a key follows the earlier ops of its document
+	for _, test := range tests {
+		del := &gtm.Op{Id: test.id, Operation: "d", Namespace: "db.c"}
+		if got := acceptedBy(t, config, filters, del); got != want[test.tenant] {
+			t.Errorf("delete of doc %d went to %s, want %s", test.id, got, want[test.tenant])
+		}
+	}
+}
+
+func TestPartitionByField(t *testing.T) {
+	config := ConfigOptions{Workers: testWorkers, PartitionKey: "field", PartitionField: "owner.tenant"}
+	filters := testFilters(t, config)
+	tenants := make(map[string]string)
+	docs := make(map[int]string)
+	for i := 0; i < 60; i++ {
+		tenant := fmt.Sprintf("t%d", i%6)
+		op := &gtm.Op{Id: i, Operation: "i", Namespace: "db.c", Data: map[string]interface{}{
+			"owner": map[string]interface{}{"tenant": tenant},
+		}}
+		got := acceptedBy(t, config, filters, op)
+		if w, ok := tenants[tenant]; ok && w != got {
+			t.Errorf("tenant %s: doc %d went to %s, want %s", tenant, i, got, w)
+		}
+		tenants[tenant] = got
+		docs[i] = got
+	}
+	tests := []struct {
+		name string
+		op   func(id int) *gtm.Op
+	}{
+		{"delta update", func(id int) *gtm.Op {
+			return &gtm.Op{Id: id, Operation: "u", Namespace: "db.c", Data: map[string]interface{}{
+				"$set": map[string]interface{}{"n": 1},
+			}}
+		}},
+		{"delete", func(id int) *gtm.Op {
+			return &gtm.Op{Id: id, Operation: "d", Namespace: "db.c"}
+		}},
+	}
+	for _, test := range tests {
+		for id, worker := range docs {
+			if got := acceptedBy(t, config, filters, test.op(id)); got != worker {
+				t.Errorf("%s of doc %d went to %s, want %s", test.name, id, got, worker)
+			}
+		}
+	}
+	// an update whose document is not fetched yet is deferred to every worker
+	pending := &gtm.Op{Id: 1, Operation: "u", Namespace: "db.c"}
+	if workers := accepted(config, filters, pending); len(workers) != len(testWorkers) {
+		t.Errorf("unfetched update accepted by %v, want every worker", workers)
+	}
+}
+
+func TestKeyCacheEviction(t *testing.T) {
+	cache := newKeyCache(2)
+	cache.put("1", "x")
+	cache.put("2", "y")
+	if _, ok := cache.get("1"); !ok {
+		t.Fatalf("expected id 1 to be cached")
+	}
+	// 2 is now the least recently used
+	cache.put("3", "z")
+	if _, ok := cache.get("2"); ok {
+		t.Errorf("expected id 2 to be evicted")
+	}
+	if key, ok := cache.get("1"); !ok || key != "x" {
+		t.Errorf("got %s %v for id 1, want x", key, ok)
+	}
+	cache.remove("3")
+	if _, ok := cache.get("3"); ok {
+		t.Errorf("expected id 3 to be removed")
+	}
+	var none *keyCache
+	if _, ok := none.get("1"); ok {
+		t.Errorf("expected a nil cache to hold nothing")
+	}
+	none.remove("1")
+}
+
+func TestCommandWorker(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    []string
+	}{
+		{"every worker", "", testWorkers},
+		{"one worker", "b", []string{"b"}},
+	}
+	drop := &gtm.Op{Operation: "c", Namespace: "db.$cmd", Data: map[string]interface{}{"drop": "c"}}
+	for _, test := range tests {
+		config := ConfigOptions{Workers: testWorkers, CommandWorker: test.command}
+		filters := testFilters(t, config)
+		got := accepted(config, filters, drop)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: command accepted by %v, want %v", test.name, got, test.want)
+		}
+	}
+}
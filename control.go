@@ -0,0 +1,131 @@
+package gtm
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// returned by control operations on a stopped context
+var ErrStopped = errors.New("context stopped")
+
+// returned when a direct read is started on a context which closes OpC once
+// its replay is done
+var ErrBounded = errors.New("context is bounded")
+
+// shared by every goroutine of a context so that a pause holds them all
+type pauseGate struct {
+	lock    sync.Mutex
+	resumeC chan bool // non nil while paused and closed on resume
+}
+
+// a request for TailOps to restart the oplog query
+type seekRequest struct {
+	ts    bson.MongoTimestamp
+	epoch int64
+}
+
+// ops read before the seek with epoch and newer than ts will be read again
+type seekMark struct {
+	lock  sync.Mutex
+	ts    bson.MongoTimestamp
+	epoch int64
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{}
+}
+
+func (this *pauseGate) pause() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.resumeC == nil {
+		this.resumeC = make(chan bool)
+	}
+}
+
+func (this *pauseGate) resume() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.resumeC != nil {
+		close(this.resumeC)
+		this.resumeC = nil
+	}
+}
+
+func (this *pauseGate) isPaused() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.resumeC != nil
+}
+
+// blocks while paused. returns false if stopC closes first
+func (this *pauseGate) wait(stopC chan bool) bool {
+	this.lock.Lock()
+	resumeC := this.resumeC
+	this.lock.Unlock()
+	if resumeC == nil {
+		return true
+	}
+	select {
+	case <-stopC:
+		return false
+	case <-resumeC:
+		return true
+	}
+}
+
+func (this *seekMark) get() (bson.MongoTimestamp, int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.ts, this.epoch
+}
+
+// records a seek to ts. returns the epoch of ops read after the seek
+func (this *seekMark) set(ts bson.MongoTimestamp, invalidate bool) int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if invalidate {
+		this.ts = ts
+		this.epoch++
+	}
+	return this.epoch
+}
+
+// replaces any seek which TailOps has not picked up yet
+func (ctx *OpCtx) requestSeek(r seekRequest) {
+	for {
+		select {
+		case ctx.seekC <- r:
+			return
+		default:
+			select {
+			case <-ctx.seekC:
+			default:
+			}
+		}
+	}
+}
+
+// true for an op read from the oplog before a Seek to an earlier timestamp.
+// the oplog query is restarted at the seek point so the op will be read again
+func (ctx *OpCtx) invalidated(op *Op) bool {
+	if !op.IsSourceOplog() {
+		return false
+	}
+	ts, epoch := ctx.seek.get()
+	return op.seekEpoch < epoch && CompareTimestamps(op.Timestamp, ts) > 0
+}
+
+// drops buffered entries invalidated by a Seek
+func (this *OpBuf) invalidate(ctx *OpCtx) {
+	entries := this.Entries[:0]
+	for _, op := range this.Entries {
+		if ctx.invalidated(op) {
+			ctx.releaseOp(op)
+		} else {
+			entries = append(entries, op)
+		}
+	}
+	this.Entries = entries
+}
@@ -0,0 +1,206 @@
+package gtm
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func stubCtx() *OpCtx {
+	return &OpCtx{
+		lock:            &sync.Mutex{},
+		DirectReadDoneC: make(chan *DirectReadDone),
+		DirectReadWg:    &sync.WaitGroup{},
+		stopC:           make(chan bool),
+		allWg:           &sync.WaitGroup{},
+		budget:          newMemoryBudget(0),
+	}
+}
+
+func TestForwardDirectReadDone(t *testing.T) {
+	child := stubCtx()
+	multi := &OpCtxMulti{
+		lock:            &sync.Mutex{},
+		contexts:        []*OpCtx{child},
+		DirectReadDoneC: make(chan *DirectReadDone),
+		stopC:           make(chan bool),
+		allWg:           &sync.WaitGroup{},
+	}
+	multi.forwardDirectReadDone(child)
+	child.DirectReadDoneC <- &DirectReadDone{Namespace: "db.a"}
+	if done := <-multi.DirectReadDoneC; done.Namespace != "db.a" {
+		t.Errorf("forwarded %s, want db.a", done.Namespace)
+	}
+	// a forward blocked on an undrained channel must not hold up Stop
+	child.DirectReadDoneC <- &DirectReadDone{Namespace: "db.b"}
+	stopped := make(chan bool)
+	go func() {
+		multi.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Stop blocked on the forwarder")
+	}
+	for range multi.DirectReadDoneC {
+	}
+	child.Stop()
+	if _, ok := <-child.DirectReadDoneC; ok {
+		t.Errorf("expected the child channel to be closed")
+	}
+}
+
+func TestAddDirectReadAfterStop(t *testing.T) {
+	ctx := stubCtx()
+	if !ctx.addDirectRead() {
+		t.Fatalf("expected a read to be added to a running context")
+	}
+	ctx.allWg.Done()
+	ctx.DirectReadWg.Done()
+	ctx.Stop()
+	if ctx.addDirectRead() {
+		t.Errorf("expected no read to be added after Stop")
+	}
+	ctx.Stop()
+}
+
+func TestDirectReadAfterStop(t *testing.T) {
+	ctx := stubCtx()
+	ctx.Stop()
+	if _, err := ctx.DirectRead("db.a", &Options{}); err != ErrStopped {
+		t.Errorf("got %v, want ErrStopped", err)
+	}
+	multi := &OpCtxMulti{
+		lock:         &sync.Mutex{},
+		contexts:     []*OpCtx{stubCtx()},
+		DirectReadWg: &sync.WaitGroup{},
+		stopC:        make(chan bool),
+		allWg:        &sync.WaitGroup{},
+	}
+	multi.Stop()
+	if _, err := multi.DirectRead("db.a", &Options{}); err != ErrStopped {
+		t.Errorf("got %v from the multi context, want ErrStopped", err)
+	}
+	if multi.addDirectRead() {
+		t.Errorf("expected no read to be added after Stop")
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	gate := newPauseGate()
+	stopC := make(chan bool)
+	if !gate.wait(stopC) || gate.isPaused() {
+		t.Fatalf("expected an open gate not to block")
+	}
+	gate.pause()
+	gate.pause()
+	if !gate.isPaused() {
+		t.Fatalf("expected the gate to be paused")
+	}
+	passed := make(chan bool)
+	go func() {
+		passed <- gate.wait(stopC)
+	}()
+	select {
+	case <-passed:
+		t.Fatalf("expected wait to block while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	gate.resume()
+	gate.resume()
+	if ok := <-passed; !ok || gate.isPaused() {
+		t.Errorf("expected resume to release the waiter")
+	}
+	gate.pause()
+	go func() {
+		passed <- gate.wait(stopC)
+	}()
+	close(stopC)
+	if ok := <-passed; ok {
+		t.Errorf("expected wait to return false once stopped")
+	}
+	ctx := stubCtx()
+	ctx.gate = newPauseGate()
+	if err := ctx.Pause(); err != nil || !ctx.IsPaused() {
+		t.Errorf("got %v pausing a running context", err)
+	}
+	ctx.Stop()
+	if err := ctx.Resume(); err != ErrStopped {
+		t.Errorf("got %v resuming a stopped context, want ErrStopped", err)
+	}
+}
+
+func TestSeekEpochs(t *testing.T) {
+	ctx := stubCtx()
+	ctx.seek = &seekMark{}
+	ctx.seekC = make(chan seekRequest, 1)
+	oplogOp := func(ts bson.MongoTimestamp, epoch int64) *Op {
+		return &Op{Source: OplogQuerySource, Timestamp: ts, seekEpoch: epoch}
+	}
+	if ctx.invalidated(oplogOp(10, 0)) {
+		t.Fatalf("expected no op to be invalidated before a seek")
+	}
+	if err := ctx.Seek(5); err != nil {
+		t.Fatalf("seek: %s", err)
+	}
+	tests := []struct {
+		name string
+		op   *Op
+		want bool
+	}{
+		{"read before the seek after its timestamp", oplogOp(10, 0), true},
+		{"read before the seek at its timestamp", oplogOp(5, 0), false},
+		{"read after the seek", oplogOp(10, 1), false},
+		{"direct read", &Op{Source: DirectQuerySource, Timestamp: 10}, false},
+	}
+	for _, test := range tests {
+		if got := ctx.invalidated(test.op); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+	// a second seek replaces the one not yet picked up by the tail
+	ctx.Seek(8)
+	if r := <-ctx.seekC; r.ts != 8 || r.epoch != 2 {
+		t.Errorf("got seek to %d in epoch %d, want 8 in epoch 2", r.ts, r.epoch)
+	}
+	if !ctx.invalidated(oplogOp(10, 1)) || ctx.invalidated(oplogOp(10, 2)) {
+		t.Errorf("expected only ops of earlier epochs to be invalidated")
+	}
+	buf := &OpBuf{Entries: []*Op{oplogOp(7, 1), oplogOp(9, 1), oplogOp(9, 2)}}
+	buf.invalidate(ctx)
+	if len(buf.Entries) != 2 || buf.Entries[0].Timestamp != 7 || buf.Entries[1].seekEpoch != 2 {
+		t.Errorf("got %d entries after invalidating the buffer, want 2", len(buf.Entries))
+	}
+	// Since moves forward without invalidating buffered ops
+	if epoch := ctx.seek.set(20, false); epoch != 2 {
+		t.Errorf("got epoch %d after a forward seek, want 2", epoch)
+	}
+}
+
+func TestEmitEntryStops(t *testing.T) {
+	ctx := stubCtx()
+	ctx.ErrC = make(chan error, 1)
+	ctx.seek = &seekMark{}
+	ctx.stats = &ctxStats{}
+	doc, _ := bson.Marshal(bson.M{"_id": 1})
+	entry := &OpLog{Timestamp: 1, Operation: "i", Namespace: "db.c", Doc: &bson.Raw{Kind: 0x03, Data: doc}}
+	// nothing reads the fetch channel
+	channels := []OpChan{make(OpChan)}
+	emitted := make(chan bool)
+	go func() {
+		emitted <- ctx.emitEntry(entry, 0, channels, &Options{Unmarshal: defaultUnmarshaller})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ctx.Stop()
+	select {
+	case ok := <-emitted:
+		if ok {
+			t.Errorf("expected emitEntry to report the stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("emitEntry blocked on the fetch channel after Stop")
+	}
+}
@@ -0,0 +1,164 @@
+package gtm
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// remembers the documents sent from the oplog while a direct read of their
+// namespace is running. a direct read op for a document already sent from
+// the oplog may hold an older version, or one deleted since, so it is
+// dropped and the oplog version stays the last one seen. likewise once a
+// collection or its database is dropped the rest of its direct read is
+// dropped. every document changed in a namespace during its read is kept,
+// about the size of its _id each, until the read ends
+type directReadTracker struct {
+	lock    sync.Mutex
+	sent    *sync.Cond
+	active  map[string]int
+	seen    map[string]map[string]bool
+	dropped map[string]bool
+	sending map[string]map[string]int
+}
+
+func newDirectReadTracker() *directReadTracker {
+	this := &directReadTracker{
+		active:  make(map[string]int),
+		seen:    make(map[string]map[string]bool),
+		dropped: make(map[string]bool),
+		sending: make(map[string]map[string]int),
+	}
+	this.sent = sync.NewCond(&this.lock)
+	return this
+}
+
+func (this *directReadTracker) begin(ns string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.active[ns] == 0 {
+		this.seen[ns] = make(map[string]bool)
+	}
+	this.active[ns]++
+}
+
+func (this *directReadTracker) end(ns string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.active[ns]--; this.active[ns] <= 0 {
+		delete(this.active, ns)
+		delete(this.seen, ns)
+		delete(this.dropped, ns)
+	}
+}
+
+// the BSON encoding of a document id, which keeps its type so that e.g. the
+// string "1" and the number 1 are different documents
+func docKey(id interface{}) string {
+	if data, err := bson.Marshal(bson.D{{Name: "_id", Value: id}}); err == nil {
+		return string(data)
+	}
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// records an oplog op. returns true if a direct read of its namespace is
+// running. the caller holds the lock
+func (this *directReadTracker) record(op *Op) bool {
+	if db, drop := op.IsDropDatabase(); drop {
+		tracked := false
+		for ns := range this.active {
+			if strings.HasPrefix(ns, db+".") {
+				this.dropped[ns] = true
+				tracked = true
+			}
+		}
+		return tracked
+	} else if col, drop := op.IsDropCollection(); drop {
+		ns := op.GetDatabase() + "." + col
+		if this.active[ns] > 0 {
+			this.dropped[ns] = true
+			return true
+		}
+		return false
+	}
+	seen, ok := this.seen[op.Namespace]
+	if !ok {
+		return false
+	}
+	seen[docKey(op.Id)] = true
+	return true
+}
+
+// true for a direct read op superseded by the oplog. the caller holds the lock
+func (this *directReadTracker) stale(op *Op) bool {
+	if this.dropped[op.Namespace] {
+		return true
+	}
+	return this.seen[op.Namespace][docKey(op.Id)]
+}
+
+// true while a direct read op which the oplog op supersedes is being sent.
+// the caller holds the lock
+func (this *directReadTracker) superseding(op *Op) bool {
+	if db, drop := op.IsDropDatabase(); drop {
+		for ns := range this.sending {
+			if strings.HasPrefix(ns, db+".") {
+				return true
+			}
+		}
+		return false
+	} else if col, drop := op.IsDropCollection(); drop {
+		return len(this.sending[op.GetDatabase()+"."+col]) > 0
+	}
+	return this.sending[op.Namespace][docKey(op.Id)] > 0
+}
+
+// counts the direct read ops of a document being sent. the caller holds the lock
+func (this *directReadTracker) sendingDirect(ns string, id string, delta int) {
+	docs := this.sending[ns]
+	if docs == nil {
+		docs = make(map[string]int)
+		this.sending[ns] = docs
+	}
+	if docs[id] += delta; docs[id] <= 0 {
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(this.sending, ns)
+		}
+	}
+}
+
+// sends op unless it is a stale direct read op. the decision is made under
+// the lock but op is sent without it. a direct read op which passed the check
+// is tracked until it is on OpC, and an oplog op superseding it waits for that,
+// so that a direct read op can never follow the oplog op which superseded it
+func (this *directReadTracker) sendOp(ctx *OpCtx, op *Op, options *Options) {
+	this.lock.Lock()
+	if op.IsSourceDirect() {
+		if this.stale(op) {
+			this.lock.Unlock()
+			atomic.AddInt64(&ctx.stats.directSuppressed, 1)
+			ctx.releaseOp(op)
+			return
+		}
+		// op belongs to the consumer once it is on OpC
+		ns, id := op.Namespace, docKey(op.Id)
+		this.sendingDirect(ns, id, 1)
+		this.lock.Unlock()
+		ctx.deliverOp(op, options)
+		this.lock.Lock()
+		this.sendingDirect(ns, id, -1)
+		this.lock.Unlock()
+		this.sent.Broadcast()
+		return
+	}
+	if this.record(op) {
+		for this.superseding(op) {
+			this.sent.Wait()
+		}
+	}
+	this.lock.Unlock()
+	ctx.deliverOp(op, options)
+}
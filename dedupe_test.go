@@ -0,0 +1,96 @@
+package gtm
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestDirectReadTrackerSendOrder(t *testing.T) {
+	tracker := newDirectReadTracker()
+	ctx := &OpCtx{OpC: make(OpChan), stats: &ctxStats{}, directReads: tracker}
+	options := DefaultOptions()
+	tracker.begin("db.c")
+	direct := &Op{Id: 1, Operation: "i", Namespace: "db.c", Source: DirectQuerySource}
+	update := &Op{Id: 1, Operation: "u", Namespace: "db.c", Source: OplogQuerySource}
+	other := &Op{Id: 3, Operation: "u", Namespace: "db.c", Source: OplogQuerySource}
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go ctx.sendOp(direct, options)
+	waitFor("the direct read op to be sent", func() bool {
+		return atomic.LoadInt64(&ctx.stats.blockedSenders) == 1
+	})
+	go ctx.sendOp(update, options)
+	// the tracker lock is not held while the direct read op waits on OpC
+	go ctx.sendOp(other, options)
+	waitFor("an unrelated oplog op to be sent", func() bool {
+		return atomic.LoadInt64(&ctx.stats.blockedSenders) == 2
+	})
+	var order []*Op
+	for i := 0; i < 3; i++ {
+		select {
+		case op := <-ctx.OpC:
+			order = append(order, op)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out receiving op %d", i)
+		}
+	}
+	position := make(map[*Op]int)
+	for i, op := range order {
+		position[op] = i
+	}
+	if position[direct] > position[update] {
+		t.Errorf("the direct read op was sent after the oplog op which superseded it")
+	}
+
+	// once the oplog has sent the document later direct read ops are stale
+	ctx.sendOp(&Op{Id: 1, Operation: "i", Namespace: "db.c", Source: DirectQuerySource}, options)
+	if n := atomic.LoadInt64(&ctx.stats.directSuppressed); n != 1 {
+		t.Errorf("%d direct read ops suppressed, want 1", n)
+	}
+	tracker.end("db.c")
+	if len(tracker.sending) != 0 || len(tracker.seen) != 0 {
+		t.Errorf("tracker state left after the read: %v %v", tracker.sending, tracker.seen)
+	}
+}
+
+func TestDirectReadTrackerIdTypes(t *testing.T) {
+	oid := bson.NewObjectId()
+	tests := []struct {
+		name   string
+		oplog  interface{}
+		direct interface{}
+		stale  bool
+	}{
+		{"same number", 1, 1, true},
+		{"same object id", oid, bson.ObjectIdHex(oid.Hex()), true},
+		{"same document id", bson.M{"a": 1}, bson.M{"a": 1}, true},
+		{"number and string", 1, "1", false},
+		{"double and int", 1.0, 1, false},
+		{"object id and hex", oid, oid.Hex(), false},
+	}
+	for _, test := range tests {
+		tracker := newDirectReadTracker()
+		tracker.begin("db.c")
+		tracker.lock.Lock()
+		tracker.record(&Op{Id: test.oplog, Operation: "u", Namespace: "db.c", Source: OplogQuerySource})
+		stale := tracker.stale(&Op{Id: test.direct, Operation: "i", Namespace: "db.c", Source: DirectQuerySource})
+		tracker.lock.Unlock()
+		if stale != test.stale {
+			t.Errorf("%s: got stale %v, want %v", test.name, stale, test.stale)
+		}
+		tracker.end("db.c")
+		if len(tracker.seen) != 0 {
+			t.Errorf("%s: ids kept after the read ended", test.name)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package gtm
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// numbers the documents read from each namespace in the order they are read
+type scanSequence struct {
+	lock sync.Mutex
+	next map[string]int64
+}
+
+func newScanSequence() *scanSequence {
+	return &scanSequence{next: make(map[string]int64)}
+}
+
+func (this *scanSequence) advance(ns string) int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.next[ns]++
+	return this.next[ns]
+}
+
+// one direct read of a namespace. the readers started for it, e.g. the
+// cursors of a parallel scan, share its progress and its stopC, which is
+// closed when the context stops or the read is canceled
+type directReadRun struct {
+	id    int64
+	stopC chan bool
+}
+
+func (ctx *OpCtx) newDirectReadRun(stopC chan bool) *directReadRun {
+	return &directReadRun{id: ctx.progress.newRead(), stopC: stopC}
+}
+
+// marks the start of a reader of run for deduplication and progress. nested
+// readers of a run count as one read
+func (ctx *OpCtx) beginDirectRead(session *mgo.Session, run *directReadRun, ns string) {
+	if ctx.directReads != nil {
+		ctx.directReads.begin(ns)
+	}
+	ctx.progress.begin(session, run.id, ns)
+}
+
+// err is the error which ended this reader early, if any. the last reader of
+// run sends the outcome on DirectReadDoneC
+func (ctx *OpCtx) endDirectRead(run *directReadRun, ns string, err error) {
+	if err == nil && isClosed(run.stopC) {
+		err = ErrStopped
+	}
+	if done := ctx.progress.end(run.id, err); done != nil && ctx.DirectReadDoneC != nil {
+		select {
+		case ctx.DirectReadDoneC <- done:
+		case <-ctx.stopC:
+		}
+	}
+	if ctx.directReads != nil {
+		ctx.directReads.end(ns)
+	}
+}
+
+// the timestamp given to ops read after this call. it is the cluster time
+// when the server reports one and the wall clock otherwise
+func directReadTimestamp(session *mgo.Session) bson.MongoTimestamp {
+	ts, err := ClusterTime(session)
+	return readTimestamp(ts, err, time.Now())
+}
+
+func readTimestamp(clusterTime bson.MongoTimestamp, err error, now time.Time) bson.MongoTimestamp {
+	if err == nil && clusterTime != 0 {
+		return clusterTime
+	}
+	return TimestampForTime(now)
+}
+
+// starts a find at the snapshot of ts with readConcern snapshot
+func (this *DirectReadQuery) snapshotIter(c *mgo.Collection, lastId interface{}, read int, ts bson.MongoTimestamp, projection bson.M, batchSize int) (*mgo.Iter, error) {
+	var result Cursor
+	cmd := this.snapshotCommand(c.Name, lastId, read, ts, projection, batchSize)
+	if err := c.Database.Run(cmd, &result); err != nil {
+		return nil, err
+	}
+	return c.NewIter(nil, result.Info.Firstbatch, result.Info.Id, nil), nil
+}
+
+// the find command run by snapshotIter
+func (this *DirectReadQuery) snapshotCommand(col string, lastId interface{}, read int, ts bson.MongoTimestamp, projection bson.M, batchSize int) bson.D {
+	sel := this.selector(lastId)
+	if sel == nil {
+		sel = bson.M{}
+	}
+	cmd := bson.D{
+		{Name: "find", Value: col},
+		{Name: "filter", Value: sel},
+		{Name: "sort", Value: keyDoc(this.sort())},
+		{Name: "batchSize", Value: batchSize},
+		{Name: "readConcern", Value: bson.D{
+			{Name: "level", Value: "snapshot"},
+			{Name: "atClusterTime", Value: ts},
+		}},
+	}
+	if hint := this.hint(); hint != nil {
+		cmd = append(cmd, bson.DocElem{Name: "hint", Value: keyDoc(hint)})
+	}
+	if !this.idOrdered() && read > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "skip", Value: read})
+	}
+	if projection != nil {
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: projection})
+	}
+	return cmd
+}
+
+// the snapshot fell out of the history the server keeps. the read continues
+// from the last document at a newer snapshot
+func isSnapshotTooOld(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok {
+		return qerr.Code == 239
+	}
+	return false
+}
+
+// narrows the direct read of a namespace on the server. Query selects the
+// documents to read. Sort defaults to _id and takes mgo sort keys such as
+// "-created". Hint takes index keys in the same form. without a Query the
+// _id index is hinted. Projection replaces Options.Projections for the read.
+// an interrupted read resumes after the last _id read, or when sorted by
+// other keys by skipping the documents already read
+type DirectReadQuery struct {
+	Query      bson.M
+	Sort       []string
+	Hint       []string
+	Projection bson.M
+}
+
+func (this *Options) directReadQuery(ns string) *DirectReadQuery {
+	if spec, ok := this.DirectReadQueries[ns]; ok && spec != nil {
+		return spec
+	}
+	return &DirectReadQuery{}
+}
+
+// true when the read of ns must be filtered by the server
+func (this *Options) hasDirectReadQuery(ns string) bool {
+	spec := this.directReadQuery(ns)
+	return len(spec.Query) > 0 || !spec.idOrdered()
+}
+
+func (this *Options) directProjectionFor(ns string) bson.M {
+	if spec := this.directReadQuery(ns); spec.Projection != nil {
+		return serverProjection(spec.Projection)
+	}
+	return this.projectionFor(ns)
+}
+
+func (this *Options) projectDirect(ns string, raw *bson.Raw) (*bson.Raw, error) {
+	if spec := this.directProjectionFor(ns); spec != nil {
+		return projectRaw(raw, spec)
+	}
+	return raw, nil
+}
+
+func (this *DirectReadQuery) idOrdered() bool {
+	return len(this.Sort) == 0 || (len(this.Sort) == 1 && this.Sort[0] == "_id")
+}
+
+func (this *DirectReadQuery) sort() []string {
+	if this.idOrdered() {
+		return []string{"_id"}
+	}
+	return this.Sort
+}
+
+func (this *DirectReadQuery) hint() []string {
+	if len(this.Hint) > 0 {
+		return this.Hint
+	}
+	if len(this.Query) == 0 && this.idOrdered() {
+		return []string{"_id"}
+	}
+	return nil
+}
+
+// the selector for documents after lastId
+func (this *DirectReadQuery) selector(lastId interface{}) bson.M {
+	if lastId == nil || !this.idOrdered() {
+		return this.Query
+	}
+	resume := bson.M{"_id": bson.M{"$gt": lastId}}
+	if len(this.Query) == 0 {
+		return resume
+	}
+	return bson.M{"$and": []bson.M{this.Query, resume}}
+}
+
+func (this *DirectReadQuery) query(c *mgo.Collection, lastId interface{}, read int, projection bson.M, batchSize int) *mgo.Query {
+	q := c.Find(this.selector(lastId)).Select(projection).Sort(this.sort()...).Batch(batchSize)
+	if hint := this.hint(); hint != nil {
+		q = q.Hint(hint...)
+	}
+	if !this.idOrdered() && read > 0 {
+		q = q.Skip(read)
+	}
+	return q
+}
+
+// converts mgo style keys such as "-created" to a key document
+func keyDoc(keys []string) bson.D {
+	var doc bson.D
+	for _, key := range keys {
+		order := 1
+		if strings.HasPrefix(key, "-") {
+			key, order = key[1:], -1
+		} else if strings.HasPrefix(key, "+") {
+			key = key[1:]
+		}
+		doc = append(doc, bson.DocElem{Name: key, Value: order})
+	}
+	return doc
+}
+
+// a DirectReadNs entry naming many namespaces: a glob such as db.* or a
+// regular expression between slashes such as /^shop\.orders_/. the syntax is
+// the one of NamespacePattern
+type nsPattern struct {
+	re       *regexp.Regexp
+	database string // the only database a glob can match or ""
+}
+
+// describes a collection as returned by listCollections. Type is
+// collection, view or timeseries
+type CollectionInfo struct {
+	Name    string `bson:"name"`
+	Type    string `bson:"type"`
+	Options bson.M `bson:"options"`
+}
+
+// converts a glob such as db.* or db.order?, or a regular expression wrapped
+// in slashes, to a regexp matching whole namespaces
+func NamespacePattern(pattern string) (*regexp.Regexp, error) {
+	if isNsRegex(pattern) {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func isNsRegex(pattern string) bool {
+	return len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// returns nil for an exact namespace
+func parseNsPattern(entry string) (*nsPattern, error) {
+	regex := isNsRegex(entry)
+	if !regex && !strings.ContainsAny(entry, "*?") {
+		return nil, nil
+	}
+	re, err := NamespacePattern(entry)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Invalid direct read pattern %s", entry))
+	}
+	pattern := &nsPattern{re: re}
+	if db := strings.SplitN(entry, ".", 2)[0]; !regex && len(db) < len(entry) && !strings.ContainsAny(db, "*?") {
+		pattern.database = db
+	}
+	return pattern, nil
+}
+
+// namespaces which are never read by a pattern
+func isSystemNamespace(db string, col string) bool {
+	switch db {
+	case "admin", "local", "config":
+		return true
+	}
+	return strings.HasPrefix(col, "system.")
+}
+
+// lists the collections of a database. before MongoDB 3.0 only names are
+// available and every entry has type collection
+func ListCollections(session *mgo.Session, db string) ([]*CollectionInfo, error) {
+	return listCollections(session, db, nil)
+}
+
+func listCollections(session *mgo.Session, db string, filter bson.M) ([]*CollectionInfo, error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			Id         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	d := session.DB(db)
+	cmd := bson.D{{Name: "listCollections", Value: 1}}
+	if filter != nil {
+		cmd = append(cmd, bson.DocElem{Name: "filter", Value: filter})
+	}
+	if err := d.Run(cmd, &result); err != nil {
+		names, nerr := d.CollectionNames()
+		if nerr != nil {
+			return nil, err
+		}
+		var infos []*CollectionInfo
+		for _, name := range names {
+			if want, ok := filter["name"]; ok && want != name {
+				continue
+			}
+			infos = append(infos, &CollectionInfo{Name: name, Type: "collection"})
+		}
+		return infos, nil
+	}
+	var infos []*CollectionInfo
+	iter := d.C("$cmd.listCollections").NewIter(nil, result.Cursor.FirstBatch, result.Cursor.Id, nil)
+	info := &CollectionInfo{}
+	for iter.Next(info) {
+		if info.Type == "" {
+			info.Type = "collection"
+		}
+		infos = append(infos, info)
+		info = &CollectionInfo{}
+	}
+	return infos, iter.Close()
+}
+
+// expands the patterns in DirectReadNs into the matching collections. views
+// and system namespaces are skipped. returns the namespaces to read and the
+// patterns for matching collections created later
+func (ctx *OpCtx) resolveDirectReadNs(session *mgo.Session, options *Options) (names []string, patterns []*nsPattern) {
+	seen := make(map[string]bool)
+	add := func(ns string) {
+		if !seen[ns] {
+			seen[ns] = true
+			names = append(names, ns)
+		}
+	}
+	for _, entry := range options.DirectReadNs {
+		pattern, err := parseNsPattern(entry)
+		if err != nil {
+			ctx.ErrC <- err
+		} else if pattern == nil {
+			add(entry)
+		} else {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+	s := session.Copy()
+	defer s.Close()
+	var dbs []string
+	for _, pattern := range patterns {
+		if pattern.database != "" {
+			dbs = append(dbs, pattern.database)
+		} else {
+			dbs = nil
+			break
+		}
+	}
+	if dbs == nil {
+		var err error
+		if dbs, err = s.DatabaseNames(); err != nil {
+			ctx.ErrC <- errors.Wrap(err, "Error listing databases for direct reads")
+			return
+		}
+	}
+	listed := make(map[string]bool)
+	for _, db := range dbs {
+		if listed[db] {
+			continue
+		}
+		listed[db] = true
+		infos, err := ListCollections(s, db)
+		if err != nil {
+			ctx.ErrC <- errors.Wrap(err, fmt.Sprintf("Error listing collections of %s for direct reads", db))
+			continue
+		}
+		for _, info := range infos {
+			ns := db + "." + info.Name
+			if info.Type == "view" || isSystemNamespace(db, info.Name) {
+				continue
+			}
+			for _, pattern := range patterns {
+				if pattern.re.MatchString(ns) {
+					add(ns)
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+// starts a direct read of a new collection matching a DirectReadNs pattern
+// when Options.DirectReadOnCreate is set
+func (ctx *OpCtx) readCreatedCollection(op *Op, options *Options) {
+	if !options.DirectReadOnCreate || ctx.session == nil || len(ctx.nsPatterns) == 0 {
+		return
+	}
+	col, ok := op.IsCreateCollection()
+	if !ok || ctx.isStopped() {
+		return
+	}
+	db := op.GetDatabase()
+	if _, view := op.Data["viewOn"]; view || isSystemNamespace(db, col) {
+		return
+	}
+	ns := db + "." + col
+	for _, pattern := range ctx.nsPatterns {
+		if pattern.re.MatchString(ns) {
+			if !ctx.addDirectRead() {
+				return
+			}
+			ctx.log.Printf("Starting a direct read of new collection %s", ns)
+			go DirectRead(ctx, ctx.session, ns, options)
+			return
+		}
+	}
+}
+
+// a direct read started with DirectRead on a running context
+type DirectReadHandle struct {
+	Namespace string
+	cancelC   chan bool
+	cancel    sync.Once
+	wg        sync.WaitGroup
+}
+
+func newDirectReadHandle(ns string) *DirectReadHandle {
+	return &DirectReadHandle{Namespace: ns, cancelC: make(chan bool)}
+}
+
+// stops the read without stopping the context. the read reports ErrStopped
+// on DirectReadDoneC
+func (this *DirectReadHandle) Cancel() {
+	this.cancel.Do(func() {
+		close(this.cancelC)
+	})
+}
+
+// blocks until the read is done or canceled
+func (this *DirectReadHandle) Wait() {
+	this.wg.Wait()
+}
+
+// starts a direct read of ns on a running context, e.g. to resync one
+// collection. options default to the options given to Start. the read is
+// tracked in DirectReadWg
+func (ctx *OpCtx) DirectRead(ns string, options *Options) (*DirectReadHandle, error) {
+	handle := newDirectReadHandle(ns)
+	if err := ctx.startDirectRead(handle, options); err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+func (ctx *OpCtx) startDirectRead(handle *DirectReadHandle, options *Options) error {
+	if options == nil {
+		options = ctx.options
+	} else {
+		options.SetDefaults()
+	}
+	if ctx.isStopped() {
+		return ErrStopped
+	}
+	if ctx.bounded {
+		return ErrBounded
+	}
+	if ctx.session == nil {
+		return errors.New("Direct reads require a session")
+	}
+	n := &N{}
+	if err := n.parse(handle.Namespace); err != nil {
+		return errors.Wrap(err, "Error parsing direct read namespace")
+	}
+	scanOk, err := SupportsCollectionScan(ctx.session)
+	if err != nil {
+		return errors.Wrap(err, "Error determining collection scan support")
+	}
+	if !ctx.addDirectRead() {
+		return ErrStopped
+	}
+	// closed when the context stops or the handle is canceled
+	stopC := make(chan bool)
+	run := ctx.newDirectReadRun(stopC)
+	finished := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.stopC:
+		case <-handle.cancelC:
+		case <-finished:
+		}
+		close(stopC)
+	}()
+	handle.wg.Add(1)
+	go func() {
+		defer handle.wg.Done()
+		defer close(finished)
+		if scanOk {
+			directReadCollectionScan(ctx, run, ctx.session, handle.Namespace, options)
+		} else {
+			directRead(ctx, run, ctx.session, handle.Namespace, options)
+		}
+	}()
+	return nil
+}
+
+// starts a direct read of ns on every child context. canceling the handle
+// cancels them all
+func (ctx *OpCtxMulti) DirectRead(ns string, options *Options) (*DirectReadHandle, error) {
+	handle := newDirectReadHandle(ns)
+	err := ctx.each(func(child *OpCtx) error {
+		return child.startDirectRead(handle, options)
+	})
+	if err != nil {
+		handle.Cancel()
+		return nil, err
+	}
+	if !ctx.addDirectRead() {
+		handle.Cancel()
+		return nil, ErrStopped
+	}
+	go func() {
+		defer ctx.allWg.Done()
+		defer ctx.DirectReadWg.Done()
+		handle.Wait()
+	}()
+	return handle, nil
+}
@@ -0,0 +1,255 @@
+package gtm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestReadTimestamp(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		name        string
+		clusterTime bson.MongoTimestamp
+		err         error
+		want        bson.MongoTimestamp
+	}{
+		{"cluster time", NewTimestamp(1400000000, 7), nil, NewTimestamp(1400000000, 7)},
+		{"not reported", 0, nil, NewTimestamp(1500000000, 0)},
+		{"isMaster failed", NewTimestamp(1400000000, 7), errors.New("down"), NewTimestamp(1500000000, 0)},
+	}
+	for _, test := range tests {
+		if got := readTimestamp(test.clusterTime, test.err, now); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSnapshotCommand(t *testing.T) {
+	ts := NewTimestamp(1500000000, 1)
+	snapshot := bson.DocElem{Name: "readConcern", Value: bson.D{
+		{Name: "level", Value: "snapshot"},
+		{Name: "atClusterTime", Value: ts},
+	}}
+	tests := []struct {
+		name       string
+		spec       DirectReadQuery
+		lastId     interface{}
+		read       int
+		projection bson.M
+		want       bson.D
+	}{
+		{
+			name: "from the start",
+			want: bson.D{
+				{Name: "find", Value: "c"},
+				{Name: "filter", Value: bson.M{}},
+				{Name: "sort", Value: bson.D{{Name: "_id", Value: 1}}},
+				{Name: "batchSize", Value: 100},
+				snapshot,
+				{Name: "hint", Value: bson.D{{Name: "_id", Value: 1}}},
+			},
+		},
+		{
+			name:       "resumed after an id",
+			spec:       DirectReadQuery{Query: bson.M{"a": 1}},
+			lastId:     5,
+			read:       3,
+			projection: bson.M{"b": 0},
+			want: bson.D{
+				{Name: "find", Value: "c"},
+				{Name: "filter", Value: bson.M{"$and": []bson.M{{"a": 1}, {"_id": bson.M{"$gt": 5}}}}},
+				{Name: "sort", Value: bson.D{{Name: "_id", Value: 1}}},
+				{Name: "batchSize", Value: 100},
+				snapshot,
+				{Name: "projection", Value: bson.M{"b": 0}},
+			},
+		},
+		{
+			name: "resumed by skipping",
+			spec: DirectReadQuery{Sort: []string{"-created"}, Hint: []string{"created"}},
+			read: 3,
+			want: bson.D{
+				{Name: "find", Value: "c"},
+				{Name: "filter", Value: bson.M{}},
+				{Name: "sort", Value: bson.D{{Name: "created", Value: -1}}},
+				{Name: "batchSize", Value: 100},
+				snapshot,
+				{Name: "hint", Value: bson.D{{Name: "created", Value: 1}}},
+				{Name: "skip", Value: 3},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := test.spec.snapshotCommand("c", test.lastId, test.read, ts, test.projection, 100)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIsSnapshotTooOld(t *testing.T) {
+	if !isSnapshotTooOld(&mgo.QueryError{Code: 239}) {
+		t.Errorf("expected SnapshotTooOld to be recognized")
+	}
+	if isSnapshotTooOld(&mgo.QueryError{Code: 11000}) || isSnapshotTooOld(errors.New("other")) {
+		t.Errorf("expected other errors not to restart the snapshot")
+	}
+}
+
+func TestScanSequence(t *testing.T) {
+	seq := newScanSequence()
+	for i := int64(1); i <= 3; i++ {
+		if got := seq.advance("db.a"); got != i {
+			t.Errorf("got %d for db.a, want %d", got, i)
+		}
+	}
+	if got := seq.advance("db.b"); got != 1 {
+		t.Errorf("got %d for db.b, want 1", got)
+	}
+}
+
+func TestDirectReadQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     DirectReadQuery
+		lastId   interface{}
+		selector bson.M
+		sort     []string
+		hint     []string
+		server   bool
+	}{
+		{name: "default", sort: []string{"_id"}, hint: []string{"_id"}},
+		{name: "resume", lastId: 5, selector: bson.M{"_id": bson.M{"$gt": 5}}, sort: []string{"_id"}, hint: []string{"_id"}},
+		{
+			name:     "query",
+			spec:     DirectReadQuery{Query: bson.M{"a": 1}},
+			selector: bson.M{"a": 1},
+			sort:     []string{"_id"},
+			server:   true,
+		},
+		{
+			name:     "sorted resumes by skipping",
+			spec:     DirectReadQuery{Query: bson.M{"a": 1}, Sort: []string{"-created"}, Hint: []string{"a", "created"}},
+			lastId:   5,
+			selector: bson.M{"a": 1},
+			sort:     []string{"-created"},
+			hint:     []string{"a", "created"},
+			server:   true,
+		},
+		{name: "sort by _id", spec: DirectReadQuery{Sort: []string{"_id"}}, sort: []string{"_id"}, hint: []string{"_id"}},
+	}
+	for _, test := range tests {
+		spec := test.spec
+		options := &Options{DirectReadQueries: map[string]*DirectReadQuery{"db.c": &spec}}
+		if got := spec.selector(test.lastId); !reflect.DeepEqual(got, test.selector) {
+			t.Errorf("%s: got selector %v, want %v", test.name, got, test.selector)
+		}
+		if got := spec.sort(); !reflect.DeepEqual(got, test.sort) {
+			t.Errorf("%s: got sort %v, want %v", test.name, got, test.sort)
+		}
+		if got := spec.hint(); !reflect.DeepEqual(got, test.hint) {
+			t.Errorf("%s: got hint %v, want %v", test.name, got, test.hint)
+		}
+		if got := options.hasDirectReadQuery("db.c"); got != test.server {
+			t.Errorf("%s: got server side %v, want %v", test.name, got, test.server)
+		}
+		if options.hasDirectReadQuery("db.other") {
+			t.Errorf("%s: expected a namespace without a query to be scanned", test.name)
+		}
+	}
+	if got := keyDoc([]string{"-a", "+b", "c"}); !reflect.DeepEqual(got, bson.D{{Name: "a", Value: -1}, {Name: "b", Value: 1}, {Name: "c", Value: 1}}) {
+		t.Errorf("got key document %v", got)
+	}
+}
+
+// documents of a parallel scan are projected on the client
+func TestProjectDirect(t *testing.T) {
+	doc := bson.M{"_id": 1, "a": 1, "b": bson.M{"c": 2, "d": 3}, "big": "x"}
+	tests := []struct {
+		name        string
+		projections map[string]bson.M
+		query       *DirectReadQuery
+		want        bson.M
+	}{
+		{name: "none", want: doc},
+		{
+			name:        "namespace projection",
+			projections: map[string]bson.M{"db.c": {"big": 0}},
+			want:        bson.M{"_id": 1, "a": 1, "b": bson.M{"c": 2, "d": 3}},
+		},
+		{
+			name:        "query projection replaces it",
+			projections: map[string]bson.M{"db.c": {"big": 0}},
+			query:       &DirectReadQuery{Projection: bson.M{"b.c": 1}},
+			want:        bson.M{"_id": 1, "b": bson.M{"c": 2}},
+		},
+		{
+			name:  "_id is kept",
+			query: &DirectReadQuery{Projection: bson.M{"_id": 0, "a": 1}},
+			want:  bson.M{"_id": 1, "a": 1},
+		},
+		{
+			name:  "query without projection",
+			query: &DirectReadQuery{Query: bson.M{"a": 1}},
+			want:  doc,
+		},
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		options := &Options{Projections: test.projections}
+		if test.query != nil {
+			options.DirectReadQueries = map[string]*DirectReadQuery{"db.c": test.query}
+		}
+		projected, err := options.projectDirect("db.c", &bson.Raw{Kind: 0x03, Data: data})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var got bson.M
+		if err = projected.Unmarshal(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+	options := &Options{DirectReadQueries: map[string]*DirectReadQuery{"db.c": {Projection: bson.M{"a": 1, "big": 0}}}}
+	if _, err := options.projectDirect("db.c", &bson.Raw{Kind: 0x03, Data: data}); err != ErrMixedProjection {
+		t.Errorf("got %v for a mixed projection, want ErrMixedProjection", err)
+	}
+}
+
+// e.g. a read of a new collection and a resync of it started with DirectRead
+func TestConcurrentReadsOfNamespace(t *testing.T) {
+	ctx := &OpCtx{
+		stopC:           make(chan bool),
+		progress:        newProgressTracker(&Options{}),
+		DirectReadDoneC: make(chan *DirectReadDone, 2),
+	}
+	created, resync := ctx.newDirectReadRun(ctx.stopC), ctx.newDirectReadRun(ctx.stopC)
+	ctx.beginDirectRead(nil, created, "db.c")
+	ctx.beginDirectRead(nil, resync, "db.c")
+	ctx.progress.add(created.id, 10)
+	ctx.progress.add(created.id, 10)
+	ctx.progress.add(resync.id, 10)
+	ctx.endDirectRead(created, "db.c", nil)
+	ctx.endDirectRead(resync, "db.c", nil)
+	for _, want := range []int64{2, 1} {
+		select {
+		case done := <-ctx.DirectReadDoneC:
+			if done.Namespace != "db.c" || done.Docs != want {
+				t.Errorf("got %s with %d docs, want db.c with %d", done.Namespace, done.Docs, want)
+			}
+		default:
+			t.Fatalf("expected a DirectReadDone for each read")
+		}
+	}
+}
@@ -0,0 +1,674 @@
+package gtm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ExtJSONMode int
+
+const (
+	CanonicalExtJSON ExtJSONMode = iota // type preserving MongoDB Extended JSON
+	RelaxedExtJSON                      // human friendly numbers and dates where lossless
+)
+
+// the version of the envelope written by Op.MarshalJSON
+const OpWireVersion = 1
+
+const extJSONDateFormat = "2006-01-02T15:04:05.999Z07:00"
+
+var operationNames = map[string]string{
+	"i": "insert",
+	"u": "update",
+	"d": "delete",
+	"c": "command",
+}
+
+type opEnvelope struct {
+	Version   int             `json:"v"`
+	Operation string          `json:"operation"`
+	Namespace string          `json:"namespace"`
+	Id        json.RawMessage `json:"_id,omitempty"`
+	Timestamp json.RawMessage `json:"timestamp"`
+	Source    string          `json:"source"`
+	Sequence  int64           `json:"sequence,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Doc       json.RawMessage `json:"doc,omitempty"`
+}
+
+func (this QuerySource) String() string {
+	switch this {
+	case OplogQuerySource:
+		return "oplog"
+	case DirectQuerySource:
+		return "direct"
+	default:
+		return strconv.Itoa(int(this))
+	}
+}
+
+func ParseQuerySource(name string) (QuerySource, error) {
+	switch name {
+	case "oplog":
+		return OplogQuerySource, nil
+	case "direct":
+		return DirectQuerySource, nil
+	default:
+		return OplogQuerySource, fmt.Errorf("Invalid source: %s", name)
+	}
+}
+
+func (this *Op) MarshalJSON() ([]byte, error) {
+	return this.MarshalExtJSON(CanonicalExtJSON)
+}
+
+func (this *Op) MarshalExtJSON(mode ExtJSONMode) ([]byte, error) {
+	var err error
+	env := opEnvelope{
+		Version:   OpWireVersion,
+		Operation: this.Operation,
+		Namespace: this.Namespace,
+		Source:    this.Source.String(),
+		Sequence:  this.Sequence,
+	}
+	if name, ok := operationNames[this.Operation]; ok {
+		env.Operation = name
+	}
+	if this.Id != nil {
+		if env.Id, err = MarshalExtJSON(this.Id, mode); err != nil {
+			return nil, err
+		}
+	}
+	if env.Timestamp, err = MarshalExtJSON(this.Timestamp, mode); err != nil {
+		return nil, err
+	}
+	if this.Data != nil {
+		if env.Data, err = MarshalExtJSON(this.Data, mode); err != nil {
+			return nil, err
+		}
+	}
+	if this.Doc != nil && !this.docIsData() {
+		if env.Doc, err = MarshalExtJSON(this.Doc, mode); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&env)
+}
+
+// Doc is only restored as a generic value since the original type is unknown
+func (this *Op) UnmarshalJSON(data []byte) error {
+	var env opEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	if env.Version > OpWireVersion {
+		return fmt.Errorf("Unsupported op version %d: expecting at most %d", env.Version, OpWireVersion)
+	}
+	op := Op{
+		Operation: env.Operation,
+		Namespace: env.Namespace,
+		Sequence:  env.Sequence,
+	}
+	for code, name := range operationNames {
+		if name == env.Operation {
+			op.Operation = code
+			break
+		}
+	}
+	if env.Source != "" {
+		source, err := ParseQuerySource(env.Source)
+		if err != nil {
+			return err
+		}
+		op.Source = source
+	}
+	if len(env.Id) > 0 {
+		id, err := UnmarshalExtJSON(env.Id)
+		if err != nil {
+			return errors.Wrap(err, "Error decoding op id")
+		}
+		op.Id = id
+	}
+	if len(env.Timestamp) > 0 {
+		ts, err := UnmarshalExtJSON(env.Timestamp)
+		if err != nil {
+			return errors.Wrap(err, "Error decoding op timestamp")
+		}
+		switch t := ts.(type) {
+		case bson.MongoTimestamp:
+			op.Timestamp = t
+		case int64:
+			op.Timestamp = bson.MongoTimestamp(t)
+		case int:
+			op.Timestamp = bson.MongoTimestamp(t)
+		default:
+			return fmt.Errorf("Invalid op timestamp: %s", env.Timestamp)
+		}
+	}
+	if len(env.Data) > 0 {
+		data, err := UnmarshalExtJSON(env.Data)
+		if err != nil {
+			return errors.Wrap(err, "Error decoding op data")
+		}
+		if m, ok := data.(map[string]interface{}); ok {
+			op.processData(m)
+		}
+	}
+	if len(env.Doc) > 0 {
+		doc, err := UnmarshalExtJSON(env.Doc)
+		if err != nil {
+			return errors.Wrap(err, "Error decoding op doc")
+		}
+		op.Doc = doc
+	}
+	*this = op
+	return nil
+}
+
+func (this *Op) docIsData() bool {
+	if m, ok := this.Doc.(map[string]interface{}); ok && this.Data != nil {
+		return reflect.ValueOf(m).Pointer() == reflect.ValueOf(this.Data).Pointer()
+	}
+	return false
+}
+
+// MarshalExtJSON encodes BSON values such as ObjectId, time.Time, Decimal128, Binary
+// and MongoTimestamp using MongoDB Extended JSON v2
+func MarshalExtJSON(value interface{}, mode ExtJSONMode) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeExtJSON(&buf, value, mode); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalExtJSON decodes canonical or relaxed Extended JSON into the BSON types
+// mgo produces when reading documents into a map[string]interface{}
+func UnmarshalExtJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return fromExtJSON(value)
+}
+
+func writeExtJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+func writeExtJSONWrapped(buf *bytes.Buffer, key string, value string) {
+	buf.WriteString(`{"` + key + `":`)
+	writeExtJSONString(buf, value)
+	buf.WriteByte('}')
+}
+
+func writeExtJSONDouble(buf *bytes.Buffer, f float64, mode ExtJSONMode) {
+	switch {
+	case math.IsInf(f, 1):
+		writeExtJSONWrapped(buf, "$numberDouble", "Infinity")
+	case math.IsInf(f, -1):
+		writeExtJSONWrapped(buf, "$numberDouble", "-Infinity")
+	case math.IsNaN(f):
+		writeExtJSONWrapped(buf, "$numberDouble", "NaN")
+	default:
+		s := strconv.FormatFloat(f, 'G', -1, 64)
+		if !strings.ContainsAny(s, ".EN") {
+			s += ".0"
+		}
+		if mode == CanonicalExtJSON {
+			writeExtJSONWrapped(buf, "$numberDouble", s)
+		} else {
+			buf.WriteString(s)
+		}
+	}
+}
+
+func writeExtJSONInt(buf *bytes.Buffer, n int64, key string, mode ExtJSONMode) {
+	s := strconv.FormatInt(n, 10)
+	if mode == CanonicalExtJSON {
+		writeExtJSONWrapped(buf, key, s)
+	} else {
+		buf.WriteString(s)
+	}
+}
+
+func writeExtJSONDate(buf *bytes.Buffer, t time.Time, mode ExtJSONMode) {
+	ms := t.Unix()*1000 + int64(t.Nanosecond()/1e6)
+	if mode == RelaxedExtJSON && t.Year() >= 1970 && t.Year() <= 9999 {
+		buf.WriteString(`{"$date":`)
+		writeExtJSONString(buf, t.UTC().Format(extJSONDateFormat))
+		buf.WriteByte('}')
+		return
+	}
+	buf.WriteString(`{"$date":`)
+	writeExtJSONWrapped(buf, "$numberLong", strconv.FormatInt(ms, 10))
+	buf.WriteByte('}')
+}
+
+func writeExtJSONBinary(buf *bytes.Buffer, data []byte, kind byte) {
+	buf.WriteString(`{"$binary":{"base64":`)
+	writeExtJSONString(buf, base64.StdEncoding.EncodeToString(data))
+	buf.WriteString(`,"subType":`)
+	writeExtJSONString(buf, hex.EncodeToString([]byte{kind}))
+	buf.WriteString(`}}`)
+}
+
+func writeExtJSONDoc(buf *bytes.Buffer, doc bson.D, mode ExtJSONMode) error {
+	buf.WriteByte('{')
+	for i, elem := range doc {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeExtJSONString(buf, elem.Name)
+		buf.WriteByte(':')
+		if err := writeExtJSON(buf, elem.Value, mode); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func writeExtJSONMap(buf *bytes.Buffer, m map[string]interface{}, mode ExtJSONMode) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	doc := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		doc = append(doc, bson.DocElem{Name: k, Value: m[k]})
+	}
+	return writeExtJSONDoc(buf, doc, mode)
+}
+
+func writeExtJSONArray(buf *bytes.Buffer, values []interface{}, mode ExtJSONMode) error {
+	buf.WriteByte('[')
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeExtJSON(buf, v, mode); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func writeExtJSONRaw(buf *bytes.Buffer, raw bson.Raw, mode ExtJSONMode) error {
+	switch raw.Kind {
+	case 0x00, 0x03:
+		var doc bson.D
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		return writeExtJSONDoc(buf, doc, mode)
+	case 0x04:
+		var values []interface{}
+		if err := raw.Unmarshal(&values); err != nil {
+			return err
+		}
+		return writeExtJSONArray(buf, values, mode)
+	default:
+		var value interface{}
+		if err := raw.Unmarshal(&value); err != nil {
+			return err
+		}
+		return writeExtJSON(buf, value, mode)
+	}
+}
+
+func writeExtJSON(buf *bytes.Buffer, value interface{}, mode ExtJSONMode) error {
+	switch value {
+	case interface{}(bson.MinKey):
+		buf.WriteString(`{"$minKey":1}`)
+		return nil
+	case interface{}(bson.MaxKey):
+		buf.WriteString(`{"$maxKey":1}`)
+		return nil
+	case interface{}(bson.Undefined):
+		buf.WriteString(`{"$undefined":true}`)
+		return nil
+	}
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeExtJSONString(buf, v)
+	case int:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			writeExtJSONInt(buf, int64(v), "$numberInt", mode)
+		} else {
+			writeExtJSONInt(buf, int64(v), "$numberLong", mode)
+		}
+	case int32:
+		writeExtJSONInt(buf, int64(v), "$numberInt", mode)
+	case int64:
+		writeExtJSONInt(buf, v, "$numberLong", mode)
+	case float32:
+		writeExtJSONDouble(buf, float64(v), mode)
+	case float64:
+		writeExtJSONDouble(buf, v, mode)
+	case bson.Decimal128:
+		writeExtJSONWrapped(buf, "$numberDecimal", v.String())
+	case bson.ObjectId:
+		writeExtJSONWrapped(buf, "$oid", v.Hex())
+	case time.Time:
+		writeExtJSONDate(buf, v, mode)
+	case bson.MongoTimestamp:
+		t, i := uint64(v)>>32, uint32(v)
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, t, i)
+	case []byte:
+		writeExtJSONBinary(buf, v, 0x00)
+	case bson.Binary:
+		writeExtJSONBinary(buf, v.Data, v.Kind)
+	case bson.RegEx:
+		buf.WriteString(`{"$regularExpression":{"pattern":`)
+		writeExtJSONString(buf, v.Pattern)
+		buf.WriteString(`,"options":`)
+		writeExtJSONString(buf, v.Options)
+		buf.WriteString(`}}`)
+	case bson.JavaScript:
+		buf.WriteString(`{"$code":`)
+		writeExtJSONString(buf, v.Code)
+		if v.Scope != nil {
+			buf.WriteString(`,"$scope":`)
+			if err := writeExtJSON(buf, v.Scope, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case bson.Symbol:
+		writeExtJSONWrapped(buf, "$symbol", string(v))
+	case bson.DBPointer:
+		buf.WriteString(`{"$dbPointer":{"$ref":`)
+		writeExtJSONString(buf, v.Namespace)
+		buf.WriteString(`,"$id":`)
+		writeExtJSONWrapped(buf, "$oid", v.Id.Hex())
+		buf.WriteString(`}}`)
+	case bson.D:
+		return writeExtJSONDoc(buf, v, mode)
+	case bson.M:
+		return writeExtJSONMap(buf, v, mode)
+	case map[string]interface{}:
+		return writeExtJSONMap(buf, v, mode)
+	case []interface{}:
+		return writeExtJSONArray(buf, v, mode)
+	case bson.Raw:
+		return writeExtJSONRaw(buf, v, mode)
+	case *bson.Raw:
+		return writeExtJSONRaw(buf, *v, mode)
+	default:
+		// custom unmarshalled types are run through bson so field
+		// names and BSON types match what is stored in MongoDB
+		if b, err := bson.Marshal(bson.M{"v": v}); err == nil {
+			var doc struct {
+				V bson.Raw `bson:"v"`
+			}
+			if err = bson.Unmarshal(b, &doc); err == nil {
+				return writeExtJSONRaw(buf, doc.V, mode)
+			}
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+func fromExtJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return fromExtJSONNumber(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			d, err := fromExtJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = d
+		}
+		return out, nil
+	case map[string]interface{}:
+		if special, ok, err := fromExtJSONSpecial(v); ok || err != nil {
+			return special, err
+		}
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			d, err := fromExtJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = d
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func fromExtJSONNumber(n json.Number) (interface{}, error) {
+	s := n.String()
+	if strings.ContainsAny(s, ".eE") {
+		return n.Float64()
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return n.Float64()
+	}
+	if i >= math.MinInt32 && i <= math.MaxInt32 {
+		return int(i), nil
+	}
+	return i, nil
+}
+
+func extJSONString(m map[string]interface{}, key string) (string, error) {
+	if s, ok := m[key].(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("Invalid extended json: %s must be a string", key)
+}
+
+func extJSONUint32(m map[string]interface{}, key string) (uint64, error) {
+	if n, ok := m[key].(json.Number); ok {
+		return strconv.ParseUint(n.String(), 10, 32)
+	}
+	return 0, fmt.Errorf("Invalid extended json: %s must be a number", key)
+}
+
+func fromExtJSONDate(value interface{}) (interface{}, error) {
+	switch d := value.(type) {
+	case string:
+		t, err := time.Parse(extJSONDateFormat, d)
+		if err != nil {
+			return nil, err
+		}
+		return t.Local(), nil
+	case json.Number:
+		ms, err := d.Int64()
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(ms/1000, ms%1000*1e6), nil
+	case map[string]interface{}:
+		s, err := extJSONString(d, "$numberLong")
+		if err != nil {
+			return nil, err
+		}
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(ms/1000, ms%1000*1e6), nil
+	default:
+		return nil, fmt.Errorf("Invalid extended json: unexpected $date %v", value)
+	}
+}
+
+func fromExtJSONBinary(m map[string]interface{}) (interface{}, error) {
+	var data, subType string
+	var err error
+	if b, ok := m["$binary"].(map[string]interface{}); ok {
+		if data, err = extJSONString(b, "base64"); err != nil {
+			return nil, err
+		}
+		if subType, err = extJSONString(b, "subType"); err != nil {
+			return nil, err
+		}
+	} else {
+		// legacy form {"$binary": "...", "$type": "00"}
+		if data, err = extJSONString(m, "$binary"); err != nil {
+			return nil, err
+		}
+		if subType, err = extJSONString(m, "$type"); err != nil {
+			return nil, err
+		}
+	}
+	bin, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := strconv.ParseUint(strings.TrimPrefix(subType, "0x"), 16, 8)
+	if err != nil {
+		return nil, err
+	}
+	if kind == 0 {
+		return bin, nil
+	}
+	return bson.Binary{Kind: byte(kind), Data: bin}, nil
+}
+
+func fromExtJSONSpecial(m map[string]interface{}) (value interface{}, ok bool, err error) {
+	if len(m) == 0 || len(m) > 2 {
+		return
+	}
+	ok = true
+	switch {
+	case len(m) == 1 && m["$oid"] != nil:
+		var hexId string
+		if hexId, err = extJSONString(m, "$oid"); err == nil {
+			if !bson.IsObjectIdHex(hexId) {
+				err = fmt.Errorf("Invalid extended json: bad $oid %s", hexId)
+			} else {
+				value = bson.ObjectIdHex(hexId)
+			}
+		}
+	case len(m) == 1 && m["$numberInt"] != nil:
+		var s string
+		var n int64
+		if s, err = extJSONString(m, "$numberInt"); err == nil {
+			if n, err = strconv.ParseInt(s, 10, 32); err == nil {
+				value = int(n)
+			}
+		}
+	case len(m) == 1 && m["$numberLong"] != nil:
+		var s string
+		if s, err = extJSONString(m, "$numberLong"); err == nil {
+			value, err = strconv.ParseInt(s, 10, 64)
+		}
+	case len(m) == 1 && m["$numberDouble"] != nil:
+		var s string
+		if s, err = extJSONString(m, "$numberDouble"); err == nil {
+			switch s {
+			case "Infinity":
+				value = math.Inf(1)
+			case "-Infinity":
+				value = math.Inf(-1)
+			case "NaN":
+				value = math.NaN()
+			default:
+				value, err = strconv.ParseFloat(s, 64)
+			}
+		}
+	case len(m) == 1 && m["$numberDecimal"] != nil:
+		var s string
+		if s, err = extJSONString(m, "$numberDecimal"); err == nil {
+			value, err = bson.ParseDecimal128(s)
+		}
+	case len(m) == 1 && m["$date"] != nil:
+		value, err = fromExtJSONDate(m["$date"])
+	case len(m) == 1 && m["$timestamp"] != nil:
+		if t, isMap := m["$timestamp"].(map[string]interface{}); isMap {
+			var secs, inc uint64
+			if secs, err = extJSONUint32(t, "t"); err == nil {
+				if inc, err = extJSONUint32(t, "i"); err == nil {
+					value = bson.MongoTimestamp(secs<<32 | inc)
+				}
+			}
+		} else {
+			err = fmt.Errorf("Invalid extended json: unexpected $timestamp %v", m["$timestamp"])
+		}
+	case m["$binary"] != nil:
+		value, err = fromExtJSONBinary(m)
+	case len(m) == 1 && m["$regularExpression"] != nil:
+		if r, isMap := m["$regularExpression"].(map[string]interface{}); isMap {
+			var re bson.RegEx
+			if re.Pattern, err = extJSONString(r, "pattern"); err == nil {
+				if re.Options, err = extJSONString(r, "options"); err == nil {
+					value = re
+				}
+			}
+		} else {
+			err = fmt.Errorf("Invalid extended json: unexpected $regularExpression %v", m["$regularExpression"])
+		}
+	case m["$code"] != nil:
+		var js bson.JavaScript
+		if js.Code, err = extJSONString(m, "$code"); err == nil {
+			if scope, hasScope := m["$scope"]; hasScope {
+				js.Scope, err = fromExtJSON(scope)
+			}
+			value = js
+		}
+	case len(m) == 1 && m["$symbol"] != nil:
+		var s string
+		if s, err = extJSONString(m, "$symbol"); err == nil {
+			value = bson.Symbol(s)
+		}
+	case len(m) == 1 && m["$dbPointer"] != nil:
+		if p, isMap := m["$dbPointer"].(map[string]interface{}); isMap {
+			var ptr bson.DBPointer
+			var id interface{}
+			if ptr.Namespace, err = extJSONString(p, "$ref"); err == nil {
+				if id, err = fromExtJSON(p["$id"]); err == nil {
+					if oid, isOid := id.(bson.ObjectId); isOid {
+						ptr.Id = oid
+						value = ptr
+					} else {
+						err = fmt.Errorf("Invalid extended json: $dbPointer $id must be an $oid")
+					}
+				}
+			}
+		} else {
+			err = fmt.Errorf("Invalid extended json: unexpected $dbPointer %v", m["$dbPointer"])
+		}
+	case len(m) == 1 && m["$minKey"] != nil:
+		value = bson.MinKey
+	case len(m) == 1 && m["$maxKey"] != nil:
+		value = bson.MaxKey
+	case len(m) == 1 && m["$undefined"] != nil:
+		value = bson.Undefined
+	default:
+		ok = false
+	}
+	return
+}
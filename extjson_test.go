@@ -0,0 +1,182 @@
+package gtm
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func mustDecimal(s string) bson.Decimal128 {
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func sameExtJSONValue(a, b interface{}) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	if fa, ok := a.(float64); ok && math.IsNaN(fa) {
+		fb, ok := b.(float64)
+		return ok && math.IsNaN(fb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestExtJSONRoundTrip(t *testing.T) {
+	oid := bson.ObjectIdHex("5c8f9a1b2c3d4e5f60718293")
+	date := time.Date(2019, 3, 18, 12, 30, 45, 123e6, time.UTC)
+	tests := []struct {
+		name      string
+		value     interface{}
+		canonical string
+		relaxed   string
+		// the value decoded from relaxed output when relaxed is lossy
+		relaxedValue interface{}
+	}{
+		{name: "null", value: nil, canonical: `null`, relaxed: `null`},
+		{name: "bool", value: true, canonical: `true`, relaxed: `true`},
+		{name: "string", value: "a\"b", canonical: `"a\"b"`, relaxed: `"a\"b"`},
+		{name: "int", value: 42, canonical: `{"$numberInt":"42"}`, relaxed: `42`},
+		{name: "long", value: int64(1) << 40, canonical: `{"$numberLong":"1099511627776"}`, relaxed: `1099511627776`},
+		{name: "small long", value: int64(7), canonical: `{"$numberLong":"7"}`, relaxed: `7`, relaxedValue: 7},
+		{name: "double", value: 1.5, canonical: `{"$numberDouble":"1.5"}`, relaxed: `1.5`},
+		{name: "whole double", value: 2.0, canonical: `{"$numberDouble":"2.0"}`, relaxed: `2.0`},
+		{name: "infinity", value: math.Inf(1), canonical: `{"$numberDouble":"Infinity"}`, relaxed: `{"$numberDouble":"Infinity"}`},
+		{name: "nan", value: math.NaN(), canonical: `{"$numberDouble":"NaN"}`, relaxed: `{"$numberDouble":"NaN"}`},
+		{name: "decimal", value: mustDecimal("12.34"), canonical: `{"$numberDecimal":"12.34"}`, relaxed: `{"$numberDecimal":"12.34"}`},
+		{name: "object id", value: oid, canonical: `{"$oid":"5c8f9a1b2c3d4e5f60718293"}`, relaxed: `{"$oid":"5c8f9a1b2c3d4e5f60718293"}`},
+		{name: "date", value: date, canonical: `{"$date":{"$numberLong":"1552912245123"}}`, relaxed: `{"$date":"2019-03-18T12:30:45.123Z"}`},
+		{name: "timestamp", value: bson.MongoTimestamp(5<<32 | 3), canonical: `{"$timestamp":{"t":5,"i":3}}`, relaxed: `{"$timestamp":{"t":5,"i":3}}`},
+		{name: "binary", value: []byte{1, 2}, canonical: `{"$binary":{"base64":"AQI=","subType":"00"}}`, relaxed: `{"$binary":{"base64":"AQI=","subType":"00"}}`},
+		{name: "uuid", value: bson.Binary{Kind: 4, Data: []byte{9}}, canonical: `{"$binary":{"base64":"CQ==","subType":"04"}}`, relaxed: `{"$binary":{"base64":"CQ==","subType":"04"}}`},
+		{name: "regex", value: bson.RegEx{Pattern: "^a", Options: "i"}, canonical: `{"$regularExpression":{"pattern":"^a","options":"i"}}`, relaxed: `{"$regularExpression":{"pattern":"^a","options":"i"}}`},
+		{name: "min key", value: bson.MinKey, canonical: `{"$minKey":1}`, relaxed: `{"$minKey":1}`},
+		{name: "max key", value: bson.MaxKey, canonical: `{"$maxKey":1}`, relaxed: `{"$maxKey":1}`},
+		{name: "symbol", value: bson.Symbol("s"), canonical: `{"$symbol":"s"}`, relaxed: `{"$symbol":"s"}`},
+		{
+			name:      "document",
+			value:     map[string]interface{}{"b": []interface{}{1, "x"}, "a": map[string]interface{}{"c": int64(1) << 40}},
+			canonical: `{"a":{"c":{"$numberLong":"1099511627776"}},"b":[{"$numberInt":"1"},"x"]}`,
+			relaxed:   `{"a":{"c":1099511627776},"b":[1,"x"]}`,
+		},
+	}
+	for _, test := range tests {
+		for _, mode := range []ExtJSONMode{CanonicalExtJSON, RelaxedExtJSON} {
+			want, decoded := test.canonical, test.value
+			if mode == RelaxedExtJSON {
+				want = test.relaxed
+				if test.relaxedValue != nil {
+					decoded = test.relaxedValue
+				}
+			}
+			b, err := MarshalExtJSON(test.value, mode)
+			if err != nil {
+				t.Errorf("%s (mode %d): %s", test.name, mode, err)
+				continue
+			}
+			if string(b) != want {
+				t.Errorf("%s (mode %d): got %s, want %s", test.name, mode, b, want)
+			}
+			value, err := UnmarshalExtJSON(b)
+			if err != nil {
+				t.Errorf("%s (mode %d): %s", test.name, mode, err)
+				continue
+			}
+			if !sameExtJSONValue(value, decoded) {
+				t.Errorf("%s (mode %d): decoded %#v, want %#v", test.name, mode, value, decoded)
+			}
+		}
+	}
+}
+
+func TestUnmarshalExtJSONErrors(t *testing.T) {
+	tests := []string{
+		`{"$oid":"nothex"}`,
+		`{"$numberInt":"99999999999"}`,
+		`{"$timestamp":5}`,
+		`{"$date":true}`,
+		`{"$binary":{"base64":"!!","subType":"00"}}`,
+		`{"$dbPointer":{"$ref":"db.c","$id":1}}`,
+		`{`,
+	}
+	for _, test := range tests {
+		if _, err := UnmarshalExtJSON([]byte(test)); err == nil {
+			t.Errorf("%s: expected an error", test)
+		}
+	}
+}
+
+func TestOpEnvelopeRoundTrip(t *testing.T) {
+	oid := bson.ObjectIdHex("5c8f9a1b2c3d4e5f60718293")
+	tests := []struct {
+		name string
+		op   *Op
+	}{
+		{
+			name: "insert",
+			op: &Op{
+				Id:        oid,
+				Operation: "i",
+				Namespace: "db.orders",
+				Timestamp: bson.MongoTimestamp(7<<32 | 1),
+				Source:    OplogQuerySource,
+				Data:      map[string]interface{}{"_id": oid, "qty": 3},
+			},
+		},
+		{
+			name: "direct read",
+			op: &Op{
+				Id:        "k",
+				Operation: "i",
+				Namespace: "db.orders",
+				Timestamp: bson.MongoTimestamp(9 << 32),
+				Source:    DirectQuerySource,
+				Sequence:  12,
+				Data:      map[string]interface{}{"_id": "k"},
+			},
+		},
+		{
+			name: "drop",
+			op: &Op{
+				Operation: "c",
+				Namespace: "db.$cmd",
+				Timestamp: bson.MongoTimestamp(1 << 32),
+				Data:      map[string]interface{}{"drop": "orders"},
+			},
+		},
+	}
+	for _, test := range tests {
+		test.op.Doc = test.op.Data
+		for _, mode := range []ExtJSONMode{CanonicalExtJSON, RelaxedExtJSON} {
+			b, err := test.op.MarshalExtJSON(mode)
+			if err != nil {
+				t.Errorf("%s (mode %d): %s", test.name, mode, err)
+				continue
+			}
+			var op Op
+			if err := op.UnmarshalJSON(b); err != nil {
+				t.Errorf("%s (mode %d): %s", test.name, mode, err)
+				continue
+			}
+			if op.Operation != test.op.Operation || op.Namespace != test.op.Namespace ||
+				op.Timestamp != test.op.Timestamp || op.Source != test.op.Source ||
+				op.Sequence != test.op.Sequence || !reflect.DeepEqual(op.Id, test.op.Id) {
+				t.Errorf("%s (mode %d): got %+v, want %+v", test.name, mode, op, test.op)
+			}
+			if !reflect.DeepEqual(op.Data, test.op.Data) {
+				t.Errorf("%s (mode %d): data %#v, want %#v", test.name, mode, op.Data, test.op.Data)
+			}
+		}
+	}
+	var op Op
+	if err := op.UnmarshalJSON([]byte(`{"v":99,"operation":"insert"}`)); err == nil {
+		t.Errorf("expected an error for a newer envelope version")
+	}
+}
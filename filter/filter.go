@@ -0,0 +1,286 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/rwynn/gtm"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// a declarative op filter. all non empty parts must match.
+// Namespaces and ExcludeNamespaces hold globs such as "db.*" or regular
+// expressions wrapped in slashes such as "/^db\.(users|orders)$/".
+// Operations holds names from insert, update, delete, command, drop,
+// dropCollection and dropDatabase (or the oplog codes i, u, d and c).
+// Query is a MongoDB query document evaluated against op.Data. commands,
+// deletes and update deltas always pass the Query since the document they
+// change is not available, so combine it with Operations to exclude them
+type Spec struct {
+	Namespaces        []string               `json:"namespaces" toml:"namespaces"`
+	ExcludeNamespaces []string               `json:"excludeNamespaces" toml:"excludeNamespaces"`
+	Operations        []string               `json:"operations" toml:"operations"`
+	Query             map[string]interface{} `json:"query" toml:"query"`
+}
+
+// a list of specs. an op passes if it matches any of them
+type Config struct {
+	Filters []Spec `json:"filters" toml:"filters"`
+}
+
+var EmptyConfig = errors.New("config not found or filters empty")
+
+// returns a filter for Options.Filter
+func (this *Config) Filter() (gtm.OpFilter, error) {
+	return this.compile(false)
+}
+
+// returns a filter for Options.NamespaceFilter which ignores the Query
+// of each spec, since op.Data is not available to namespace filters
+func (this *Config) NamespaceFilter() (gtm.OpFilter, error) {
+	return this.compile(true)
+}
+
+func (this *Config) compile(nsOnly bool) (gtm.OpFilter, error) {
+	if len(this.Filters) == 0 {
+		return nil, EmptyConfig
+	}
+	var filters []gtm.OpFilter
+	for i := range this.Filters {
+		spec := this.Filters[i]
+		if nsOnly {
+			spec.Query = nil
+		}
+		f, err := Compile(&spec)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return AnyOpFilters(filters...), nil
+}
+
+// returns a filter which accepts an op if any of the filters accept it
+func AnyOpFilters(filters ...gtm.OpFilter) gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		for _, filter := range filters {
+			if filter(op) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// compiles a spec into an OpFilter which may be combined with gtm.ChainOpFilters
+func Compile(spec *Spec) (gtm.OpFilter, error) {
+	var filters []gtm.OpFilter
+	if len(spec.Namespaces) > 0 {
+		include, err := compileNamespaces(spec.Namespaces)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, include)
+	}
+	if len(spec.ExcludeNamespaces) > 0 {
+		exclude, err := compileNamespaces(spec.ExcludeNamespaces)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, func(op *gtm.Op) bool {
+			return !exclude(op)
+		})
+	}
+	if len(spec.Operations) > 0 {
+		ops, err := compileOperations(spec.Operations)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, ops)
+	}
+	if len(spec.Query) > 0 {
+		query, err := compileDataQuery(spec.Query)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, query)
+	}
+	return gtm.ChainOpFilters(filters...), nil
+}
+
+// compiles a MongoDB query document into an OpFilter
+func CompileQuery(query map[string]interface{}) (gtm.OpFilter, error) {
+	return compileDataQuery(query)
+}
+
+// returns the namespace an op applies to, resolving drop commands to
+// the dropped collection instead of db.$cmd
+func Namespace(op *gtm.Op) string {
+	if col, drop := op.IsDropCollection(); drop {
+		return op.GetDatabase() + "." + col
+	}
+	return op.Namespace
+}
+
+// converts a glob, or a regular expression wrapped in slashes, to a regexp.
+// the same syntax as DirectReadNs, see gtm.NamespacePattern
+func NamespacePattern(pattern string) (*regexp.Regexp, error) {
+	return gtm.NamespacePattern(pattern)
+}
+
+func compileNamespaces(patterns []string) (gtm.OpFilter, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := NamespacePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %s: %s", pattern, err)
+		}
+		res = append(res, re)
+	}
+	return func(op *gtm.Op) bool {
+		ns := Namespace(op)
+		for _, re := range res {
+			if re.MatchString(ns) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileOperations(names []string) (gtm.OpFilter, error) {
+	var tests []func(*gtm.Op) bool
+	for _, name := range names {
+		switch name {
+		case "i", "insert":
+			tests = append(tests, (*gtm.Op).IsInsert)
+		case "u", "update":
+			tests = append(tests, (*gtm.Op).IsUpdate)
+		case "d", "delete":
+			tests = append(tests, (*gtm.Op).IsDelete)
+		case "c", "command":
+			tests = append(tests, (*gtm.Op).IsCommand)
+		case "drop":
+			tests = append(tests, (*gtm.Op).IsDrop)
+		case "dropCollection":
+			tests = append(tests, func(op *gtm.Op) bool {
+				_, drop := op.IsDropCollection()
+				return drop
+			})
+		case "dropDatabase":
+			tests = append(tests, func(op *gtm.Op) bool {
+				_, drop := op.IsDropDatabase()
+				return drop
+			})
+		default:
+			return nil, fmt.Errorf("Invalid operation %s", name)
+		}
+	}
+	return func(op *gtm.Op) bool {
+		for _, test := range tests {
+			if test(op) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileDataQuery(query map[string]interface{}) (gtm.OpFilter, error) {
+	m, err := compileQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return func(op *gtm.Op) bool {
+		if op.IsCommand() || op.IsDelete() {
+			// the document is not known so it cannot be matched
+			return true
+		}
+		if op.Data == nil {
+			// updates are filtered again once the document is fetched
+			return op.IsUpdate()
+		}
+		if op.IsUpdate() && !gtm.UpdateIsReplace(op.Data) {
+			// a delta with UpdateDataAsDelta only holds the changed fields
+			return true
+		}
+		return m(op.Data)
+	}, nil
+}
+
+// parses a JSON document in the shape of Config. query values may use
+// MongoDB Extended JSON such as {"$oid": "..."} or {"$date": "..."}
+func FromJSON(data []byte) (*Config, error) {
+	var raw struct {
+		Filters []struct {
+			Spec
+			Query json.RawMessage `json:"query"`
+		} `json:"filters"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	for _, f := range raw.Filters {
+		spec := f.Spec
+		if len(f.Query) > 0 {
+			query, err := parseQuery(f.Query)
+			if err != nil {
+				return nil, err
+			}
+			spec.Query = query
+		}
+		config.Filters = append(config.Filters, spec)
+	}
+	return config, nil
+}
+
+// parses a TOML document with one [[filters]] table per spec
+func FromTOML(data string) (*Config, error) {
+	config := &Config{}
+	if _, err := toml.Decode(data, config); err != nil {
+		return nil, err
+	}
+	for i := range config.Filters {
+		if config.Filters[i].Query == nil {
+			continue
+		}
+		// run the query through extended json so {"$oid" = "..."} style tables are typed
+		b, err := json.Marshal(config.Filters[i].Query)
+		if err != nil {
+			return nil, err
+		}
+		if config.Filters[i].Query, err = parseQuery(b); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// loads a Config from a .json or .toml file
+func FromFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return FromJSON(data)
+	}
+	return FromTOML(string(data))
+}
+
+func parseQuery(data []byte) (map[string]interface{}, error) {
+	val, err := gtm.UnmarshalExtJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	query, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("query must be a document")
+	}
+	return query, nil
+}
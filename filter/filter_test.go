@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/rwynn/gtm"
+)
+
+func insertOp(ns string, data map[string]interface{}) *gtm.Op {
+	return &gtm.Op{Id: data["_id"], Operation: "i", Namespace: ns, Data: data}
+}
+
+func TestCompileDataQuery(t *testing.T) {
+	query := map[string]interface{}{
+		"status": map[string]interface{}{"$in": []interface{}{"open", "pending"}},
+		"qty":    map[string]interface{}{"$gt": 2},
+	}
+	tests := []struct {
+		name string
+		op   *gtm.Op
+		want bool
+	}{
+		{
+			name: "matching insert",
+			op:   insertOp("db.orders", map[string]interface{}{"_id": 1, "status": "open", "qty": 3}),
+			want: true,
+		},
+		{
+			name: "insert failing one condition",
+			op:   insertOp("db.orders", map[string]interface{}{"_id": 1, "status": "open", "qty": 1}),
+			want: false,
+		},
+		{
+			name: "replacement update",
+			op:   &gtm.Op{Id: 1, Operation: "u", Data: map[string]interface{}{"_id": 1, "status": "closed", "qty": 5}},
+			want: false,
+		},
+		{
+			name: "update before its document is fetched",
+			op:   &gtm.Op{Id: 1, Operation: "u"},
+			want: true,
+		},
+		{
+			name: "set delta",
+			op:   &gtm.Op{Id: 1, Operation: "u", Data: map[string]interface{}{"$set": map[string]interface{}{"qty": 1}}},
+			want: true,
+		},
+		{
+			name: "unset delta",
+			op:   &gtm.Op{Id: 1, Operation: "u", Data: map[string]interface{}{"$unset": map[string]interface{}{"status": true}}},
+			want: true,
+		},
+		{
+			name: "v2 diff delta",
+			op:   &gtm.Op{Id: 1, Operation: "u", Data: map[string]interface{}{"$v": 2, "diff": map[string]interface{}{}}},
+			want: true,
+		},
+		{
+			name: "delete",
+			op:   &gtm.Op{Id: 1, Operation: "d"},
+			want: true,
+		},
+		{
+			name: "command",
+			op:   &gtm.Op{Operation: "c", Namespace: "db.$cmd", Data: map[string]interface{}{"drop": "orders"}},
+			want: true,
+		},
+	}
+	f, err := compileDataQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if got := f(test.op); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	open := map[string]interface{}{"_id": 1, "status": "open"}
+	tests := []struct {
+		name string
+		spec Spec
+		op   *gtm.Op
+		want bool
+	}{
+		{name: "empty spec", spec: Spec{}, op: insertOp("db.orders", open), want: true},
+		{name: "glob", spec: Spec{Namespaces: []string{"db.*"}}, op: insertOp("db.orders", open), want: true},
+		{name: "glob miss", spec: Spec{Namespaces: []string{"other.*"}}, op: insertOp("db.orders", open), want: false},
+		{name: "single character glob", spec: Spec{Namespaces: []string{"db.order?"}}, op: insertOp("db.orders", open), want: true},
+		{name: "regex", spec: Spec{Namespaces: []string{`/^db\.(users|orders)$/`}}, op: insertOp("db.orders", open), want: true},
+		{
+			name: "excluded",
+			spec: Spec{Namespaces: []string{"db.*"}, ExcludeNamespaces: []string{"db.orders"}},
+			op:   insertOp("db.orders", open),
+			want: false,
+		},
+		{
+			name: "drop resolves to the dropped collection",
+			spec: Spec{Namespaces: []string{"db.orders"}},
+			op:   &gtm.Op{Operation: "c", Namespace: "db.$cmd", Data: map[string]interface{}{"drop": "orders"}},
+			want: true,
+		},
+		{name: "operation name", spec: Spec{Operations: []string{"insert"}}, op: insertOp("db.orders", open), want: true},
+		{name: "operation code", spec: Spec{Operations: []string{"u", "d"}}, op: insertOp("db.orders", open), want: false},
+		{
+			name: "drop operation",
+			spec: Spec{Operations: []string{"dropCollection"}},
+			op:   &gtm.Op{Operation: "c", Namespace: "db.$cmd", Data: map[string]interface{}{"drop": "orders"}},
+			want: true,
+		},
+		{
+			name: "query",
+			spec: Spec{Query: map[string]interface{}{"status": "open"}},
+			op:   insertOp("db.orders", open),
+			want: true,
+		},
+		{
+			name: "query miss",
+			spec: Spec{Query: map[string]interface{}{"status": "closed"}},
+			op:   insertOp("db.orders", open),
+			want: false,
+		},
+		{
+			name: "delete passes the query",
+			spec: Spec{Query: map[string]interface{}{"status": "closed"}},
+			op:   &gtm.Op{Id: 1, Operation: "d", Namespace: "db.orders"},
+			want: true,
+		},
+		{
+			name: "operations exclude deletes from a query",
+			spec: Spec{Operations: []string{"insert", "update"}, Query: map[string]interface{}{"status": "closed"}},
+			op:   &gtm.Op{Id: 1, Operation: "d", Namespace: "db.orders"},
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		f, err := Compile(&test.spec)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := f(test.op); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec Spec
+	}{
+		{name: "bad regex", spec: Spec{Namespaces: []string{"/(/"}}},
+		{name: "bad operation", spec: Spec{Operations: []string{"upsert"}}},
+		{name: "bad top level operator", spec: Spec{Query: map[string]interface{}{"$where": "1"}}},
+		{name: "bad logical operator", spec: Spec{Query: map[string]interface{}{"$or": []interface{}{}}}},
+	}
+	for _, test := range tests {
+		if _, err := Compile(&test.spec); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
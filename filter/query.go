@@ -0,0 +1,513 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// a compiled MongoDB query document
+type matcher func(doc map[string]interface{}) bool
+
+// a compiled condition on the value(s) found at a path
+type valueMatcher func(values []interface{}, exists bool) bool
+
+func compileQuery(query map[string]interface{}) (matcher, error) {
+	var matchers []matcher
+	for key, val := range query {
+		var m matcher
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			m, err = compileLogical(key, val)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("Unsupported top level operator %s", key)
+			}
+			m, err = compileField(key, val)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, val interface{}) (matcher, error) {
+	clauses, ok := val.([]interface{})
+	if !ok || len(clauses) == 0 {
+		return nil, fmt.Errorf("%s expects a non empty array", op)
+	}
+	var matchers []matcher
+	for _, clause := range clauses {
+		q, ok := toDoc(clause)
+		if !ok {
+			return nil, fmt.Errorf("%s expects an array of documents", op)
+		}
+		m, err := compileQuery(q)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc map[string]interface{}) bool {
+		for _, m := range matchers {
+			matched := m(doc)
+			if op == "$and" && !matched {
+				return false
+			} else if op == "$or" && matched {
+				return true
+			} else if op == "$nor" && matched {
+				return false
+			}
+		}
+		return op != "$or"
+	}, nil
+}
+
+func compileField(path string, val interface{}) (matcher, error) {
+	var vm valueMatcher
+	var err error
+	if cond, ok := toDoc(val); ok && isOperatorDoc(cond) {
+		vm, err = compileOperators(cond)
+	} else {
+		vm = equals(val)
+	}
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(path, ".")
+	return func(doc map[string]interface{}) bool {
+		values, exists := resolve(doc, parts)
+		return vm(values, exists)
+	}, nil
+}
+
+func isOperatorDoc(doc map[string]interface{}) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func compileOperators(cond map[string]interface{}) (valueMatcher, error) {
+	var matchers []valueMatcher
+	options, _ := cond["$options"].(string)
+	for op, arg := range cond {
+		var vm valueMatcher
+		switch op {
+		case "$eq":
+			vm = equals(arg)
+		case "$ne":
+			vm = not(equals(arg))
+		case "$gt", "$gte", "$lt", "$lte":
+			vm = comparison(op, arg)
+		case "$in", "$nin":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s expects an array", op)
+			}
+			var any []valueMatcher
+			for _, item := range list {
+				any = append(any, equals(item))
+			}
+			vm = func(values []interface{}, exists bool) bool {
+				for _, m := range any {
+					if m(values, exists) {
+						return true
+					}
+				}
+				return false
+			}
+			if op == "$nin" {
+				vm = not(vm)
+			}
+		case "$exists":
+			want := truthy(arg)
+			vm = func(values []interface{}, exists bool) bool {
+				return exists == want
+			}
+		case "$regex":
+			re, err := compileRegex(arg, options)
+			if err != nil {
+				return nil, err
+			}
+			vm = matchRegex(re)
+		case "$options":
+			continue
+		case "$not":
+			var inner valueMatcher
+			var err error
+			if sub, ok := toDoc(arg); ok && isOperatorDoc(sub) {
+				inner, err = compileOperators(sub)
+			} else {
+				var re *regexp.Regexp
+				if re, err = compileRegex(arg, ""); err == nil {
+					inner = matchRegex(re)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			vm = not(inner)
+		case "$size":
+			size, ok := toFloat(arg)
+			if !ok {
+				return nil, fmt.Errorf("$size expects a number")
+			}
+			vm = func(values []interface{}, exists bool) bool {
+				for _, v := range values {
+					if arr, ok := v.([]interface{}); ok && float64(len(arr)) == size {
+						return true
+					}
+				}
+				return false
+			}
+		case "$all":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$all expects an array")
+			}
+			var all []valueMatcher
+			for _, item := range list {
+				all = append(all, equals(item))
+			}
+			vm = func(values []interface{}, exists bool) bool {
+				if len(all) == 0 {
+					return false
+				}
+				for _, m := range all {
+					if !m(values, exists) {
+						return false
+					}
+				}
+				return true
+			}
+		case "$elemMatch":
+			sub, ok := toDoc(arg)
+			if !ok {
+				return nil, fmt.Errorf("$elemMatch expects a document")
+			}
+			var docMatch matcher
+			var valMatch valueMatcher
+			var err error
+			if isOperatorDoc(sub) {
+				valMatch, err = compileOperators(sub)
+			} else {
+				docMatch, err = compileQuery(sub)
+			}
+			if err != nil {
+				return nil, err
+			}
+			vm = func(values []interface{}, exists bool) bool {
+				for _, v := range values {
+					arr, ok := v.([]interface{})
+					if !ok {
+						continue
+					}
+					for _, elem := range arr {
+						if docMatch != nil {
+							if d, ok := toDoc(elem); ok && docMatch(d) {
+								return true
+							}
+						} else if valMatch([]interface{}{elem}, true) {
+							return true
+						}
+					}
+				}
+				return false
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported query operator %s", op)
+		}
+		matchers = append(matchers, vm)
+	}
+	return func(values []interface{}, exists bool) bool {
+		for _, m := range matchers {
+			if !m(values, exists) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func not(vm valueMatcher) valueMatcher {
+	return func(values []interface{}, exists bool) bool {
+		return !vm(values, exists)
+	}
+}
+
+// matches if the value, or any element of an array value, equals want
+func equals(want interface{}) valueMatcher {
+	return func(values []interface{}, exists bool) bool {
+		if want == nil && !exists {
+			return true
+		}
+		for _, v := range values {
+			if equal(v, want) {
+				return true
+			}
+			if arr, ok := v.([]interface{}); ok {
+				for _, elem := range arr {
+					if equal(elem, want) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+func comparison(op string, want interface{}) valueMatcher {
+	test := func(v interface{}) bool {
+		c, ok := compare(v, want)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	}
+	return func(values []interface{}, exists bool) bool {
+		for _, v := range values {
+			if test(v) {
+				return true
+			}
+			if arr, ok := v.([]interface{}); ok {
+				for _, elem := range arr {
+					if test(elem) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+func compileRegex(arg interface{}, options string) (*regexp.Regexp, error) {
+	var pattern string
+	switch re := arg.(type) {
+	case string:
+		pattern = re
+	case bson.RegEx:
+		pattern, options = re.Pattern, re.Options+options
+	default:
+		return nil, fmt.Errorf("$regex expects a string")
+	}
+	var flags string
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func matchRegex(re *regexp.Regexp) valueMatcher {
+	return func(values []interface{}, exists bool) bool {
+		for _, v := range values {
+			if s, ok := v.(string); ok && re.MatchString(s) {
+				return true
+			}
+			if arr, ok := v.([]interface{}); ok {
+				for _, elem := range arr {
+					if s, ok := elem.(string); ok && re.MatchString(s) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+// returns every value reachable at path, descending into arrays of documents
+func resolve(doc map[string]interface{}, path []string) ([]interface{}, bool) {
+	val, ok := doc[path[0]]
+	if !ok {
+		return nil, false
+	}
+	if len(path) == 1 {
+		return []interface{}{val}, true
+	}
+	if sub, ok := toDoc(val); ok {
+		return resolve(sub, path[1:])
+	}
+	if arr, ok := val.([]interface{}); ok {
+		var values []interface{}
+		found := false
+		for _, elem := range arr {
+			if sub, ok := toDoc(elem); ok {
+				if vals, exists := resolve(sub, path[1:]); exists {
+					values = append(values, vals...)
+					found = true
+				}
+			}
+		}
+		return values, found
+	}
+	return nil, false
+}
+
+func toDoc(val interface{}) (map[string]interface{}, bool) {
+	switch d := val.(type) {
+	case map[string]interface{}:
+		return d, true
+	case bson.M:
+		return d, true
+	case bson.D:
+		return d.Map(), true
+	default:
+		return nil, false
+	}
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func truthy(val interface{}) bool {
+	if b, ok := val.(bool); ok {
+		return b
+	}
+	if n, ok := toFloat(val); ok {
+		return n != 0
+	}
+	return val != nil
+}
+
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	da, aok := toDoc(a)
+	db, bok := toDoc(b)
+	if aok && bok {
+		if len(da) != len(db) {
+			return false
+		}
+		for k, v := range da {
+			if !equal(v, db[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	aa, aok := a.([]interface{})
+	ab, bok := b.([]interface{})
+	if aok && bok {
+		if len(aa) != len(ab) {
+			return false
+		}
+		for i := range aa {
+			if !equal(aa[i], ab[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == nil && b == nil
+}
+
+// compares two scalar values of the same kind. ok is false when the
+// values are not comparable, following MongoDB's type bracketing
+func compare(a, b interface{}) (c int, ok bool) {
+	if fa, aok := toFloat(a); aok {
+		if fb, bok := toFloat(b); bok {
+			return compareFloat(fa, fb), true
+		}
+		return 0, false
+	}
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), true
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			if va == vb {
+				return 0, true
+			} else if !va {
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			if va.Before(vb) {
+				return -1, true
+			} else if va.After(vb) {
+				return 1, true
+			}
+			return 0, true
+		}
+	case bson.ObjectId:
+		if vb, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(va.Hex(), vb.Hex()), true
+		}
+	case bson.MongoTimestamp:
+		if vb, ok := b.(bson.MongoTimestamp); ok {
+			if uint64(va) < uint64(vb) {
+				return -1, true
+			} else if uint64(va) > uint64(vb) {
+				return 1, true
+			}
+			return 0, true
+		}
+	case bson.Decimal128:
+		if vb, ok := b.(bson.Decimal128); ok && va.String() == vb.String() {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func compareFloat(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
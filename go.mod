@@ -0,0 +1,13 @@
+module github.com/rwynn/gtm
+
+go 1.12
+
+require (
+	github.com/BurntSushi/toml v1.0.0
+	github.com/Shopify/sarama v1.23.1
+	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
+	github.com/pkg/errors v0.9.1
+	github.com/serialx/hashring v0.0.0-20200727003509-22c0c7ab6b1b
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/jcmturner/goidentity.v3 v3.0.0 // indirect
+)
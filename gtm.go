@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +25,15 @@ const (
 
 type QuerySource int
 
+// what Flush does with an update whose document could not be fetched
+type FetchFailureAction int
+
+const (
+	EmitFailedFetches FetchFailureAction = iota // send the op without Data
+	DropFailedFetches                           // do not send the op
+	HoldFailedFetches                           // keep the batch buffered until the lookup succeeds or FetchHoldFlushes is reached
+)
+
 const (
 	OplogQuerySource QuerySource = iota
 	DirectQuerySource
@@ -47,8 +57,40 @@ type Options struct {
 	DirectReadFilter    OpFilter
 	DirectReadBatchSize int
 	DirectReadCursors   int
+	DirectReadDedupe    bool // drop direct read ops superseded by the oplog during the read. keeps the ids changed during each read
+	DirectReadSnapshot  bool // read at a snapshot with readConcern snapshot on MongoDB 5.0+
+	DirectReadQueries   map[string]*DirectReadQuery
+	DirectReadOnCreate  bool // also read collections matching a DirectReadNs pattern when they are created
+	DirectReadProgress  DirectReadProgressHandler
+	ProgressInterval    time.Duration // how often DirectReadProgress is called during a read
+	DirectReadEvents    bool          // send a DirectReadDone on DirectReadDoneC as each namespace is read
 	Unmarshal           DataUnmarshaller
 	Log                 *log.Logger
+	AllCommands         bool // send create, rename, index and other commands on OpC, not only drops
+	OpLogQueryFilter    *OpLogQueryFilter
+	Projections         map[string]bson.M
+	Redactions          []RedactSpec
+	Redactor            Redactor
+	TailRateLimit       RateLimit
+	DirectReadRateLimit RateLimit
+	MaxBufferedBytes    int64 // approximate bytes of oplog and direct read ops held before they are sent on OpC
+	RetryPolicy         *RetryPolicy
+	RetryOverrides      map[RetryStage]*RetryPolicy
+	FetchFailure        FetchFailureAction
+	FetchHoldFlushes    int                 // failed flushes a held batch is kept for before its ops are emitted without Data
+	Until               bson.MongoTimestamp // stop after the last oplog entry at or before Until
+	UntilTime           time.Time           // stop before the first oplog entry written at or after UntilTime
+}
+
+// conditions added to the oplog query so that unwanted entries are
+// filtered by the server. NamespaceFilter and Filter still apply afterwards.
+// drops of Namespaces are always matched. SetDefaults adds the commands which
+// AllCommands and DirectReadOnCreate consume to Commands
+type OpLogQueryFilter struct {
+	Namespaces       []string // exact namespaces e.g. db.collection
+	NamespaceRegexes []string // server side regular expressions on ns
+	Operations       []string // oplog operation codes i, u, d and c
+	Commands         []string // command names e.g. create matched in every database. * matches every command
 }
 
 type Op struct {
@@ -59,6 +101,14 @@ type Op struct {
 	Timestamp bson.MongoTimestamp    `json:"timestamp"`
 	Source    QuerySource            `json:"source"`
 	Doc       interface{}            `json:"doc,omitempty"`
+	Sequence  int64                  `json:"sequence,omitempty"` // order of a direct read op within its namespace
+	// the oplog timestamp to resume after once this op and every op received
+	// before it are processed. with several fetch workers this trails Timestamp.
+	// zero for direct read ops. not adjusted for a Since or Seek backwards
+	Checkpoint bson.MongoTimestamp `json:"-"`
+
+	bufferedBytes int64
+	seekEpoch     int64
 }
 
 type OpLog struct {
@@ -75,6 +125,8 @@ type CursorInfo struct {
 	Firstbatch []bson.Raw "firstBatch"
 	Namespace  string     "ns"
 	Id         int64      "id"
+
+	readTs bson.MongoTimestamp // cluster time before the scan started
 }
 
 type Cursor struct {
@@ -98,6 +150,12 @@ type Doc struct {
 
 type OpChan chan *Op
 
+// sent on ErrC for each op whose document could not be fetched or unmarshalled
+type FetchError struct {
+	Op  *Op
+	Err error
+}
+
 type OpLogEntry map[string]interface{}
 
 type OpFilter func(*Op) bool
@@ -113,37 +171,53 @@ type OpBuf struct {
 	BufferSize     int
 	BufferDuration time.Duration
 	FlushTicker    *time.Ticker
+	worker         int
+	last           bson.MongoTimestamp
+	held           int
 }
 
 type OpCtx struct {
-	lock         *sync.Mutex
-	OpC          OpChan
-	ErrC         chan error
-	DirectReadWg *sync.WaitGroup
-	stopC        chan bool
-	allWg        *sync.WaitGroup
-	seekC        chan bson.MongoTimestamp
-	pauseC       chan bool
-	resumeC      chan bool
-	paused       bool
-	stopped      bool
-	log          *log.Logger
+	lock            *sync.Mutex
+	OpC             OpChan
+	ErrC            chan error
+	DirectReadDoneC chan *DirectReadDone // nil unless Options.DirectReadEvents is set
+	DirectReadWg    *sync.WaitGroup
+	TailWg          *sync.WaitGroup
+	stopC           chan bool
+	allWg           *sync.WaitGroup
+	seekC           chan seekRequest
+	seek            *seekMark
+	gate            *pauseGate
+	stopped         bool
+	log             *log.Logger
+	tailThrottle    *throttle
+	directThrottle  *throttle
+	budget          *memoryBudget
+	stats           *ctxStats
+	directReads     *directReadTracker
+	scanSeq         *scanSequence
+	session         *mgo.Session
+	nsPatterns      []*nsPattern
+	progress        *progressTracker
+	marks           *workerMarks
+	options         *Options
+	bounded         bool
 }
 
 type OpCtxMulti struct {
-	lock         *sync.Mutex
-	contexts     []*OpCtx
-	OpC          OpChan
-	ErrC         chan error
-	DirectReadWg *sync.WaitGroup
-	stopC        chan bool
-	allWg        *sync.WaitGroup
-	seekC        chan bson.MongoTimestamp
-	pauseC       chan bool
-	resumeC      chan bool
-	paused       bool
-	stopped      bool
-	log          *log.Logger
+	lock            *sync.Mutex
+	contexts        []*OpCtx
+	OpC             OpChan
+	ErrC            chan error
+	DirectReadDoneC chan *DirectReadDone
+	DirectReadWg    *sync.WaitGroup
+	TailWg          *sync.WaitGroup
+	stopC           chan bool
+	allWg           *sync.WaitGroup
+	gate            *pauseGate
+	stopped         bool
+	log             *log.Logger
+	bounded         bool
 }
 
 type ShardInfo struct {
@@ -195,110 +269,221 @@ func (shard *ShardInfo) GetURL() string {
 	}
 }
 
-func (ctx *OpCtx) waitForConnection(wg *sync.WaitGroup, session *mgo.Session, options *Options) {
-	defer wg.Done()
-	t := time.NewTicker(5 * time.Second)
-	defer t.Stop()
-	for {
-		select {
-		case <-ctx.stopC:
-			return
-		case <-t.C:
-			s := session.Copy()
-			if err := s.Ping(); err == nil {
-				s.Close()
-				return
-			}
-			s.Close()
-		}
+func (ctx *OpCtx) sendOp(op *Op, options *Options) {
+	if ctx.directReads != nil {
+		ctx.directReads.sendOp(ctx, op, options)
+		return
 	}
+	ctx.deliverOp(op, options)
+}
+
+func (ctx *OpCtx) deliverOp(op *Op, options *Options) {
+	op.redact(options)
+	select {
+	case ctx.OpC <- op:
+	default:
+		// the consumer is not keeping up
+		atomic.AddInt64(&ctx.stats.blockedSenders, 1)
+		start := time.Now()
+		ctx.OpC <- op
+		atomic.AddInt64(&ctx.stats.consumerBlocked, int64(time.Since(start)))
+		atomic.AddInt64(&ctx.stats.blockedSenders, -1)
+	}
+	ctx.releaseOp(op)
 }
 
 func (ctx *OpCtx) isStopped() bool {
-	ctx.lock.Lock()
-	defer ctx.lock.Unlock()
-	return ctx.stopped
+	return isClosed(ctx.stopC)
 }
 
-func (ctx *OpCtx) Since(ts bson.MongoTimestamp) {
-	ctx.lock.Lock()
-	defer ctx.lock.Unlock()
-	ctx.seekC <- ts
+// restarts tailing the oplog after ts
+func (ctx *OpCtx) Since(ts bson.MongoTimestamp) error {
+	if ctx.isStopped() {
+		return ErrStopped
+	}
+	ctx.requestSeek(seekRequest{ts: ts, epoch: ctx.seek.set(ts, false)})
+	return nil
 }
 
-func (ctx *OpCtx) Pause() {
-	ctx.lock.Lock()
-	defer ctx.lock.Unlock()
-	if !ctx.paused {
-		ctx.paused = true
-		ctx.pauseC <- true
+// like Since but also drops buffered ops after ts so that ops read again
+// after seeking backwards are not sent twice
+func (ctx *OpCtx) Seek(ts bson.MongoTimestamp) error {
+	if ctx.isStopped() {
+		return ErrStopped
 	}
+	ctx.requestSeek(seekRequest{ts: ts, epoch: ctx.seek.set(ts, true)})
+	return nil
 }
 
-func (ctx *OpCtx) Resume() {
-	ctx.lock.Lock()
-	defer ctx.lock.Unlock()
-	if ctx.paused {
-		ctx.paused = false
-		ctx.resumeC <- true
+// pauses tailing, document fetching and direct reads
+func (ctx *OpCtx) Pause() error {
+	if ctx.isStopped() {
+		return ErrStopped
 	}
+	ctx.gate.pause()
+	return nil
 }
 
+func (ctx *OpCtx) Resume() error {
+	if ctx.isStopped() {
+		return ErrStopped
+	}
+	ctx.gate.resume()
+	return nil
+}
+
+func (ctx *OpCtx) IsPaused() bool {
+	return ctx.gate.isPaused()
+}
+
+// the wait is outside the lock so that goroutines in allWg which start
+// direct reads see stopped instead of blocking Stop
+// DirectReadDoneC is closed once every direct read has ended
 func (ctx *OpCtx) Stop() {
 	ctx.lock.Lock()
-	defer ctx.lock.Unlock()
-	if !ctx.stopped {
+	first := !ctx.stopped
+	if first {
 		ctx.stopped = true
 		close(ctx.stopC)
-		ctx.allWg.Wait()
+		ctx.budget.close()
+	}
+	ctx.lock.Unlock()
+	ctx.allWg.Wait()
+	if first && ctx.DirectReadDoneC != nil {
+		close(ctx.DirectReadDoneC)
+	}
+}
+
+func isClosed(c chan bool) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
 	}
 }
 
-func (ctx *OpCtxMulti) Since(ts bson.MongoTimestamp) {
+// counts a new direct read in allWg and DirectReadWg. returns false once
+// Stop has been called, when adding could race with its wait
+func (ctx *OpCtx) addDirectRead() bool {
 	ctx.lock.Lock()
 	defer ctx.lock.Unlock()
-	for _, child := range ctx.contexts {
-		child.Since(ts)
+	if ctx.stopped {
+		return false
 	}
+	ctx.allWg.Add(1)
+	ctx.DirectReadWg.Add(1)
+	return true
+}
+
+func (ctx *OpCtxMulti) isStopped() bool {
+	return isClosed(ctx.stopC)
 }
 
-func (ctx *OpCtxMulti) Pause() {
+// as OpCtx.addDirectRead
+func (ctx *OpCtxMulti) addDirectRead() bool {
 	ctx.lock.Lock()
 	defer ctx.lock.Unlock()
-	if !ctx.paused {
-		ctx.paused = true
-		ctx.pauseC <- true
-		for _, child := range ctx.contexts {
-			child.Pause()
-		}
+	if ctx.stopped {
+		return false
 	}
+	ctx.allWg.Add(1)
+	ctx.DirectReadWg.Add(1)
+	return true
 }
 
-func (ctx *OpCtxMulti) Resume() {
+func (ctx *OpCtxMulti) each(f func(*OpCtx) error) error {
+	if ctx.isStopped() {
+		return ErrStopped
+	}
 	ctx.lock.Lock()
 	defer ctx.lock.Unlock()
-	if ctx.paused {
-		ctx.paused = false
-		ctx.resumeC <- true
-		for _, child := range ctx.contexts {
-			child.Resume()
+	for _, child := range ctx.contexts {
+		if err := f(child); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (ctx *OpCtxMulti) Since(ts bson.MongoTimestamp) error {
+	return ctx.each(func(child *OpCtx) error {
+		return child.Since(ts)
+	})
+}
+
+func (ctx *OpCtxMulti) Seek(ts bson.MongoTimestamp) error {
+	return ctx.each(func(child *OpCtx) error {
+		return child.Seek(ts)
+	})
+}
+
+func (ctx *OpCtxMulti) Pause() error {
+	if ctx.isStopped() {
+		return ErrStopped
+	}
+	ctx.gate.pause()
+	return ctx.each((*OpCtx).Pause)
+}
+
+func (ctx *OpCtxMulti) Resume() error {
+	if ctx.isStopped() {
+		return ErrStopped
+	}
+	ctx.gate.resume()
+	return ctx.each((*OpCtx).Resume)
 }
 
+func (ctx *OpCtxMulti) IsPaused() bool {
+	return ctx.gate.isPaused()
+}
+
+// DirectReadDoneC is closed once the forwarders from the children have
+// returned. as for OpCtx the wait is outside the lock, which tailShards takes
 func (ctx *OpCtxMulti) Stop() {
 	ctx.lock.Lock()
-	defer ctx.lock.Unlock()
-	if !ctx.stopped {
+	first := !ctx.stopped
+	if first {
 		ctx.stopped = true
 		close(ctx.stopC)
 		for _, child := range ctx.contexts {
 			go child.Stop()
 		}
-		ctx.allWg.Wait()
+	}
+	ctx.lock.Unlock()
+	ctx.allWg.Wait()
+	if first && ctx.DirectReadDoneC != nil {
+		close(ctx.DirectReadDoneC)
 	}
 }
 
+// the forwarder is counted in allWg and returns on stop or when the child
+// closes its channel
+func (ctx *OpCtxMulti) forwardDirectReadDone(child *OpCtx) {
+	if ctx.DirectReadDoneC == nil || child.DirectReadDoneC == nil {
+		return
+	}
+	ctx.allWg.Add(1)
+	go func(c chan *DirectReadDone) {
+		defer ctx.allWg.Done()
+		for {
+			select {
+			case <-ctx.stopC:
+				return
+			case done, ok := <-c:
+				if !ok {
+					return
+				}
+				select {
+				case ctx.DirectReadDoneC <- done:
+				case <-ctx.stopC:
+					return
+				}
+			}
+		}
+	}(child.DirectReadDoneC)
+}
+
 func tailShards(multi *OpCtxMulti, ctx *OpCtx, options *Options, handler ShardInsertHandler) {
 	defer multi.allWg.Done()
 	if options == nil {
@@ -306,16 +491,14 @@ func tailShards(multi *OpCtxMulti, ctx *OpCtx, options *Options, handler ShardIn
 	} else {
 		options.SetDefaults()
 	}
+	retry := options.retrier(ShardListenerStage)
 	for {
+		if !multi.gate.wait(multi.stopC) {
+			return
+		}
 		select {
 		case <-multi.stopC:
 			return
-		case <-multi.pauseC:
-			<-multi.resumeC
-			select {
-			case <-multi.stopC:
-				return
-			}
 		case err := <-ctx.ErrC:
 			multi.ErrC <- err
 		case op := <-ctx.OpC:
@@ -323,12 +506,14 @@ func tailShards(multi *OpCtxMulti, ctx *OpCtx, options *Options, handler ShardIn
 			shardInfo := &ShardInfo{
 				hostname: op.Data["host"].(string),
 			}
-			shardSession, err := handler(shardInfo)
-			if err != nil {
-				multi.ErrC <- errors.Wrap(err, "Error calling shard handler")
+			shardSession, ok := multi.callShardHandler(handler, shardInfo, retry)
+			if !ok {
 				continue
 			}
 			shardCtx := Start(shardSession, options)
+			if multi.gate.isPaused() {
+				shardCtx.Pause()
+			}
 			multi.lock.Lock()
 			multi.contexts = append(multi.contexts, shardCtx)
 			multi.DirectReadWg.Add(1)
@@ -336,6 +521,11 @@ func tailShards(multi *OpCtxMulti, ctx *OpCtx, options *Options, handler ShardIn
 				defer multi.DirectReadWg.Done()
 				shardCtx.DirectReadWg.Wait()
 			}()
+			multi.TailWg.Add(1)
+			go func() {
+				defer multi.TailWg.Done()
+				shardCtx.TailWg.Wait()
+			}()
 			multi.allWg.Add(1)
 			go func() {
 				defer multi.allWg.Done()
@@ -351,17 +541,56 @@ func tailShards(multi *OpCtxMulti, ctx *OpCtx, options *Options, handler ShardIn
 					multi.ErrC <- err
 				}
 			}(shardCtx.ErrC)
+			multi.forwardDirectReadDone(shardCtx)
 			multi.lock.Unlock()
 		}
 	}
 }
 
+// calls the handler for a new shard, retrying failures under the retry policy
+func (ctx *OpCtxMulti) callShardHandler(handler ShardInsertHandler, info *ShardInfo, r *retrier) (*mgo.Session, bool) {
+	r.reset()
+	for {
+		session, err := handler(info)
+		if err == nil {
+			return session, true
+		}
+		ctx.ErrC <- errors.Wrap(err, "Error calling shard handler")
+		if err = r.wait(ctx.stopC); err != nil {
+			if err == errRetryStopped {
+				return nil, false
+			}
+			if r.policy.StopOnExhausted {
+				ctx.ErrC <- err
+				go ctx.Stop()
+			} else {
+				ctx.ErrC <- errors.Wrap(ErrRetriesExhausted, fmt.Sprintf("Giving up on shard %s", info.hostname))
+			}
+			return nil, false
+		}
+	}
+}
+
+// a bounded context only replays the shards it was started with since its
+// OpC closes once they are done. ErrBounded is sent on ErrC instead
 func (ctx *OpCtxMulti) AddShardListener(
 	configSession *mgo.Session, shardOptions *Options, handler ShardInsertHandler) {
+	if ctx.bounded {
+		ctx.ErrC <- ErrBounded
+		return
+	}
 	opts := DefaultOptions()
 	opts.NamespaceFilter = func(op *Op) bool {
 		return op.Namespace == "config.shards" && op.IsInsert()
 	}
+	opts.OpLogQueryFilter = &OpLogQueryFilter{
+		Namespaces: []string{"config.shards"},
+		Operations: []string{"i"},
+	}
+	if shardOptions != nil {
+		policy := *shardOptions.retryPolicy(ShardListenerStage)
+		opts.RetryPolicy = &policy
+	}
 	configCtx := Start(configSession, opts)
 	ctx.allWg.Add(1)
 	go tailShards(ctx, configCtx, shardOptions, handler)
@@ -388,6 +617,19 @@ func (this *Op) IsDrop() bool {
 	return false
 }
 
+func (this *Op) IsCreateCollection() (string, bool) {
+	if this.IsCommand() {
+		if this.Data != nil {
+			if val, ok := this.Data["create"]; ok {
+				if col, ok := val.(string); ok {
+					return col, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
 func (this *Op) IsDropCollection() (string, bool) {
 	if this.IsCommand() {
 		if this.Data != nil {
@@ -452,6 +694,14 @@ func (this *Op) GetCollection() string {
 	}
 }
 
+func (this *FetchError) Error() string {
+	return fmt.Sprintf("Error fetching document %v in %s: %s", this.Op.Id, this.Op.Namespace, this.Err)
+}
+
+func (this *FetchError) Cause() error {
+	return this.Err
+}
+
 func (this *OpBuf) Append(op *Op) {
 	this.Entries = append(this.Entries, op)
 }
@@ -460,12 +710,30 @@ func (this *OpBuf) IsFull() bool {
 	return len(this.Entries) >= this.BufferSize
 }
 
+func (this *OpBuf) discard(ctx *OpCtx) {
+	for _, op := range this.Entries {
+		ctx.releaseOp(op)
+	}
+	this.Entries = nil
+}
+
+func fetchDocuments(session *mgo.Session, n string, opIds []interface{}, options *Options) (results []*bson.Raw, err error) {
+	var parts = strings.SplitN(n, ".", 2)
+	db, col := parts[0], parts[1]
+	sel := bson.M{"_id": bson.M{"$in": opIds}}
+	collection := session.DB(db).C(col)
+	err = collection.Find(sel).Select(options.projectionFor(n)).All(&results)
+	return
+}
+
 func (this *OpBuf) Flush(session *mgo.Session, ctx *OpCtx, options *Options) {
 	if len(this.Entries) == 0 {
 		return
 	}
 	ns := make(map[string][]interface{})
 	byId := make(map[interface{}][]*Op)
+	failed := make(map[*Op]error)
+	retry := options.retrier(FetchStage)
 	for _, op := range this.Entries {
 		if op.IsUpdate() && op.Doc == nil {
 			idKey := fmt.Sprintf("%s.%v", op.Namespace, op.Id)
@@ -473,49 +741,68 @@ func (this *OpBuf) Flush(session *mgo.Session, ctx *OpCtx, options *Options) {
 			byId[idKey] = append(byId[idKey], op)
 		}
 	}
-Retry:
 	for n, opIds := range ns {
-		var parts = strings.SplitN(n, ".", 2)
-		var results []*bson.Raw
-		db, col := parts[0], parts[1]
-		sel := bson.M{"_id": bson.M{"$in": opIds}}
-		collection := session.DB(db).C(col)
-		err := collection.Find(sel).All(&results)
-		if err == nil {
-			for _, result := range results {
-				var doc Doc
-				result.Unmarshal(&doc)
-				resultId := fmt.Sprintf("%s.%v", n, doc.Id)
-				if ops, ok := byId[resultId]; ok {
-					for _, o := range ops {
-						if u, err := options.Unmarshal(o.Namespace, result); err == nil {
-							o.processData(u)
-						} else {
-							ctx.ErrC <- err
-						}
-					}
-				}
-			}
-		} else {
+		results, err := fetchDocuments(session, n, opIds, options)
+		for err != nil {
 			ctx.ErrC <- errors.Wrap(err, "Error finding documents to associate with ops")
-			var wg sync.WaitGroup
-			wg.Add(1)
-			go ctx.waitForConnection(&wg, session, options)
-			wg.Wait()
-			if ctx.isStopped() {
-				this.Entries = nil
-				return
+			if !ctx.waitForConnection(session, retry, ctx.stopC) {
+				break
 			}
 			session.Refresh()
-			break Retry
+			results, err = fetchDocuments(session, n, opIds, options)
+		}
+		if err != nil {
+			if ctx.isStopped() || retry.policy.StopOnExhausted {
+				this.discard(ctx)
+				return
+			}
+			if options.FetchFailure == HoldFailedFetches && this.held+1 < options.FetchHoldFlushes {
+				// keep the whole batch, in order, for the next flush
+				this.held++
+				return
+			}
+			for _, id := range opIds {
+				for _, o := range byId[fmt.Sprintf("%s.%v", n, id)] {
+					failed[o] = err
+				}
+			}
+			continue
+		}
+		retry.reset()
+		for _, result := range results {
+			var doc Doc
+			result.Unmarshal(&doc)
+			resultId := fmt.Sprintf("%s.%v", n, doc.Id)
+			if ops, ok := byId[resultId]; ok {
+				for _, o := range ops {
+					if u, err := options.Unmarshal(o.Namespace, result); err == nil {
+						o.processData(u)
+						ctx.growOp(o, len(result.Data))
+					} else {
+						failed[o] = err
+					}
+				}
+			}
 		}
 	}
 	for _, op := range this.Entries {
+		if err, ok := failed[op]; ok {
+			ctx.ErrC <- &FetchError{Op: op, Err: err}
+			// a held batch which keeps failing is emitted so it is not retained forever
+			if options.FetchFailure == DropFailedFetches {
+				ctx.releaseOp(op)
+				continue
+			}
+		}
 		if op.matchesFilter(options) {
-			ctx.OpC <- op
+			this.send(ctx, op, options)
+		} else {
+			ctx.releaseOp(op)
 		}
 	}
 	this.Entries = nil
+	this.held = 0
+	this.mark(ctx)
 }
 
 func UpdateIsReplace(entry map[string]interface{}) bool {
@@ -523,11 +810,20 @@ func UpdateIsReplace(entry map[string]interface{}) bool {
 		return false
 	} else if _, ok := entry["$unset"]; ok {
 		return false
+	} else if UpdateIsDiff(entry) {
+		return false
 	} else {
 		return true
 	}
 }
 
+// reports whether entry is a MongoDB 5.0+ update in the $v 2 diff format
+func UpdateIsDiff(entry map[string]interface{}) bool {
+	_, version := entry["$v"]
+	_, diff := entry["diff"]
+	return version && diff
+}
+
 func (this *Op) shouldParse() bool {
 	return this.IsInsert() || this.IsDelete() || this.IsUpdate() || this.IsCommand()
 }
@@ -577,6 +873,9 @@ func (this *Op) ParseLogEntry(entry *OpLog, options *Options) (include bool, err
 				rawField.Unmarshal(&doc)
 				this.Id = doc.Id
 				if this.IsInsert() {
+					if rawField, err = options.project(this.Namespace, rawField); err != nil {
+						return
+					}
 					if u, err = options.Unmarshal(this.Namespace, rawField); err == nil {
 						this.processData(u)
 					}
@@ -584,6 +883,17 @@ func (this *Op) ParseLogEntry(entry *OpLog, options *Options) (include bool, err
 					var changeField map[string]interface{}
 					rawField = entry.Doc
 					rawField.Unmarshal(&changeField)
+					if UpdateIsReplace(changeField) {
+						if rawField, err = options.project(this.Namespace, rawField); err != nil {
+							return
+						}
+					} else if options.UpdateDataAsDelta {
+						var changed bool
+						if rawField, changed, err = options.projectDelta(this.Namespace, rawField); err != nil || !changed {
+							// a delta which only changed projected out fields is dropped
+							return
+						}
+					}
 					if options.UpdateDataAsDelta || UpdateIsReplace(changeField) {
 						if u, err = options.Unmarshal(this.Namespace, rawField); err == nil {
 							this.processData(u)
@@ -592,13 +902,24 @@ func (this *Op) ParseLogEntry(entry *OpLog, options *Options) (include bool, err
 				}
 				include = true
 			} else if this.IsCommand() {
-				include = this.IsDrop()
+				include = this.IsDrop() || options.AllCommands
 			}
 		}
 	}
 	return
 }
 
+// the approximate size of the entry in bytes
+func (this *OpLog) size() (n int) {
+	if this.Doc != nil {
+		n += len(this.Doc.Data)
+	}
+	if this.Update != nil {
+		n += len(this.Update.Data)
+	}
+	return
+}
+
 func OpLogCollectionName(session *mgo.Session, options *Options) string {
 	localDB := session.DB(*options.OpLogDatabaseName)
 	col_names, err := localDB.CollectionNames()
@@ -636,21 +957,108 @@ func ParseTimestamp(timestamp bson.MongoTimestamp) (int32, int32) {
 	return int32(ts), int32(ordinal)
 }
 
+// returns 0 without a session, e.g. when replaying files with StartFiles
 func LastOpTimestamp(session *mgo.Session, options *Options) bson.MongoTimestamp {
+	if session == nil {
+		return 0
+	}
 	var opLog OpLog
 	collection := OpLogCollection(session, options)
 	collection.Find(nil).Sort("-$natural").One(&opLog)
 	return opLog.Timestamp
 }
 
+func (this *OpLogQueryFilter) hasOperation(op string) bool {
+	if len(this.Operations) == 0 {
+		return true
+	}
+	for _, o := range this.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *OpLogQueryFilter) hasCommand(command string) bool {
+	for _, c := range this.Commands {
+		if c == command || c == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a copy which also matches command
+func (this *OpLogQueryFilter) withCommand(command string) *OpLogQueryFilter {
+	if this.hasCommand(command) {
+		return this
+	}
+	filter := *this
+	filter.Commands = append(append([]string{}, this.Commands...), command)
+	return &filter
+}
+
+func (this *OpLogQueryFilter) commandSelectors() (sels []bson.M) {
+	if len(this.NamespaceRegexes) > 0 || this.hasCommand("*") {
+		// the dropped collection is not part of ns so a regex
+		// cannot be matched on the server. accept all commands
+		return []bson.M{{"op": "c"}}
+	}
+	for _, command := range this.Commands {
+		sels = append(sels, bson.M{"op": "c", "o." + command: bson.M{"$exists": true}})
+	}
+	dbs := make(map[string]bool)
+	for _, ns := range this.Namespaces {
+		n := &N{}
+		if err := n.parse(ns); err != nil {
+			continue
+		}
+		cmdNs := n.database + ".$cmd"
+		sels = append(sels, bson.M{"ns": cmdNs, "o.drop": n.collection})
+		if !dbs[n.database] {
+			dbs[n.database] = true
+			sels = append(sels, bson.M{"ns": cmdNs, "o.dropDatabase": bson.M{"$exists": true}})
+		}
+	}
+	return
+}
+
+func (this *OpLogQueryFilter) Selector() bson.M {
+	sel := bson.M{}
+	if len(this.Operations) > 0 {
+		sel["op"] = bson.M{"$in": this.Operations}
+	}
+	var or []bson.M
+	if len(this.Namespaces) > 0 {
+		or = append(or, bson.M{"ns": bson.M{"$in": this.Namespaces}})
+	}
+	for _, re := range this.NamespaceRegexes {
+		or = append(or, bson.M{"ns": bson.RegEx{Pattern: re}})
+	}
+	if len(or) > 0 && this.hasOperation("c") {
+		or = append(or, this.commandSelectors()...)
+	}
+	if len(or) > 0 {
+		sel["$or"] = or
+	}
+	return sel
+}
+
 func GetOpLogQuery(session *mgo.Session, after bson.MongoTimestamp, options *Options) *mgo.Query {
 	query := bson.M{"ts": bson.M{"$gt": after}, "fromMigrate": bson.M{"$exists": false}}
+	if options.OpLogQueryFilter != nil {
+		for k, v := range options.OpLogQueryFilter.Selector() {
+			query[k] = v
+		}
+	}
 	collection := OpLogCollection(session, options)
 	return collection.Find(query).LogReplay().Sort("$natural")
 }
 
 func TailOps(ctx *OpCtx, session *mgo.Session, channels []OpChan, options *Options) error {
 	defer ctx.allWg.Done()
+	defer ctx.TailWg.Done()
 	s := session.Copy()
 	defer s.Close()
 	options.Fill(s)
@@ -658,63 +1066,44 @@ func TailOps(ctx *OpCtx, session *mgo.Session, channels []OpChan, options *Optio
 	if err != nil {
 		panic(fmt.Sprintf("Invalid value <%s> for CursorTimeout", *options.CursorTimeout))
 	}
+	until := options.until()
+	if until != 0 && options.EOFDuration < duration {
+		// check for the end of a bounded replay sooner
+		duration = options.EOFDuration
+	}
 	currTimestamp := options.After(s, options)
+	retry := options.retrier(TailStage)
+	_, epoch := ctx.seek.get()
 	iter := GetOpLogQuery(s, currTimestamp, options).Tail(duration)
 	for {
 		var entry OpLog
 	Seek:
 		for iter.Next(&entry) {
-			op := &Op{
-				Id:        "",
-				Operation: "",
-				Namespace: "",
-				Data:      nil,
-				Timestamp: bson.MongoTimestamp(0),
-				Source:    OplogQuerySource,
+			retry.reset()
+			if until != 0 && CompareTimestamps(entry.Timestamp, until) > 0 {
+				iter.Close()
+				endTail(channels)
+				return nil
 			}
-			ok, err := op.ParseLogEntry(&entry, options)
-			if err == nil {
-				if ok && op.matchesFilter(options) {
-					if options.UpdateDataAsDelta {
-						ctx.OpC <- op
-					} else {
-						// broadcast to fetch channels
-						for _, channel := range channels {
-							channel <- op
-						}
-					}
-				}
-			} else {
-				ctx.ErrC <- err
+			if !ctx.emitEntry(&entry, epoch, channels, options) {
+				return nil
+			}
+			if !ctx.gate.wait(ctx.stopC) {
+				return nil
 			}
 			select {
 			case <-ctx.stopC:
 				return nil
-			case ts := <-ctx.seekC:
-				currTimestamp = ts
+			case r := <-ctx.seekC:
+				currTimestamp, epoch = r.ts, r.epoch
 				break Seek
-			case <-ctx.pauseC:
-				<-ctx.resumeC
-				select {
-				case <-ctx.stopC:
-					return nil
-				case ts := <-ctx.seekC:
-					currTimestamp = ts
-					break Seek
-				default:
-					currTimestamp = op.Timestamp
-				}
 			default:
-				currTimestamp = op.Timestamp
+				currTimestamp = entry.Timestamp
 			}
 		}
 		if err = iter.Close(); err != nil {
 			ctx.ErrC <- errors.Wrap(err, "Error tailing oplog entries")
-			var wg sync.WaitGroup
-			wg.Add(1)
-			go ctx.waitForConnection(&wg, s, options)
-			wg.Wait()
-			if ctx.isStopped() {
+			if !ctx.waitForConnection(s, retry, ctx.stopC) {
 				return nil
 			}
 			s.Refresh()
@@ -722,19 +1111,21 @@ func TailOps(ctx *OpCtx, session *mgo.Session, channels []OpChan, options *Optio
 			continue
 		}
 		if iter.Timeout() {
+			retry.reset()
+			if until != 0 && (CompareTimestamps(currTimestamp, until) >= 0 ||
+				CompareTimestamps(LastOpTimestamp(s, options), until) >= 0) {
+				// every entry up to until has been read
+				endTail(channels)
+				return nil
+			}
+			if !ctx.gate.wait(ctx.stopC) {
+				return nil
+			}
 			select {
 			case <-ctx.stopC:
 				return nil
-			case ts := <-ctx.seekC:
-				currTimestamp = ts
-			case <-ctx.pauseC:
-				<-ctx.resumeC
-				select {
-				case ts := <-ctx.seekC:
-					currTimestamp = ts
-				default:
-					continue
-				}
+			case r := <-ctx.seekC:
+				currTimestamp, epoch = r.ts, r.epoch
 			default:
 				continue
 			}
@@ -744,6 +1135,57 @@ func TailOps(ctx *OpCtx, session *mgo.Session, channels []OpChan, options *Optio
 	return nil
 }
 
+// parses an oplog entry and sends the op on to OpC, or to the fetch channels when
+// the document must be fetched. returns false if the context stopped
+func (ctx *OpCtx) emitEntry(entry *OpLog, epoch int64, channels []OpChan, options *Options) bool {
+	op := &Op{
+		Id:        "",
+		Operation: "",
+		Namespace: "",
+		Data:      nil,
+		Timestamp: bson.MongoTimestamp(0),
+		Source:    OplogQuerySource,
+		seekEpoch: epoch,
+	}
+	ok, err := op.ParseLogEntry(entry, options)
+	if err != nil {
+		ctx.ErrC <- err
+		return true
+	}
+	ctx.readCreatedCollection(op, options)
+	if ok && op.matchesFilter(options) && !ctx.invalidated(op) {
+		size := entry.size()
+		if !ctx.admitTail(size) {
+			return false
+		}
+		if !ctx.bufferOp(op, size) {
+			return false
+		}
+		if options.UpdateDataAsDelta {
+			// sent in oplog order
+			op.Checkpoint = op.Timestamp
+			ctx.sendOp(op, options)
+		} else {
+			// broadcast to fetch channels
+			for _, channel := range channels {
+				select {
+				case channel <- op:
+				case <-ctx.stopC:
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// closes the fetch channels so that workers flush their buffers and exit
+func endTail(channels []OpChan) {
+	for _, channel := range channels {
+		close(channel)
+	}
+}
+
 func SupportsCollectionScan(session *mgo.Session) (supports bool, err error) {
 	var buildInfo *BuildInfo
 	if buildInfo, err = VersionInfo(session); err == nil {
@@ -756,36 +1198,73 @@ func SupportsCollectionScan(session *mgo.Session) (supports bool, err error) {
 	return
 }
 
-func DirectReadCollectionScan(ctx *OpCtx, session *mgo.Session, ns string, options *Options) (err error) {
+func DirectReadCollectionScan(ctx *OpCtx, session *mgo.Session, ns string, options *Options) error {
+	return directReadCollectionScan(ctx, ctx.newDirectReadRun(ctx.stopC), session, ns, options)
+}
+
+// the readers started here are part of run
+func directReadCollectionScan(ctx *OpCtx, run *directReadRun, session *mgo.Session, ns string, options *Options) (err error) {
 	defer ctx.allWg.Done()
 	defer ctx.DirectReadWg.Done()
+	// the first batches are read by the scan command so track the namespace
+	// from here. the scan ends its read only after every cursor so that the
+	// read has one end, whichever reader finishes last
+	ctx.beginDirectRead(session, run, ns)
+	var cursorWg sync.WaitGroup
+	defer func() {
+		cursorWg.Wait()
+		ctx.endDirectRead(run, ns, err)
+	}()
 	n := &N{}
 	if err = n.parse(ns); err != nil {
 		ctx.ErrC <- errors.Wrap(err, "Error parsing direct read namespace")
 		return
 	}
+	if !ctx.scanSupported(session, n, ns, options) {
+		// a parallel scan reads every document of a plain collection
+		ctx.allWg.Add(1)
+		ctx.DirectReadWg.Add(1)
+		cursorWg.Add(1)
+		go func() {
+			defer cursorWg.Done()
+			directRead(ctx, run, session, ns, options)
+		}()
+		return
+	}
 	scan := PCollectionScan{
 		Namespace:  n.collection,
 		Numcursors: options.DirectReadCursors,
 	}
 	var result PCollectionScanResult
 	s := session.Copy()
+	readTs := directReadTimestamp(s)
 	err = s.DB(n.database).Run(scan, &result)
 	if err != nil || result.Ok == 0 {
 		defer s.Close()
 		msg := fmt.Sprintf("Parallel collection scan of %s failed", ns)
 		ctx.ErrC <- errors.Wrap(err, msg)
+		// the read below reports its own outcome
+		err = nil
 		ctx.log.Println("Reverting to single-threaded collection read")
 		ctx.allWg.Add(1)
 		ctx.DirectReadWg.Add(1)
-		go DirectRead(ctx, session, ns, options)
+		cursorWg.Add(1)
+		go func() {
+			defer cursorWg.Done()
+			directRead(ctx, run, session, ns, options)
+		}()
 		return
 	}
 	if len(result.Cursors) > 1 {
 		for _, cursor := range result.Cursors {
+			cursor.Info.readTs = readTs
 			ctx.allWg.Add(1)
 			ctx.DirectReadWg.Add(1)
-			go DirectReadCursor(ctx, s, ns, options, cursor.Info)
+			cursorWg.Add(1)
+			go func(cursor CursorInfo) {
+				defer cursorWg.Done()
+				directReadCursor(ctx, run, s, ns, options, cursor)
+			}(cursor.Info)
 		}
 	} else {
 		defer s.Close()
@@ -795,47 +1274,74 @@ func DirectReadCollectionScan(ctx *OpCtx, session *mgo.Session, ns string, optio
 		ctx.log.Println("Reverting to single-threaded collection read")
 		ctx.allWg.Add(1)
 		ctx.DirectReadWg.Add(1)
-		go DirectRead(ctx, session, ns, options)
+		cursorWg.Add(1)
+		go func() {
+			defer cursorWg.Done()
+			directRead(ctx, run, session, ns, options)
+		}()
 	}
 	return
 }
 
-func DirectReadCursor(ctx *OpCtx, s *mgo.Session, ns string, options *Options, cursor CursorInfo) (err error) {
+func DirectReadCursor(ctx *OpCtx, s *mgo.Session, ns string, options *Options, cursor CursorInfo) error {
+	return directReadCursor(ctx, ctx.newDirectReadRun(ctx.stopC), s, ns, options, cursor)
+}
+
+func directReadCursor(ctx *OpCtx, run *directReadRun, s *mgo.Session, ns string, options *Options, cursor CursorInfo) (err error) {
 	defer ctx.allWg.Done()
 	defer ctx.DirectReadWg.Done()
+	stopC := run.stopC
+	ctx.beginDirectRead(s, run, ns)
+	defer func() { ctx.endDirectRead(run, ns, err) }()
 	n := &N{}
 	if err = n.parse(ns); err != nil {
 		ctx.ErrC <- errors.Wrap(err, "Error parsing direct read namespace")
 		return
 	}
 	c := s.DB(n.database).C(n.collection)
+	retry := options.retrier(DirectReadStage)
+	readTs := cursor.readTs
+	if readTs == 0 {
+		readTs = directReadTimestamp(s)
+	}
 	iter := c.NewIter(nil, cursor.Firstbatch, cursor.Id, nil)
 	for {
 		foundResults := false
 		var result = &bson.Raw{}
 		for iter.Next(result) {
 			foundResults = true
-			t := time.Now().UTC().Unix()
+			retry.reset()
 			var doc Doc
 			result.Unmarshal(&doc)
+			ctx.progress.add(run.id, len(result.Data))
 			op := &Op{
 				Id:        doc.Id,
 				Operation: "i",
 				Namespace: ns,
 				Source:    DirectQuerySource,
-				Timestamp: bson.MongoTimestamp(t << 32),
+				Timestamp: readTs,
+				Sequence:  ctx.scanSeq.advance(ns),
 			}
-			if u, err := options.Unmarshal(ns, result); err == nil {
+			// parallel scan cursors cannot be projected by the server
+			if projected, perr := options.projectDirect(ns, result); perr != nil {
+				ctx.ErrC <- perr
+			} else if u, err := options.Unmarshal(ns, projected); err == nil {
 				op.processData(u)
 				if op.matchesDirectFilter(options) {
-					ctx.OpC <- op
+					if !ctx.admitDirect(len(result.Data), stopC) || !ctx.bufferOp(op, len(result.Data)) {
+						return nil
+					}
+					ctx.sendOp(op, options)
 				}
 			} else {
 				ctx.ErrC <- err
 			}
 			result = &bson.Raw{}
+			if !ctx.gate.wait(stopC) {
+				return
+			}
 			select {
-			case <-ctx.stopC:
+			case <-stopC:
 				return
 			default:
 				continue
@@ -843,11 +1349,7 @@ func DirectReadCursor(ctx *OpCtx, s *mgo.Session, ns string, options *Options, c
 		}
 		if err = iter.Close(); err != nil {
 			ctx.ErrC <- errors.Wrap(err, "Error performing direct reads of collections")
-			var wg sync.WaitGroup
-			wg.Add(1)
-			go ctx.waitForConnection(&wg, s, options)
-			wg.Wait()
-			if ctx.isStopped() {
+			if !ctx.waitForConnection(s, retry, stopC) {
 				return
 			}
 			s.Refresh()
@@ -859,9 +1361,17 @@ func DirectReadCursor(ctx *OpCtx, s *mgo.Session, ns string, options *Options, c
 	return
 }
 
-func DirectRead(ctx *OpCtx, session *mgo.Session, ns string, options *Options) (err error) {
+func DirectRead(ctx *OpCtx, session *mgo.Session, ns string, options *Options) error {
+	return directRead(ctx, ctx.newDirectReadRun(ctx.stopC), session, ns, options)
+}
+
+// a reader of run, on its own or started by a collection scan
+func directRead(ctx *OpCtx, run *directReadRun, session *mgo.Session, ns string, options *Options) (err error) {
 	defer ctx.allWg.Done()
 	defer ctx.DirectReadWg.Done()
+	stopC := run.stopC
+	ctx.beginDirectRead(session, run, ns)
+	defer func() { ctx.endDirectRead(run, ns, err) }()
 	s := session.Copy()
 	defer s.Close()
 	n := &N{}
@@ -870,48 +1380,85 @@ func DirectRead(ctx *OpCtx, session *mgo.Session, ns string, options *Options) (
 		return
 	}
 	c := s.DB(n.database).C(n.collection)
-	var sel bson.M = nil
+	spec := options.directReadQuery(ns)
+	projection := options.directProjectionFor(ns)
+	strategy, info, err := ctx.directReadStrategy(s, n, ns)
+	if err != nil {
+		// not a failure of the read, the namespace is skipped
+		ctx.log.Printf("Skipping %s: %s", ns, err)
+		return
+	}
+	if strategy != idOrderRead {
+		ctx.log.Printf("Reading %s in %s", ns, strategy)
+	}
+	if strategy == naturalRead {
+		spec = spec.natural()
+	}
+	pos := &readPosition{}
+	retry := options.retrier(DirectReadStage)
+	snapshot := false
+	if options.DirectReadSnapshot && (strategy == idOrderRead || strategy == naturalRead) {
+		if snapshot, err = SupportsSnapshotReads(s); !snapshot {
+			ctx.log.Printf("Snapshot reads are not supported. Reading %s without a snapshot", ns)
+		}
+	}
 	for {
 		foundResults := false
-		q := c.Find(sel).Sort("_id").Hint("_id").Batch(options.DirectReadBatchSize)
-		iter := q.Iter()
+		var iter *mgo.Iter
+		readTs := directReadTimestamp(s)
+		if snapshot {
+			if iter, err = spec.snapshotIter(c, pos.lastId, pos.read, readTs, projection, options.DirectReadBatchSize); err != nil {
+				ctx.log.Printf("Unable to read %s at a snapshot. Reading without a snapshot: %s", ns, err)
+				snapshot = false
+			}
+		}
+		if iter == nil {
+			iter = spec.iter(c, strategy, info, pos, projection, options.DirectReadBatchSize)
+		}
 		var result = &bson.Raw{}
 		for iter.Next(result) {
 			foundResults = true
+			retry.reset()
 			var doc Doc
 			result.Unmarshal(&doc)
-			sel = bson.M{"_id": bson.M{"$gt": doc.Id}}
-			t := time.Now().UTC().Unix()
+			pos.advance(strategy, info, doc.Id, result)
+			ctx.progress.add(run.id, len(result.Data))
 			op := &Op{
 				Id:        doc.Id,
 				Operation: "i",
 				Namespace: ns,
 				Source:    DirectQuerySource,
-				Timestamp: bson.MongoTimestamp(t << 32),
+				Timestamp: readTs,
+				Sequence:  ctx.scanSeq.advance(ns),
 			}
 			if u, err := options.Unmarshal(ns, result); err == nil {
 				op.processData(u)
 				if op.matchesDirectFilter(options) {
-					ctx.OpC <- op
+					if !ctx.admitDirect(len(result.Data), stopC) || !ctx.bufferOp(op, len(result.Data)) {
+						return nil
+					}
+					ctx.sendOp(op, options)
 				}
 			} else {
 				ctx.ErrC <- err
 			}
 			result = &bson.Raw{}
+			if !ctx.gate.wait(stopC) {
+				return
+			}
 			select {
-			case <-ctx.stopC:
+			case <-stopC:
 				return
 			default:
 				continue
 			}
 		}
 		if err = iter.Close(); err != nil {
+			if snapshot && isSnapshotTooOld(err) {
+				continue
+			}
 			ctx.ErrC <- errors.Wrap(err, "Error performing direct reads of collections")
-			var wg sync.WaitGroup
-			wg.Add(1)
-			go ctx.waitForConnection(&wg, s, options)
-			wg.Wait()
-			if ctx.isStopped() {
+			if !ctx.waitForConnection(s, retry, stopC) {
 				return
 			}
 			s.Refresh()
@@ -925,22 +1472,43 @@ func DirectRead(ctx *OpCtx, session *mgo.Session, ns string, options *Options) (
 
 func FetchDocuments(ctx *OpCtx, session *mgo.Session, filter OpFilter, buf *OpBuf, inOp OpChan, options *Options) error {
 	defer ctx.allWg.Done()
+	defer ctx.TailWg.Done()
 	s := session.Copy()
 	defer s.Close()
 	for {
+		if !ctx.gate.wait(ctx.stopC) {
+			return nil
+		}
 		select {
 		case <-ctx.stopC:
 			return nil
 		case <-buf.FlushTicker.C:
+			buf.invalidate(ctx)
 			buf.Flush(s, ctx, options)
-		case op := <-inOp:
+		case op, open := <-inOp:
+			if !open {
+				// the end of a bounded replay
+				buf.FlushTicker.Stop()
+				buf.invalidate(ctx)
+				buf.Flush(s, ctx, options)
+				return nil
+			}
+			if ctx.invalidated(op) {
+				// read again after the seek
+				if filter(op) {
+					ctx.releaseOp(op)
+				}
+				continue
+			}
 			if filter(op) {
 				buf.Append(op)
-				if buf.IsFull() {
-					buf.Flush(s, ctx, options)
-					buf.FlushTicker.Stop()
-					buf.FlushTicker = time.NewTicker(buf.BufferDuration)
-				}
+			}
+			buf.seen(ctx, op)
+			if buf.IsFull() {
+				buf.invalidate(ctx)
+				buf.Flush(s, ctx, options)
+				buf.FlushTicker.Stop()
+				buf.FlushTicker = time.NewTicker(buf.BufferDuration)
 			}
 		}
 	}
@@ -999,8 +1567,29 @@ func DefaultOptions() *Options {
 		DirectReadFilter:    nil,
 		DirectReadBatchSize: 500,
 		DirectReadCursors:   10,
+		DirectReadDedupe:    false,
+		DirectReadSnapshot:  false,
+		DirectReadQueries:   nil,
+		DirectReadOnCreate:  false,
+		DirectReadProgress:  nil,
+		ProgressInterval:    time.Duration(10) * time.Second,
+		DirectReadEvents:    false,
 		Unmarshal:           defaultUnmarshaller,
 		Log:                 log.New(os.Stdout, "INFO ", log.Flags()),
+		AllCommands:         false,
+		OpLogQueryFilter:    nil,
+		Projections:         nil,
+		Redactions:          nil,
+		Redactor:            nil,
+		TailRateLimit:       RateLimit{},
+		DirectReadRateLimit: RateLimit{},
+		MaxBufferedBytes:    0,
+		RetryPolicy:         nil,
+		RetryOverrides:      nil,
+		FetchFailure:        EmitFailedFetches,
+		FetchHoldFlushes:    10,
+		Until:               bson.MongoTimestamp(0),
+		UntilTime:           time.Time{},
 	}
 }
 
@@ -1022,6 +1611,23 @@ func (this *Options) Fill(session *mgo.Session) {
 	}
 }
 
+// returns the end of a bounded replay or 0 to tail forever
+func (this *Options) until() bson.MongoTimestamp {
+	until := this.Until
+	if !this.UntilTime.IsZero() {
+		// entries written at or after UntilTime are left out
+		ts := beforeTimestamp(TimestampForTime(this.UntilTime))
+		if ts == 0 {
+			// zero would mean no end at all
+			ts = NewTimestamp(0, 1)
+		}
+		if until == 0 || CompareTimestamps(ts, until) < 0 {
+			until = ts
+		}
+	}
+	return until
+}
+
 func defaultUnmarshaller(namespace string, raw *bson.Raw) (interface{}, error) {
 	var m map[string]interface{}
 	if err := raw.Unmarshal(&m); err == nil {
@@ -1058,6 +1664,12 @@ func (this *Options) SetDefaults() {
 	if this.DirectReadCursors < 1 {
 		this.DirectReadCursors = defaultOpts.DirectReadCursors
 	}
+	if this.FetchHoldFlushes < 1 {
+		this.FetchHoldFlushes = defaultOpts.FetchHoldFlushes
+	}
+	if this.ProgressInterval <= 0 {
+		this.ProgressInterval = defaultOpts.ProgressInterval
+	}
 	if this.EOFDuration == 0 {
 		this.EOFDuration = defaultOpts.EOFDuration
 	}
@@ -1067,6 +1679,23 @@ func (this *Options) SetDefaults() {
 	if this.Log == nil {
 		this.Log = defaultOpts.Log
 	}
+	if this.RetryPolicy == nil {
+		this.RetryPolicy = DefaultRetryPolicy()
+	}
+	this.RetryPolicy.SetDefaults()
+	for _, policy := range this.RetryOverrides {
+		if policy != nil {
+			policy.SetDefaults()
+		}
+	}
+	if this.OpLogQueryFilter != nil {
+		// commands which the options act on must not be filtered by the server
+		if this.AllCommands {
+			this.OpLogQueryFilter = this.OpLogQueryFilter.withCommand("*")
+		} else if this.DirectReadOnCreate {
+			this.OpLogQueryFilter = this.OpLogQueryFilter.withCommand("create")
+		}
+	}
 }
 
 func Tail(session *mgo.Session, options *Options) (OpChan, chan error) {
@@ -1106,47 +1735,65 @@ func StartMulti(sessions []*mgo.Session, options *Options) *OpCtxMulti {
 	} else {
 		options.SetDefaults()
 	}
+	var contexts []*OpCtx
+	for _, session := range sessions {
+		contexts = append(contexts, Start(session, options))
+	}
+	return startMulti(contexts, options)
+}
 
+// coalesces the output of running contexts. with Until or UntilTime set OpC
+// is closed once every context has closed its own
+func startMulti(contexts []*OpCtx, options *Options) *OpCtxMulti {
 	stopC := make(chan bool, 1)
 	errC := make(chan error, options.ChannelSize)
 	opC := make(OpChan, options.ChannelSize)
 
 	var directReadWg sync.WaitGroup
+	var tailWg sync.WaitGroup
 	var allWg sync.WaitGroup
-	var seekC = make(chan bson.MongoTimestamp, 1)
-	var pauseC = make(chan bool, 1)
-	var resumeC = make(chan bool, 1)
+	var forwardWg sync.WaitGroup
 
 	ctxMulti := &OpCtxMulti{
 		lock:         &sync.Mutex{},
 		OpC:          opC,
 		ErrC:         errC,
 		DirectReadWg: &directReadWg,
+		TailWg:       &tailWg,
 		stopC:        stopC,
 		allWg:        &allWg,
-		pauseC:       pauseC,
-		resumeC:      resumeC,
-		seekC:        seekC,
+		gate:         newPauseGate(),
 		log:          options.Log,
+		bounded:      options.until() != 0,
+	}
+	if options.DirectReadEvents {
+		ctxMulti.DirectReadDoneC = make(chan *DirectReadDone, options.ChannelSize)
 	}
 
 	ctxMulti.lock.Lock()
 	defer ctxMulti.lock.Unlock()
 
-	for _, session := range sessions {
-		ctx := Start(session, options)
+	for _, ctx := range contexts {
+		ctx := ctx
 		ctxMulti.contexts = append(ctxMulti.contexts, ctx)
 		directReadWg.Add(1)
 		go func() {
 			defer directReadWg.Done()
 			ctx.DirectReadWg.Wait()
 		}()
+		tailWg.Add(1)
+		go func() {
+			defer tailWg.Done()
+			ctx.TailWg.Wait()
+		}()
 		allWg.Add(1)
 		go func() {
 			defer allWg.Done()
 			ctx.allWg.Wait()
 		}()
+		forwardWg.Add(1)
 		go func(c OpChan) {
+			defer forwardWg.Done()
 			for op := range c {
 				opC <- op
 			}
@@ -1156,16 +1803,33 @@ func StartMulti(sessions []*mgo.Session, options *Options) *OpCtxMulti {
 				errC <- err
 			}
 		}(ctx.ErrC)
+		ctxMulti.forwardDirectReadDone(ctx)
+	}
+	if ctxMulti.bounded {
+		// every child closes its OpC at the end of a bounded replay
+		go func() {
+			forwardWg.Wait()
+			close(opC)
+		}()
 	}
 	return ctxMulti
 }
 
+// the goroutine which reads oplog entries for a context
+type tailFunc func(ctx *OpCtx, session *mgo.Session, channels []OpChan, options *Options) error
+
 func Start(session *mgo.Session, options *Options) *OpCtx {
 	if options == nil {
 		options = DefaultOptions()
 	} else {
 		options.SetDefaults()
 	}
+	return start(session, options, TailOps, options.until() != 0)
+}
+
+// starts a context reading entries with tail. when bounded is true OpC is
+// closed once tail, the fetch workers and the direct reads are done
+func start(session *mgo.Session, options *Options, tail tailFunc, bounded bool) *OpCtx {
 
 	stopC := make(chan bool)
 	errC := make(chan error, options.ChannelSize)
@@ -1174,22 +1838,40 @@ func Start(session *mgo.Session, options *Options) *OpCtx {
 	var inOps []OpChan
 	var workerNames []string
 	var directReadWg sync.WaitGroup
+	var tailWg sync.WaitGroup
 	var allWg sync.WaitGroup
-	var seekC = make(chan bson.MongoTimestamp, 1)
-	var pauseC = make(chan bool, 1)
-	var resumeC = make(chan bool, 1)
+	var seekC = make(chan seekRequest, 1)
 
 	ctx := &OpCtx{
-		lock:         &sync.Mutex{},
-		OpC:          opC,
-		ErrC:         errC,
-		DirectReadWg: &directReadWg,
-		stopC:        stopC,
-		allWg:        &allWg,
-		pauseC:       pauseC,
-		resumeC:      resumeC,
-		seekC:        seekC,
-		log:          options.Log,
+		lock:           &sync.Mutex{},
+		OpC:            opC,
+		ErrC:           errC,
+		DirectReadWg:   &directReadWg,
+		TailWg:         &tailWg,
+		stopC:          stopC,
+		allWg:          &allWg,
+		seekC:          seekC,
+		seek:           &seekMark{},
+		gate:           newPauseGate(),
+		log:            options.Log,
+		tailThrottle:   newThrottle(options.TailRateLimit),
+		directThrottle: newThrottle(options.DirectReadRateLimit),
+		budget:         newMemoryBudget(options.MaxBufferedBytes),
+		stats:          &ctxStats{},
+		scanSeq:        newScanSequence(),
+		session:        session,
+		progress:       newProgressTracker(options),
+		options:        options,
+		bounded:        bounded,
+	}
+	if options.DirectReadEvents {
+		ctx.DirectReadDoneC = make(chan *DirectReadDone, options.ChannelSize)
+	}
+	if options.WorkerCount > 0 {
+		ctx.marks = newWorkerMarks(options.WorkerCount)
+	}
+	if options.DirectReadDedupe {
+		ctx.directReads = newDirectReadTracker()
 	}
 
 	for i := 1; i <= options.WorkerCount; i++ {
@@ -1198,6 +1880,7 @@ func Start(session *mgo.Session, options *Options) *OpCtx {
 
 	for i := 1; i <= options.WorkerCount; i++ {
 		allWg.Add(1)
+		tailWg.Add(1)
 		inOp := make(OpChan, options.ChannelSize)
 		inOps = append(inOps, inOp)
 		buf := &OpBuf{
@@ -1205,6 +1888,7 @@ func Start(session *mgo.Session, options *Options) *OpCtx {
 			BufferDuration: options.BufferDuration,
 			FlushTicker:    time.NewTicker(options.BufferDuration),
 		}
+		buf.worker = i - 1
 		worker := strconv.Itoa(i)
 		filter := OpFilterForOrdering(options.Ordering, workerNames, worker)
 		go FetchDocuments(ctx, session, filter, buf, inOp, options)
@@ -1212,7 +1896,15 @@ func Start(session *mgo.Session, options *Options) *OpCtx {
 
 	var scanOk bool
 	var err error
-	if len(options.DirectReadNs) > 0 {
+	directReadNs := options.DirectReadNs
+	if len(directReadNs) > 0 && session == nil {
+		ctx.ErrC <- errors.New("Direct reads require a session")
+		directReadNs = nil
+	}
+	if len(directReadNs) > 0 {
+		directReadNs, ctx.nsPatterns = ctx.resolveDirectReadNs(session, options)
+	}
+	if len(directReadNs) > 0 {
 		scanOk, err = SupportsCollectionScan(session)
 		if err != nil {
 			ctx.ErrC <- errors.Wrap(err, "Error determining collection scan support")
@@ -1222,7 +1914,7 @@ func Start(session *mgo.Session, options *Options) *OpCtx {
 		}
 	}
 
-	for _, ns := range options.DirectReadNs {
+	for _, ns := range directReadNs {
 		directReadWg.Add(1)
 		allWg.Add(1)
 		if scanOk {
@@ -1233,7 +1925,19 @@ func Start(session *mgo.Session, options *Options) *OpCtx {
 	}
 
 	allWg.Add(1)
-	go TailOps(ctx, session, inOps, options)
+	tailWg.Add(1)
+	go tail(ctx, session, inOps, options)
+
+	if bounded {
+		// close OpC once a bounded replay and the direct reads are done
+		allWg.Add(1)
+		go func() {
+			defer allWg.Done()
+			tailWg.Wait()
+			directReadWg.Wait()
+			close(opC)
+		}()
+	}
 
 	return ctx
 }
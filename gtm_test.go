@@ -0,0 +1,97 @@
+package gtm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestOpLogQueryFilterSelector(t *testing.T) {
+	allCommands := bson.M{"op": "c"}
+	tests := []struct {
+		name    string
+		filter  OpLogQueryFilter
+		options Options
+		want    bson.M
+	}{
+		{
+			name:   "empty",
+			filter: OpLogQueryFilter{},
+			want:   bson.M{},
+		},
+		{
+			name:   "operations only",
+			filter: OpLogQueryFilter{Operations: []string{"i", "u"}},
+			want:   bson.M{"op": bson.M{"$in": []string{"i", "u"}}},
+		},
+		{
+			name:   "namespaces match their drops",
+			filter: OpLogQueryFilter{Namespaces: []string{"db.a", "db.b"}},
+			want: bson.M{"$or": []bson.M{
+				{"ns": bson.M{"$in": []string{"db.a", "db.b"}}},
+				{"ns": "db.$cmd", "o.drop": "a"},
+				{"ns": "db.$cmd", "o.dropDatabase": bson.M{"$exists": true}},
+				{"ns": "db.$cmd", "o.drop": "b"},
+			}},
+		},
+		{
+			name:   "no commands without c",
+			filter: OpLogQueryFilter{Namespaces: []string{"db.a"}, Operations: []string{"i"}},
+			want: bson.M{
+				"op":  bson.M{"$in": []string{"i"}},
+				"$or": []bson.M{{"ns": bson.M{"$in": []string{"db.a"}}}},
+			},
+		},
+		{
+			name:   "regexes match every command",
+			filter: OpLogQueryFilter{NamespaceRegexes: []string{"^db\\."}},
+			want: bson.M{"$or": []bson.M{
+				{"ns": bson.RegEx{Pattern: "^db\\."}},
+				allCommands,
+			}},
+		},
+		{
+			name:    "creates for DirectReadOnCreate",
+			filter:  OpLogQueryFilter{Namespaces: []string{"db.a"}},
+			options: Options{DirectReadOnCreate: true},
+			want: bson.M{"$or": []bson.M{
+				{"ns": bson.M{"$in": []string{"db.a"}}},
+				{"op": "c", "o.create": bson.M{"$exists": true}},
+				{"ns": "db.$cmd", "o.drop": "a"},
+				{"ns": "db.$cmd", "o.dropDatabase": bson.M{"$exists": true}},
+			}},
+		},
+		{
+			name:    "every command for AllCommands",
+			filter:  OpLogQueryFilter{Namespaces: []string{"db.a"}},
+			options: Options{AllCommands: true, DirectReadOnCreate: true},
+			want: bson.M{"$or": []bson.M{
+				{"ns": bson.M{"$in": []string{"db.a"}}},
+				allCommands,
+			}},
+		},
+		{
+			name:   "named commands",
+			filter: OpLogQueryFilter{Namespaces: []string{"db.a"}, Commands: []string{"renameCollection"}},
+			want: bson.M{"$or": []bson.M{
+				{"ns": bson.M{"$in": []string{"db.a"}}},
+				{"op": "c", "o.renameCollection": bson.M{"$exists": true}},
+				{"ns": "db.$cmd", "o.drop": "a"},
+				{"ns": "db.$cmd", "o.dropDatabase": bson.M{"$exists": true}},
+			}},
+		},
+	}
+	for _, test := range tests {
+		filter := test.filter
+		options := test.options
+		options.OpLogQueryFilter = &filter
+		options.SetDefaults()
+		if got := options.OpLogQueryFilter.Selector(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if len(test.filter.Commands) != len(filter.Commands) {
+			t.Errorf("%s: SetDefaults changed the caller's filter", test.name)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package gtm
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+// documents larger than this are treated as a corrupt file
+const maxEntrySize = 64 * 1024 * 1024
+
+// reads oplog entries from a stream of concatenated BSON documents such as
+// the oplog.bson written by mongodump --oplog. gzip streams are detected
+// and decompressed
+type OpLogFileReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	gz     *gzip.Reader
+}
+
+func NewOpLogFileReader(r io.Reader) (*OpLogFileReader, error) {
+	reader := &OpLogFileReader{r: bufio.NewReader(r)}
+	if c, ok := r.(io.Closer); ok {
+		reader.closer = c
+	}
+	magic, err := reader.r.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader.r)
+		if err != nil {
+			return nil, err
+		}
+		reader.gz = gz
+		reader.r = bufio.NewReader(gz)
+	}
+	return reader, nil
+}
+
+func OpenOpLogFile(path string) (*OpLogFileReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewOpLogFileReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("Error reading oplog file %s", path))
+	}
+	return reader, nil
+}
+
+// returns the next raw BSON document or io.EOF at the end of the stream
+func (this *OpLogFileReader) NextRaw() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(this.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Truncated BSON document in oplog file")
+		}
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header[:]))
+	if size < 5 || size > maxEntrySize {
+		return nil, fmt.Errorf("Invalid BSON document size %d in oplog file", size)
+	}
+	doc := make([]byte, size)
+	copy(doc, header[:])
+	if _, err := io.ReadFull(this.r, doc[4:]); err != nil {
+		return nil, errors.New("Truncated BSON document in oplog file")
+	}
+	return doc, nil
+}
+
+// reads the next entry or returns io.EOF at the end of the stream
+func (this *OpLogFileReader) Next(entry *OpLog) error {
+	doc, err := this.NextRaw()
+	if err != nil {
+		return err
+	}
+	*entry = OpLog{}
+	return bson.Unmarshal(doc, entry)
+}
+
+func (this *OpLogFileReader) Close() (err error) {
+	if this.gz != nil {
+		err = this.gz.Close()
+	}
+	if this.closer != nil {
+		if cerr := this.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// replays oplog entries from BSON files, in the order given, through the
+// normal OpCtx api. filters, projections and redactions apply as usual.
+// without a session updates carry the oplog delta as with UpdateDataAsDelta.
+// with a session and UpdateDataAsDelta false the current version of updated
+// documents is fetched from that session. Options.After and Until bound the
+// replay. without a session the generators of this package work from the
+// files alone, e.g. StartOfOpLog replays every file and AfterCheckpoint
+// without a checkpoint starts at the first entry. a generator of your own
+// is called with a nil session. OpC is closed at the end
+func StartFiles(session *mgo.Session, paths []string, options *Options) *OpCtx {
+	if options == nil {
+		options = DefaultOptions()
+	} else {
+		// a copy so that forcing UpdateDataAsDelta leaves the caller's options alone
+		copied := *options
+		options = &copied
+	}
+	if session == nil {
+		options.UpdateDataAsDelta = true
+	}
+	options.SetDefaults()
+	return start(session, options, tailFiles(paths, false), true)
+}
+
+// like StartFiles but once the files are done tailing continues in the live
+// oplog after the last entry read from the files. a seek after the hand
+// over only applies to the live oplog
+func StartFromFiles(session *mgo.Session, paths []string, options *Options) *OpCtx {
+	if options == nil {
+		options = DefaultOptions()
+	} else {
+		// a copy as for StartFiles
+		copied := *options
+		options = &copied
+	}
+	options.SetDefaults()
+	return start(session, options, tailFiles(paths, true), options.until() != 0)
+}
+
+// calls Options.After with the oplog names filled in, as TailOps would.
+// options is left alone since Fill defaults After to the end of the oplog
+func afterFiles(session *mgo.Session, options *Options) bson.MongoTimestamp {
+	if session == nil {
+		return options.After(nil, options)
+	}
+	s := session.Copy()
+	defer s.Close()
+	filled := *options
+	filled.Fill(s)
+	return options.After(s, &filled)
+}
+
+type fileReplay struct {
+	paths        []string
+	after        bson.MongoTimestamp
+	epoch        int64
+	reachedUntil bool
+	failed       bool
+}
+
+func tailFiles(paths []string, live bool) tailFunc {
+	return func(ctx *OpCtx, session *mgo.Session, channels []OpChan, options *Options) error {
+		replay := &fileReplay{paths: paths}
+		if options.After != nil {
+			replay.after = afterFiles(session, options)
+		}
+		_, replay.epoch = ctx.seek.get()
+		if !replay.run(ctx, channels, options) {
+			ctx.TailWg.Done()
+			ctx.allWg.Done()
+			return nil
+		}
+		if !live || replay.reachedUntil || replay.failed {
+			endTail(channels)
+			ctx.TailWg.Done()
+			ctx.allWg.Done()
+			return nil
+		}
+		s := session.Copy()
+		options.Fill(s)
+		if first := FirstOpTimestamp(s, options); CompareTimestamps(first, replay.after+1) > 0 {
+			ctx.ErrC <- fmt.Errorf("The oplog starts at %s after the end of the files at %s. Ops in between are missing",
+				TimestampTime(first), TimestampTime(replay.after))
+		}
+		s.Close()
+		handover := *options
+		handover.After = AfterTimestamp(replay.after)
+		return TailOps(ctx, session, channels, &handover)
+	}
+}
+
+// sends the entries of the files after this.after, restarting from the first
+// file after a seek. returns false if the context stopped. a file which cannot
+// be opened or read ends the replay with an error rather than skipping entries
+func (this *fileReplay) run(ctx *OpCtx, channels []OpChan, options *Options) bool {
+	until := options.until()
+Restart:
+	for {
+		for _, path := range this.paths {
+			reader, err := OpenOpLogFile(path)
+			if err != nil {
+				ctx.ErrC <- errors.Wrap(err, "Error opening oplog file. Replay stopped")
+				this.failed = true
+				return true
+			}
+			for {
+				var entry OpLog
+				if err = reader.Next(&entry); err != nil {
+					if err != io.EOF {
+						reader.Close()
+						ctx.ErrC <- errors.Wrap(err, fmt.Sprintf("Error reading oplog file %s. Replay stopped", path))
+						this.failed = true
+						return true
+					}
+					break
+				}
+				if CompareTimestamps(entry.Timestamp, this.after) <= 0 {
+					continue
+				}
+				if until != 0 && CompareTimestamps(entry.Timestamp, until) > 0 {
+					reader.Close()
+					this.reachedUntil = true
+					return true
+				}
+				if !ctx.emitEntry(&entry, this.epoch, channels, options) || !ctx.gate.wait(ctx.stopC) {
+					reader.Close()
+					return false
+				}
+				this.after = entry.Timestamp
+				select {
+				case <-ctx.stopC:
+					reader.Close()
+					return false
+				case r := <-ctx.seekC:
+					reader.Close()
+					this.after, this.epoch = r.ts, r.epoch
+					continue Restart
+				default:
+				}
+			}
+			reader.Close()
+		}
+		return true
+	}
+}
@@ -0,0 +1,233 @@
+package gtm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func writeOpLogFile(t *testing.T, path string, ids ...int) {
+	var data []byte
+	for _, id := range ids {
+		doc, err := bson.Marshal(bson.M{
+			"ts": bson.MongoTimestamp(int64(id) << 32),
+			"op": "i",
+			"ns": "db.c",
+			"o":  bson.M{"_id": id},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, doc...)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gtm-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second := filepath.Join(dir, "1.bson"), filepath.Join(dir, "2.bson")
+	writeOpLogFile(t, first, 1, 2)
+	writeOpLogFile(t, second, 3)
+	corrupt := filepath.Join(dir, "corrupt.bson")
+	if err := ioutil.WriteFile(corrupt, []byte{0xff, 0xff, 0xff, 0x7f, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		paths []string
+		ids   []interface{}
+		err   bool
+	}{
+		{name: "all files", paths: []string{first, second}, ids: []interface{}{1, 2, 3}},
+		{name: "missing file", paths: []string{first, filepath.Join(dir, "missing.bson"), second}, ids: []interface{}{1, 2}, err: true},
+		{name: "corrupt file", paths: []string{first, corrupt, second}, ids: []interface{}{1, 2}, err: true},
+	}
+	for _, test := range tests {
+		options := &Options{ChannelSize: 10, Log: DefaultOptions().Log}
+		ctx := StartFiles(nil, test.paths, options)
+		if options.UpdateDataAsDelta {
+			t.Errorf("%s: the caller's options were changed", test.name)
+		}
+		var ids []interface{}
+		errs := 0
+		timeout := time.After(5 * time.Second)
+	Read:
+		for {
+			select {
+			case op, open := <-ctx.OpC:
+				if !open {
+					break Read
+				}
+				ids = append(ids, op.Id)
+			case <-ctx.ErrC:
+				errs++
+			case <-timeout:
+				t.Fatalf("%s: OpC was not closed", test.name)
+			}
+		}
+		// errors are sent before the replay closes OpC
+	Drain:
+		for {
+			select {
+			case <-ctx.ErrC:
+				errs++
+			default:
+				break Drain
+			}
+		}
+		ctx.Stop()
+		if len(ids) != len(test.ids) {
+			t.Errorf("%s: got ops %v, want %v", test.name, ids, test.ids)
+		} else {
+			for i := range ids {
+				if ids[i] != test.ids[i] {
+					t.Errorf("%s: got ops %v, want %v", test.name, ids, test.ids)
+					break
+				}
+			}
+		}
+		if (errs > 0) != test.err {
+			t.Errorf("%s: %d errors", test.name, errs)
+		}
+	}
+}
+
+// reads OpC until it is closed and returns the ids of the ops
+func readUntilClosed(t *testing.T, opC OpChan) []interface{} {
+	var ids []interface{}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case op, open := <-opC:
+			if !open {
+				return ids
+			}
+			ids = append(ids, op.Id)
+		case <-timeout:
+			t.Fatalf("OpC was not closed")
+		}
+	}
+}
+
+func TestBoundedReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gtm-bounded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second := filepath.Join(dir, "1.bson"), filepath.Join(dir, "2.bson")
+	writeOpLogFile(t, first, 1, 2, 3, 4)
+	writeOpLogFile(t, second, 3, 5, 6)
+	tests := []struct {
+		name    string
+		options Options
+		want    int
+	}{
+		{name: "until", options: Options{Until: bson.MongoTimestamp(2 << 32)}, want: 2},
+		{name: "until time", options: Options{UntilTime: time.Unix(3, 0)}, want: 2},
+		{name: "earlier of both", options: Options{Until: bson.MongoTimestamp(3 << 32), UntilTime: time.Unix(2, 0)}, want: 1},
+		{name: "past the end", options: Options{Until: bson.MongoTimestamp(9 << 32)}, want: 4},
+	}
+	for _, test := range tests {
+		options := test.options
+		options.ChannelSize = 10
+		options.Log = DefaultOptions().Log
+		ctx := StartFiles(nil, []string{first}, &options)
+		if ids := readUntilClosed(t, ctx.OpC); len(ids) != test.want {
+			t.Errorf("%s: got ops %v, want %d", test.name, ids, test.want)
+		}
+		ctx.Stop()
+
+		// each shard closes its OpC at its own end point
+		options.Until, options.UntilTime = test.options.Until, test.options.UntilTime
+		options.SetDefaults()
+		multi := startMulti([]*OpCtx{
+			StartFiles(nil, []string{first}, &options),
+			StartFiles(nil, []string{second}, &options),
+		}, &options)
+		ids := readUntilClosed(t, multi.OpC)
+		want := 0
+		for _, id := range []int{1, 2, 3, 4, 3, 5, 6} {
+			if CompareTimestamps(bson.MongoTimestamp(int64(id)<<32), options.until()) <= 0 {
+				want++
+			}
+		}
+		if len(ids) != want {
+			t.Errorf("%s: got %v from the multi context, want %d ops", test.name, ids, want)
+		}
+		// new shards cannot join a bounded replay
+		multi.AddShardListener(nil, nil, nil)
+		select {
+		case err := <-multi.ErrC:
+			if err != ErrBounded {
+				t.Errorf("%s: got %v adding a shard listener, want ErrBounded", test.name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected ErrBounded adding a shard listener", test.name)
+		}
+		multi.Stop()
+	}
+}
+
+type stubCheckpoint bson.MongoTimestamp
+
+func (this stubCheckpoint) Load() (bson.MongoTimestamp, error) {
+	return bson.MongoTimestamp(this), nil
+}
+
+func TestStartFilesAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gtm-after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "1.bson")
+	writeOpLogFile(t, path, 1, 2, 3, 4)
+	tests := []struct {
+		name  string
+		after TimestampGenerator
+		want  int
+	}{
+		{"start of oplog", StartOfOpLog, 4},
+		{"last op", LastOpTimestamp, 4},
+		{"timestamp", AfterTimestamp(bson.MongoTimestamp(1 << 32)), 3},
+		{"time", AfterTime(time.Unix(3, 0)), 2},
+		{"duration", AfterDuration(time.Since(time.Unix(2, 0))), 3},
+		{"no checkpoint", AfterCheckpoint(stubCheckpoint(0)), 4},
+		{"checkpoint", AfterCheckpoint(stubCheckpoint(3 << 32)), 1},
+	}
+	for _, test := range tests {
+		options := &Options{ChannelSize: 10, Log: DefaultOptions().Log, After: test.after}
+		ctx := StartFiles(nil, []string{path}, options)
+		if ids := readUntilClosed(t, ctx.OpC); len(ids) != test.want {
+			t.Errorf("%s: got ops %v, want %d", test.name, ids, test.want)
+		}
+		ctx.Stop()
+	}
+}
+
+func TestStartFromFilesCopiesOptions(t *testing.T) {
+	// without fetch workers no session is needed until the hand over
+	options := &Options{Log: DefaultOptions().Log, UpdateDataAsDelta: true}
+	// a missing file ends the replay before the hand over to the live oplog
+	ctx := StartFromFiles(nil, []string{filepath.Join(os.TempDir(), "gtm-missing.bson")}, options)
+	select {
+	case <-ctx.ErrC:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an error for the missing file")
+	}
+	ctx.Stop()
+	if options.ChannelSize != 0 || options.RetryPolicy != nil {
+		t.Errorf("StartFromFiles changed the caller's options")
+	}
+}
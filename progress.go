@@ -0,0 +1,260 @@
+package gtm
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far the direct read of a namespace has come. the estimates come from
+// collStats when the read starts and are zero when unknown, e.g. for views.
+// they cover the whole collection so a DirectReadQuery finishes early. ETA
+// is zero when unknown
+type DirectReadProgress struct {
+	Namespace      string
+	EstimatedDocs  int64
+	EstimatedBytes int64
+	Docs           int64
+	Bytes          int64
+	Started        time.Time
+	Elapsed        time.Duration
+	ETA            time.Duration
+	Done           bool
+}
+
+// called from the reading goroutine so it should return quickly
+type DirectReadProgressHandler func(*DirectReadProgress)
+
+// sent on DirectReadDoneC when a direct read of a namespace, with every
+// reader started for it such as the cursors of a parallel scan, has finished. Docs
+// counts the documents read before DirectReadFilter. Err is the error which
+// ended the read early, ErrStopped when the context was stopped, or nil
+type DirectReadDone struct {
+	Namespace string
+	Docs      int64
+	Duration  time.Duration
+	Err       error
+}
+
+// progress is kept per direct read so that concurrent reads of a namespace,
+// e.g. of a new collection and a resync of it, each end with their own
+// DirectReadDone. the readers started for one read share its entry
+type progressTracker struct {
+	lock     sync.Mutex
+	interval time.Duration
+	handler  DirectReadProgressHandler
+	lastId   int64
+	reads    map[int64]*nsProgress
+	order    []int64
+}
+
+type nsProgress struct {
+	progress DirectReadProgress
+	readers  int
+	reported time.Time
+	err      error
+}
+
+func newProgressTracker(options *Options) *progressTracker {
+	return &progressTracker{
+		interval: options.ProgressInterval,
+		handler:  options.DirectReadProgress,
+		reads:    make(map[int64]*nsProgress),
+	}
+}
+
+// the document count and size of a collection from collStats
+func estimateCollection(session *mgo.Session, ns string) (docs int64, bytes int64) {
+	parts := strings.SplitN(ns, ".", 2)
+	if session == nil || len(parts) != 2 {
+		return
+	}
+	s := session.Copy()
+	defer s.Close()
+	var stats struct {
+		Count int64 `bson:"count"`
+		Size  int64 `bson:"size"`
+	}
+	if err := s.DB(parts[0]).Run(bson.D{{Name: "collStats", Value: parts[1]}}, &stats); err == nil {
+		docs, bytes = stats.Count, stats.Size
+	}
+	return
+}
+
+func (this *DirectReadProgress) update(now time.Time) {
+	this.Elapsed = now.Sub(this.Started)
+	this.ETA = 0
+	if this.Done || this.Docs == 0 || this.EstimatedDocs <= this.Docs {
+		return
+	}
+	perDoc := float64(this.Elapsed) / float64(this.Docs)
+	this.ETA = time.Duration(perDoc * float64(this.EstimatedDocs-this.Docs))
+}
+
+// returns the id of a new direct read
+func (this *progressTracker) newRead() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.lastId++
+	return this.lastId
+}
+
+// begins a reader of the read id. the first reader starts the read
+func (this *progressTracker) begin(session *mgo.Session, id int64, ns string) {
+	this.lock.Lock()
+	if p, ok := this.reads[id]; ok {
+		p.readers++
+		this.lock.Unlock()
+		return
+	}
+	this.lock.Unlock()
+	docs, bytes := estimateCollection(session, ns)
+	now := time.Now()
+	this.lock.Lock()
+	if p, ok := this.reads[id]; ok {
+		p.readers++
+		this.lock.Unlock()
+		return
+	}
+	this.forget(ns)
+	p := &nsProgress{
+		progress: DirectReadProgress{
+			Namespace:      ns,
+			EstimatedDocs:  docs,
+			EstimatedBytes: bytes,
+			Started:        now,
+		},
+		readers:  1,
+		reported: now,
+	}
+	this.reads[id] = p
+	this.order = append(this.order, id)
+	report := p.progress
+	this.lock.Unlock()
+	this.report(&report)
+}
+
+// drops the finished reads of ns so that reading a namespace again replaces
+// its progress rather than adding to it. called with the lock held
+func (this *progressTracker) forget(ns string) {
+	order := this.order[:0]
+	for _, id := range this.order {
+		if p := this.reads[id]; p.progress.Namespace == ns && p.readers == 0 {
+			delete(this.reads, id)
+			continue
+		}
+		order = append(order, id)
+	}
+	this.order = order
+}
+
+// counts a document read and reports progress every interval
+func (this *progressTracker) add(id int64, size int) {
+	now := time.Now()
+	this.lock.Lock()
+	p, ok := this.reads[id]
+	if !ok {
+		this.lock.Unlock()
+		return
+	}
+	p.progress.Docs++
+	p.progress.Bytes += int64(size)
+	if now.Sub(p.reported) < this.interval {
+		this.lock.Unlock()
+		return
+	}
+	p.reported = now
+	p.progress.update(now)
+	report := p.progress
+	this.lock.Unlock()
+	this.report(&report)
+}
+
+// ends one reader of the read id. returns the outcome once the last reader
+// is done
+func (this *progressTracker) end(id int64, err error) *DirectReadDone {
+	this.lock.Lock()
+	p, ok := this.reads[id]
+	if !ok || p.readers == 0 {
+		this.lock.Unlock()
+		return nil
+	}
+	if p.err == nil {
+		p.err = err
+	}
+	if p.readers--; p.readers > 0 {
+		this.lock.Unlock()
+		return nil
+	}
+	p.progress.Done = true
+	p.progress.update(time.Now())
+	report := p.progress
+	done := &DirectReadDone{
+		Namespace: report.Namespace,
+		Docs:      report.Docs,
+		Duration:  report.Elapsed,
+		Err:       p.err,
+	}
+	this.lock.Unlock()
+	this.report(&report)
+	return done
+}
+
+func (this *progressTracker) report(progress *DirectReadProgress) {
+	if this.handler != nil {
+		this.handler(progress)
+	}
+}
+
+func (this *progressTracker) snapshot() []DirectReadProgress {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := time.Now()
+	var all []DirectReadProgress
+	for _, id := range this.order {
+		p := this.reads[id].progress
+		if !p.Done {
+			p.update(now)
+		}
+		all = append(all, p)
+	}
+	return all
+}
+
+// returns the progress of every direct read so far, in the order the reads
+// started. a namespace read again shows only its latest read once the
+// earlier one is done
+func (ctx *OpCtx) DirectReadProgress() []DirectReadProgress {
+	return ctx.progress.snapshot()
+}
+
+// the longest ETA of the running direct reads. zero when none is running or
+// none can be estimated
+func (ctx *OpCtx) DirectReadETA() time.Duration {
+	return directReadETA(ctx.DirectReadProgress())
+}
+
+func (ctx *OpCtxMulti) DirectReadProgress() []DirectReadProgress {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	var all []DirectReadProgress
+	for _, child := range ctx.contexts {
+		all = append(all, child.DirectReadProgress()...)
+	}
+	return all
+}
+
+func (ctx *OpCtxMulti) DirectReadETA() time.Duration {
+	return directReadETA(ctx.DirectReadProgress())
+}
+
+func directReadETA(all []DirectReadProgress) (eta time.Duration) {
+	for _, p := range all {
+		if !p.Done && p.ETA > eta {
+			eta = p.ETA
+		}
+	}
+	return
+}
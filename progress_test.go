@@ -0,0 +1,155 @@
+package gtm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNamespaceResolution(t *testing.T) {
+	tests := []struct {
+		entry    string
+		pattern  bool
+		database string
+		matches  []string
+		misses   []string
+	}{
+		{entry: "db.c"},
+		{entry: "db.*", pattern: true, database: "db", matches: []string{"db.c", "db.c.d"}, misses: []string{"other.c", "dbx.c"}},
+		{entry: "db.order?", pattern: true, database: "db", matches: []string{"db.orders"}, misses: []string{"db.order", "db.orders2"}},
+		{entry: "*.users", pattern: true, matches: []string{"a.users", "b.users"}, misses: []string{"a.users2"}},
+		{entry: "/^db\\.(a|b)$/", pattern: true, matches: []string{"db.a", "db.b"}, misses: []string{"db.c"}},
+	}
+	for _, test := range tests {
+		pattern, err := parseNsPattern(test.entry)
+		if err != nil {
+			t.Errorf("%s: %s", test.entry, err)
+			continue
+		}
+		if (pattern != nil) != test.pattern {
+			t.Errorf("%s: got pattern %v, want %v", test.entry, pattern != nil, test.pattern)
+			continue
+		}
+		if pattern == nil {
+			continue
+		}
+		if pattern.database != test.database {
+			t.Errorf("%s: got database %q, want %q", test.entry, pattern.database, test.database)
+		}
+		for _, ns := range test.matches {
+			if !pattern.re.MatchString(ns) {
+				t.Errorf("%s: expected %s to match", test.entry, ns)
+			}
+		}
+		for _, ns := range test.misses {
+			if pattern.re.MatchString(ns) {
+				t.Errorf("%s: expected %s not to match", test.entry, ns)
+			}
+		}
+	}
+	if _, err := parseNsPattern("/(/"); err == nil {
+		t.Errorf("expected an invalid regex to be an error")
+	}
+	// exact namespaces are read as given without listing collections
+	ctx := &OpCtx{ErrC: make(chan error, 1)}
+	names, patterns := ctx.resolveDirectReadNs(nil, &Options{DirectReadNs: []string{"db.a", "db.b", "db.a", "/(/"}})
+	if !reflect.DeepEqual(names, []string{"db.a", "db.b"}) || len(patterns) != 0 {
+		t.Errorf("got %v and %d patterns, want db.a and db.b", names, len(patterns))
+	}
+	if len(ctx.ErrC) != 1 {
+		t.Errorf("expected the invalid pattern on ErrC")
+	}
+	if !isSystemNamespace("local", "oplog.rs") || !isSystemNamespace("db", "system.views") || isSystemNamespace("db", "c") {
+		t.Errorf("unexpected system namespaces")
+	}
+}
+
+func TestStrategySelection(t *testing.T) {
+	capped := &CollectionInfo{Type: "collection", Options: map[string]interface{}{"capped": true}}
+	tests := []struct {
+		info     *CollectionInfo
+		strategy readStrategy
+		name     string
+	}{
+		{nil, idOrderRead, "_id order"},
+		{capped, naturalRead, "natural order"},
+		{&CollectionInfo{Type: "view"}, viewRead, "view aggregation"},
+	}
+	for _, test := range tests {
+		strategy, _ := test.info.readStrategy("db.c")
+		if strategy != test.strategy || strategy.String() != test.name {
+			t.Errorf("got %s, want %s", strategy, test.name)
+		}
+	}
+}
+
+// the cursors of a parallel scan are readers of the scan's read
+func TestProgressReaders(t *testing.T) {
+	var reports []DirectReadProgress
+	tracker := newProgressTracker(&Options{
+		DirectReadProgress: func(p *DirectReadProgress) {
+			reports = append(reports, *p)
+		},
+	})
+	id := tracker.newRead()
+	tracker.begin(nil, id, "db.c")
+	tracker.begin(nil, id, "db.c")
+	tracker.begin(nil, id, "db.c")
+	if len(reports) != 1 || reports[0].Done {
+		t.Fatalf("got %d reports, want one for the start", len(reports))
+	}
+	tracker.add(id, 10)
+	tracker.add(id, 20)
+	failed := errors.New("cursor failed")
+	if done := tracker.end(id, failed); done != nil {
+		t.Errorf("expected no outcome while readers remain")
+	}
+	if done := tracker.end(id, nil); done != nil {
+		t.Errorf("expected no outcome while readers remain")
+	}
+	done := tracker.end(id, nil)
+	if done == nil {
+		t.Fatalf("expected the last reader to end the read")
+	}
+	if done.Namespace != "db.c" || done.Docs != 2 || done.Err != failed {
+		t.Errorf("got %+v, want 2 docs of db.c ended by the cursor error", *done)
+	}
+	if last := reports[len(reports)-1]; !last.Done || last.Bytes != 30 {
+		t.Errorf("got final report %+v, want done with 30 bytes", last)
+	}
+	if tracker.end(id, nil) != nil || tracker.end(tracker.newRead(), nil) != nil {
+		t.Errorf("expected no outcome for reads which are not running")
+	}
+	// a read again of the namespace replaces the finished one
+	again := tracker.newRead()
+	tracker.begin(nil, again, "db.c")
+	other := tracker.newRead()
+	tracker.begin(nil, other, "db.d")
+	all := tracker.snapshot()
+	if len(all) != 2 || all[0].Namespace != "db.c" || all[0].Done || all[1].Namespace != "db.d" {
+		t.Errorf("got %+v, want the running reads of db.c and db.d", all)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	started := time.Unix(1500000000, 0)
+	p := DirectReadProgress{EstimatedDocs: 100, Docs: 25, Started: started}
+	p.update(started.Add(10 * time.Second))
+	if p.Elapsed != 10*time.Second || p.ETA != 30*time.Second {
+		t.Errorf("got elapsed %s and ETA %s, want 10s and 30s", p.Elapsed, p.ETA)
+	}
+	p.Docs = 150
+	p.update(started.Add(20 * time.Second))
+	if p.ETA != 0 {
+		t.Errorf("got ETA %s past the estimate, want 0", p.ETA)
+	}
+	all := []DirectReadProgress{
+		{ETA: time.Minute},
+		{ETA: time.Hour, Done: true},
+		{ETA: 2 * time.Minute},
+	}
+	if eta := directReadETA(all); eta != 2*time.Minute {
+		t.Errorf("got ETA %s, want the longest running 2m", eta)
+	}
+}
@@ -0,0 +1,489 @@
+package gtm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/globalsign/mgo/bson"
+	"hash"
+	"strings"
+)
+
+// a projection must either include or exclude fields. only _id may differ
+var ErrMixedProjection = errors.New("projection mixes included and excluded fields")
+
+// the value written in place of masked fields
+const RedactedMask = "*****"
+
+// fields of a namespace to redact before ops reach OpC
+type RedactSpec struct {
+	Namespace string   // empty matches every namespace
+	Fields    []string // dotted paths into op.Data
+	Hash      bool     // replace values with a sha256 digest instead of RedactedMask
+	HashKey   []byte   // when set the digest is an HMAC keyed with HashKey
+	Remove    bool     // remove the fields entirely
+}
+
+type Redactor func(op *Op)
+
+type projection struct {
+	include  bool
+	children map[string]*projection
+}
+
+func isProjectionInclude(v interface{}) bool {
+	switch n := v.(type) {
+	case bool:
+		return n
+	case int:
+		return n != 0
+	case int32:
+		return n != 0
+	case int64:
+		return n != 0
+	case float64:
+		return n != 0
+	default:
+		return v != nil
+	}
+}
+
+func newProjection(spec bson.M) (*projection, error) {
+	root := &projection{children: make(map[string]*projection)}
+	for field, v := range spec {
+		if field == "_id" {
+			continue
+		}
+		include := isProjectionInclude(v)
+		if len(root.children) > 0 && include != root.include {
+			return nil, ErrMixedProjection
+		}
+		root.include = include
+		node := root
+		for _, part := range strings.Split(field, ".") {
+			child, ok := node.children[part]
+			if !ok {
+				child = &projection{children: make(map[string]*projection)}
+				node.children[part] = child
+			}
+			node = child
+		}
+	}
+	return root, nil
+}
+
+func (this *projection) applyValue(v interface{}, include bool) (interface{}, bool) {
+	switch t := v.(type) {
+	case bson.D:
+		return this.apply(t, include), true
+	case []interface{}:
+		out := make([]interface{}, 0, len(t))
+		for _, elem := range t {
+			if d, ok := elem.(bson.D); ok {
+				out = append(out, this.apply(d, include))
+			} else if !include {
+				out = append(out, elem)
+			}
+		}
+		return out, true
+	default:
+		// an inclusion of a sub field drops scalars
+		return v, !include
+	}
+}
+
+func (this *projection) apply(doc bson.D, include bool) bson.D {
+	var out bson.D
+	for _, elem := range doc {
+		node, ok := this.children[elem.Name]
+		if !ok {
+			if !include {
+				out = append(out, elem)
+			}
+			continue
+		}
+		if len(node.children) == 0 {
+			if include {
+				out = append(out, elem)
+			}
+			continue
+		}
+		if v, keep := node.applyValue(elem.Value, include); keep {
+			out = append(out, bson.DocElem{Name: elem.Name, Value: v})
+		}
+	}
+	return out
+}
+
+// applies a find style projection to a raw document on the client. used where the
+// server cannot project, e.g. parallelCollectionScan cursors and oplog entries.
+// _id is always kept since gtm needs it to track documents
+func projectRaw(raw *bson.Raw, spec bson.M) (*bson.Raw, error) {
+	var doc bson.D
+	if err := raw.Unmarshal(&doc); err != nil {
+		return nil, err
+	}
+	p, err := newProjection(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.children) == 0 {
+		return raw, nil
+	}
+	projected := p.apply(doc, p.include)
+	if p.include {
+		for _, elem := range doc {
+			if elem.Name == "_id" {
+				projected = append(bson.D{elem}, projected...)
+				break
+			}
+		}
+	}
+	data, err := bson.Marshal(projected)
+	if err != nil {
+		return nil, err
+	}
+	return &bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// returns the projection for a namespace for use with Query.Select. an
+// exclusion of _id is dropped since gtm needs it to track documents
+func (this *Options) projectionFor(ns string) bson.M {
+	return serverProjection(this.Projections[ns])
+}
+
+func serverProjection(spec bson.M) bson.M {
+	if len(spec) == 0 {
+		return nil
+	}
+	if id, ok := spec["_id"]; ok && !isProjectionInclude(id) {
+		sel := bson.M{}
+		for k, v := range spec {
+			if k != "_id" {
+				sel[k] = v
+			}
+		}
+		return sel
+	}
+	return spec
+}
+
+func (this *Options) project(ns string, raw *bson.Raw) (*bson.Raw, error) {
+	if spec := this.projectionFor(ns); spec != nil {
+		return projectRaw(raw, spec)
+	}
+	return raw, nil
+}
+
+// applies the projection for ns to an update delta. reports false when
+// every change in the delta was projected out
+func (this *Options) projectDelta(ns string, raw *bson.Raw) (*bson.Raw, bool, error) {
+	if spec := this.projectionFor(ns); spec != nil {
+		return projectDeltaRaw(raw, spec)
+	}
+	return raw, true, nil
+}
+
+// projects the fields changed by an update delta: the keys of $set and
+// $unset, which may be dotted paths, and the fields of a $v 2 diff
+func projectDeltaRaw(raw *bson.Raw, spec bson.M) (*bson.Raw, bool, error) {
+	var delta bson.D
+	if err := raw.Unmarshal(&delta); err != nil {
+		return nil, false, err
+	}
+	p, err := newProjection(spec)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(p.children) == 0 {
+		return raw, true, nil
+	}
+	var out bson.D
+	changed := false
+	for _, elem := range delta {
+		switch elem.Name {
+		case "$set", "$unset":
+			fields, ok := elem.Value.(bson.D)
+			if !ok {
+				break
+			}
+			if fields = p.projectFields(nil, fields, p.include, elem.Name == "$unset"); len(fields) == 0 {
+				continue
+			}
+			elem.Value = fields
+			changed = true
+		case "diff":
+			diff, ok := elem.Value.(bson.D)
+			if !ok {
+				break
+			}
+			var kept bool
+			elem.Value, kept = p.projectDiff(nil, diff, p.include)
+			changed = changed || kept
+		}
+		out = append(out, elem)
+	}
+	data, err := bson.Marshal(out)
+	if err != nil {
+		return nil, false, err
+	}
+	return &bson.Raw{Kind: 0x03, Data: data}, changed, nil
+}
+
+func isArrayIndex(part string) bool {
+	if part == "" {
+		return false
+	}
+	for _, r := range part {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// decides whether the field at path survives the projection. sub is set
+// when only some fields below path are projected. array indexes in the
+// path match the projection of the array itself
+func (this *projection) lookup(path []string, include bool) (keep bool, sub *projection) {
+	node := this
+	for _, part := range path {
+		child, ok := node.children[part]
+		if !ok {
+			if isArrayIndex(part) {
+				continue
+			}
+			return !include, nil
+		}
+		if len(child.children) == 0 {
+			return include, nil
+		}
+		node = child
+	}
+	return true, node
+}
+
+func (this *projection) projectFields(path []string, fields bson.D, include bool, removed bool) bson.D {
+	var out bson.D
+	for _, elem := range fields {
+		keep, sub := this.lookup(joinPath(path, strings.Split(elem.Name, ".")...), include)
+		if !keep {
+			continue
+		}
+		if sub != nil && !removed {
+			v, ok := sub.applyValue(elem.Value, include)
+			if !ok {
+				continue
+			}
+			elem.Value = v
+		}
+		out = append(out, elem)
+	}
+	return out
+}
+
+// projects a $v 2 diff. u, i and d hold changed fields at path, s<field>
+// holds a nested diff and in array diffs u<index> replaces an element
+func (this *projection) projectDiff(path []string, diff bson.D, include bool) (bson.D, bool) {
+	isArray := false
+	for _, elem := range diff {
+		if elem.Name == "a" {
+			isArray, _ = elem.Value.(bool)
+		}
+	}
+	var out bson.D
+	changed := false
+	for _, elem := range diff {
+		switch {
+		case elem.Name == "a":
+		case isArray && elem.Name == "l":
+			changed = true
+		case !isArray && (elem.Name == "u" || elem.Name == "i" || elem.Name == "d"):
+			fields, ok := elem.Value.(bson.D)
+			if !ok {
+				break
+			}
+			if fields = this.projectFields(path, fields, include, elem.Name == "d"); len(fields) == 0 {
+				continue
+			}
+			elem.Value = fields
+			changed = true
+		case isArray && strings.HasPrefix(elem.Name, "u"):
+			fields := this.projectFields(path, bson.D{{Name: elem.Name[1:], Value: elem.Value}}, include, false)
+			if len(fields) == 0 {
+				continue
+			}
+			elem.Value = fields[0].Value
+			changed = true
+		case strings.HasPrefix(elem.Name, "s"):
+			field := joinPath(path, elem.Name[1:])
+			if keep, _ := this.lookup(field, include); !keep {
+				continue
+			}
+			sub, ok := elem.Value.(bson.D)
+			if !ok {
+				break
+			}
+			var kept bool
+			if elem.Value, kept = this.projectDiff(field, sub, include); !kept {
+				continue
+			}
+			changed = true
+		}
+		out = append(out, elem)
+	}
+	return out, changed
+}
+
+func joinPath(path []string, parts ...string) []string {
+	joined := make([]string, 0, len(path)+len(parts))
+	return append(append(joined, path...), parts...)
+}
+
+func redactDigest(v interface{}, key []byte) string {
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	b, err := MarshalExtJSON(v, CanonicalExtJSON)
+	if err != nil {
+		return RedactedMask
+	}
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (this *RedactSpec) redactValue(v interface{}) interface{} {
+	if this.Hash {
+		return redactDigest(v, this.HashKey)
+	}
+	return RedactedMask
+}
+
+func (this *RedactSpec) redactPath(doc map[string]interface{}, path []string) {
+	v, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		if this.Remove {
+			delete(doc, path[0])
+		} else {
+			doc[path[0]] = this.redactValue(v)
+		}
+		return
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		this.redactPath(t, path[1:])
+	case bson.M:
+		this.redactPath(t, path[1:])
+	case []interface{}:
+		for _, elem := range t {
+			switch e := elem.(type) {
+			case map[string]interface{}:
+				this.redactPath(e, path[1:])
+			case bson.M:
+				this.redactPath(e, path[1:])
+			}
+		}
+	}
+}
+
+func asDocument(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case bson.M:
+		return t, true
+	}
+	return nil, false
+}
+
+// relates the path of a changed field to a redacted field. rest is the part
+// of field below path and is empty when path is at or below the field
+func relativePath(path, field []string) (rest []string, related bool) {
+	i, j := 0, 0
+	for i < len(path) && j < len(field) {
+		if path[i] == field[j] {
+			i++
+			j++
+		} else if isArrayIndex(path[i]) {
+			i++
+		} else {
+			return nil, false
+		}
+	}
+	return field[j:], true
+}
+
+// redacts a field wherever an update delta changes it. the keys of $set may
+// be dotted paths above, at or below the field
+func (this *RedactSpec) redactDelta(delta map[string]interface{}, field []string) {
+	if set, ok := asDocument(delta["$set"]); ok {
+		for key := range set {
+			this.redactChange(set, key, strings.Split(key, "."), field)
+		}
+	}
+	if diff, ok := asDocument(delta["diff"]); ok {
+		this.redactDiff(diff, nil, field)
+	}
+}
+
+func (this *RedactSpec) redactChange(fields map[string]interface{}, key string, path, field []string) {
+	if rest, related := relativePath(path, field); related {
+		this.redactPath(fields, joinPath([]string{key}, rest...))
+	}
+}
+
+func (this *RedactSpec) redactDiff(diff map[string]interface{}, path, field []string) {
+	isArray, _ := diff["a"].(bool)
+	for k, v := range diff {
+		switch {
+		case !isArray && (k == "u" || k == "i"):
+			if fields, ok := asDocument(v); ok {
+				for f := range fields {
+					this.redactChange(fields, f, joinPath(path, f), field)
+				}
+			}
+		case isArray && strings.HasPrefix(k, "u"):
+			this.redactChange(diff, k, joinPath(path, k[1:]), field)
+		case strings.HasPrefix(k, "s"):
+			if sub, ok := asDocument(v); ok {
+				this.redactDiff(sub, joinPath(path, k[1:]), field)
+			}
+		}
+	}
+}
+
+func (this *RedactSpec) matches(op *Op) bool {
+	return this.Namespace == "" || this.Namespace == op.Namespace
+}
+
+// masks, hashes or removes configured fields of op.Data and then calls the
+// custom Redactor. a custom unmarshalled op.Doc is left to the Redactor.
+// update deltas are redacted in the fields they change
+func (this *Op) redact(options *Options) {
+	if this.Data != nil {
+		delta := this.IsUpdate() && !UpdateIsReplace(this.Data)
+		for i := range options.Redactions {
+			spec := &options.Redactions[i]
+			if !spec.matches(this) {
+				continue
+			}
+			for _, field := range spec.Fields {
+				if delta {
+					spec.redactDelta(this.Data, strings.Split(field, "."))
+				} else {
+					spec.redactPath(this.Data, strings.Split(field, "."))
+				}
+			}
+		}
+	}
+	if options.Redactor != nil {
+		options.Redactor(this)
+	}
+}
@@ -0,0 +1,212 @@
+package gtm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestProjectDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    bson.M
+		delta   bson.D
+		want    bson.M
+		changed bool
+	}{
+		{
+			name:    "exclude a $set key",
+			spec:    bson.M{"ssn": 0},
+			delta:   bson.D{{Name: "$v", Value: 1}, {Name: "$set", Value: bson.D{{Name: "ssn", Value: "1"}, {Name: "name", Value: "a"}}}},
+			want:    bson.M{"$v": 1, "$set": bson.M{"name": "a"}},
+			changed: true,
+		},
+		{
+			name:    "exclude a dotted $set key",
+			spec:    bson.M{"a.ssn": 0},
+			delta:   bson.D{{Name: "$set", Value: bson.D{{Name: "a.ssn", Value: "1"}, {Name: "a.name", Value: "x"}}}},
+			want:    bson.M{"$set": bson.M{"a.name": "x"}},
+			changed: true,
+		},
+		{
+			name:    "exclude below a $set key",
+			spec:    bson.M{"a.ssn": 0},
+			delta:   bson.D{{Name: "$set", Value: bson.D{{Name: "a", Value: bson.D{{Name: "ssn", Value: "1"}, {Name: "name", Value: "x"}}}}}},
+			want:    bson.M{"$set": bson.M{"a": bson.M{"name": "x"}}},
+			changed: true,
+		},
+		{
+			name:    "exclude through an array index",
+			spec:    bson.M{"people.ssn": 0},
+			delta:   bson.D{{Name: "$set", Value: bson.D{{Name: "people.0.ssn", Value: "1"}, {Name: "people.0.name", Value: "x"}}}},
+			want:    bson.M{"$set": bson.M{"people.0.name": "x"}},
+			changed: true,
+		},
+		{
+			name:    "include",
+			spec:    bson.M{"name": 1, "a.city": 1},
+			delta:   bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "n"}, {Name: "ssn", Value: "1"}, {Name: "a.city", Value: "c"}, {Name: "a.zip", Value: "z"}}}},
+			want:    bson.M{"$set": bson.M{"name": "n", "a.city": "c"}},
+			changed: true,
+		},
+		{
+			name:    "$unset of an excluded field",
+			spec:    bson.M{"ssn": 0},
+			delta:   bson.D{{Name: "$unset", Value: bson.D{{Name: "ssn", Value: true}}}, {Name: "$set", Value: bson.D{{Name: "n", Value: 1}}}},
+			want:    bson.M{"$set": bson.M{"n": 1}},
+			changed: true,
+		},
+		{
+			name:    "only excluded fields",
+			spec:    bson.M{"ssn": 0},
+			delta:   bson.D{{Name: "$v", Value: 1}, {Name: "$set", Value: bson.D{{Name: "ssn", Value: "1"}}}},
+			want:    bson.M{"$v": 1},
+			changed: false,
+		},
+		{
+			name: "v2 diff",
+			spec: bson.M{"a.ssn": 0, "secret": 0},
+			delta: bson.D{{Name: "$v", Value: 2}, {Name: "diff", Value: bson.D{
+				{Name: "u", Value: bson.D{{Name: "secret", Value: "s"}, {Name: "n", Value: 1}}},
+				{Name: "sa", Value: bson.D{{Name: "u", Value: bson.D{{Name: "ssn", Value: "1"}}}}},
+			}}},
+			want:    bson.M{"$v": 2, "diff": bson.M{"u": bson.M{"n": 1}}},
+			changed: true,
+		},
+		{
+			name: "v2 array diff",
+			spec: bson.M{"people.ssn": 0},
+			delta: bson.D{{Name: "$v", Value: 2}, {Name: "diff", Value: bson.D{
+				{Name: "speople", Value: bson.D{
+					{Name: "a", Value: true},
+					{Name: "u0", Value: bson.D{{Name: "ssn", Value: "1"}, {Name: "name", Value: "x"}}},
+				}},
+			}}},
+			want: bson.M{"$v": 2, "diff": bson.M{"speople": bson.M{
+				"a":  true,
+				"u0": bson.M{"name": "x"},
+			}}},
+			changed: true,
+		},
+	}
+	for _, test := range tests {
+		data, err := bson.Marshal(test.delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, changed, err := projectDeltaRaw(&bson.Raw{Kind: 0x03, Data: data}, test.spec)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if changed != test.changed {
+			t.Errorf("%s: changed %t, want %t", test.name, changed, test.changed)
+		}
+		var got bson.M
+		if err := raw.Unmarshal(&got); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRedactDelta(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  RedactSpec
+		delta map[string]interface{}
+		want  map[string]interface{}
+	}{
+		{
+			name:  "mask a $set key",
+			spec:  RedactSpec{Fields: []string{"ssn"}},
+			delta: map[string]interface{}{"$set": map[string]interface{}{"ssn": "1", "n": 1}},
+			want:  map[string]interface{}{"$set": map[string]interface{}{"ssn": RedactedMask, "n": 1}},
+		},
+		{
+			name:  "mask a dotted $set key",
+			spec:  RedactSpec{Fields: []string{"a.ssn"}},
+			delta: map[string]interface{}{"$set": map[string]interface{}{"a.ssn": "1", "a.n": 1}},
+			want:  map[string]interface{}{"$set": map[string]interface{}{"a.ssn": RedactedMask, "a.n": 1}},
+		},
+		{
+			name:  "remove below a $set key",
+			spec:  RedactSpec{Fields: []string{"a.ssn"}, Remove: true},
+			delta: map[string]interface{}{"$set": map[string]interface{}{"a": map[string]interface{}{"ssn": "1", "n": 1}}},
+			want:  map[string]interface{}{"$set": map[string]interface{}{"a": map[string]interface{}{"n": 1}}},
+		},
+		{
+			name:  "mask above a $set key",
+			spec:  RedactSpec{Fields: []string{"a"}},
+			delta: map[string]interface{}{"$set": map[string]interface{}{"a.ssn": "1"}},
+			want:  map[string]interface{}{"$set": map[string]interface{}{"a.ssn": RedactedMask}},
+		},
+		{
+			name:  "mask through an array index",
+			spec:  RedactSpec{Fields: []string{"people.ssn"}},
+			delta: map[string]interface{}{"$set": map[string]interface{}{"people.1.ssn": "1", "people.1.n": 1}},
+			want:  map[string]interface{}{"$set": map[string]interface{}{"people.1.ssn": RedactedMask, "people.1.n": 1}},
+		},
+		{
+			name:  "unrelated keys",
+			spec:  RedactSpec{Fields: []string{"a.ssn"}},
+			delta: map[string]interface{}{"$set": map[string]interface{}{"ab": "1", "b.ssn": "2"}},
+			want:  map[string]interface{}{"$set": map[string]interface{}{"ab": "1", "b.ssn": "2"}},
+		},
+		{
+			name: "v2 diff",
+			spec: RedactSpec{Fields: []string{"a.ssn", "people.ssn"}, Remove: true},
+			delta: map[string]interface{}{"$v": 2, "diff": map[string]interface{}{
+				"sa":      map[string]interface{}{"i": map[string]interface{}{"ssn": "1", "n": 1}},
+				"speople": map[string]interface{}{"a": true, "u0": map[string]interface{}{"ssn": "2", "n": 2}},
+			}},
+			want: map[string]interface{}{"$v": 2, "diff": map[string]interface{}{
+				"sa":      map[string]interface{}{"i": map[string]interface{}{"n": 1}},
+				"speople": map[string]interface{}{"a": true, "u0": map[string]interface{}{"n": 2}},
+			}},
+		},
+	}
+	for _, test := range tests {
+		op := &Op{Operation: "u", Namespace: "db.people", Data: test.delta}
+		op.redact(&Options{Redactions: []RedactSpec{test.spec}})
+		if !reflect.DeepEqual(op.Data, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, op.Data, test.want)
+		}
+	}
+}
+
+func TestNewProjectionMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    bson.M
+		include bool
+		err     error
+	}{
+		{name: "include", spec: bson.M{"a": 1, "b.c": true}, include: true},
+		{name: "exclude", spec: bson.M{"a": 0, "b.c": false}},
+		{name: "include without _id", spec: bson.M{"_id": 0, "a": 1, "b": 1}, include: true},
+		{name: "exclude keeping _id", spec: bson.M{"_id": 1, "a": 0, "b": 0}},
+		{name: "mixed", spec: bson.M{"a": 1, "b": 0, "c": 1}, err: ErrMixedProjection},
+	}
+	for _, test := range tests {
+		// map order changes between runs so repeat to catch order dependence
+		for i := 0; i < 20; i++ {
+			p, err := newProjection(test.spec)
+			if err != test.err {
+				t.Fatalf("%s: got %v, want %v", test.name, err, test.err)
+			}
+			if err == nil && p.include != test.include {
+				t.Fatalf("%s: got include %v, want %v", test.name, p.include, test.include)
+			}
+		}
+	}
+	raw := &bson.Raw{Kind: 0x03}
+	raw.Data, _ = bson.Marshal(bson.M{"_id": 1, "a": 1, "b": 2})
+	if _, err := projectRaw(raw, bson.M{"a": 1, "b": 0}); err != ErrMixedProjection {
+		t.Errorf("projectRaw: got %v, want ErrMixedProjection", err)
+	}
+}
@@ -0,0 +1,72 @@
+package gtm
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"sync"
+)
+
+// the oplog position each fetch worker has finished with. every op of the
+// worker up to its mark has been sent on OpC or dropped. with several workers
+// ops leave OpC out of oplog order, so an op is stamped with the lowest mark
+// as the point to resume after once it and the ops before it are processed
+type workerMarks struct {
+	lock  sync.Mutex
+	marks []bson.MongoTimestamp
+}
+
+func newWorkerMarks(workers int) *workerMarks {
+	return &workerMarks{marks: make([]bson.MongoTimestamp, workers)}
+}
+
+func (this *workerMarks) set(worker int, ts bson.MongoTimestamp) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if worker < len(this.marks) {
+		this.marks[worker] = ts
+	}
+}
+
+// the checkpoint of an op about to be sent by worker. the worker's own mark
+// is not published until the op is on OpC so it counts up to the op itself
+func (this *workerMarks) stamp(worker int, ts bson.MongoTimestamp) bson.MongoTimestamp {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	low := ts
+	for i, mark := range this.marks {
+		if i != worker && CompareTimestamps(mark, low) < 0 {
+			low = mark
+		}
+	}
+	return low
+}
+
+// records that the worker of buf has read op from its channel
+func (this *OpBuf) seen(ctx *OpCtx, op *Op) {
+	if op.IsSourceOplog() && CompareTimestamps(op.Timestamp, this.last) > 0 {
+		this.last = op.Timestamp
+	}
+	this.mark(ctx)
+}
+
+// publishes how far the worker of buf has got. buffered ops hold it back
+func (this *OpBuf) mark(ctx *OpCtx) {
+	if ctx.marks == nil {
+		return
+	}
+	if len(this.Entries) == 0 {
+		ctx.marks.set(this.worker, this.last)
+	} else {
+		ctx.marks.set(this.worker, this.Entries[0].Timestamp-1)
+	}
+}
+
+// sends a fetched op stamped with its checkpoint
+func (this *OpBuf) send(ctx *OpCtx, op *Op, options *Options) {
+	if ctx.marks != nil && op.IsSourceOplog() {
+		op.Checkpoint = ctx.marks.stamp(this.worker, op.Timestamp)
+	}
+	ctx.sendOp(op, options)
+	if ctx.marks != nil && op.IsSourceOplog() {
+		ctx.marks.set(this.worker, op.Timestamp)
+	}
+}
@@ -0,0 +1,74 @@
+package gtm
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func oplogOp(ts bson.MongoTimestamp) *Op {
+	return &Op{Id: int(ts), Operation: "i", Namespace: "db.col", Source: OplogQuerySource, Timestamp: ts}
+}
+
+func TestWorkerMarksStamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		marks  []bson.MongoTimestamp
+		worker int
+		ts     bson.MongoTimestamp
+		stamp  bson.MongoTimestamp
+	}{
+		{name: "single worker", marks: []bson.MongoTimestamp{3}, worker: 0, ts: 7, stamp: 7},
+		{name: "other worker behind", marks: []bson.MongoTimestamp{9, 4}, worker: 0, ts: 7, stamp: 4},
+		{name: "other worker ahead", marks: []bson.MongoTimestamp{1, 12}, worker: 0, ts: 7, stamp: 7},
+		{name: "own mark ignored", marks: []bson.MongoTimestamp{1, 12, 10}, worker: 0, ts: 11, stamp: 10},
+		{name: "idle worker", marks: []bson.MongoTimestamp{5, 0}, worker: 0, ts: 6, stamp: 0},
+	}
+	for _, test := range tests {
+		marks := newWorkerMarks(len(test.marks))
+		for i, mark := range test.marks {
+			marks.set(i, mark)
+		}
+		if got := marks.stamp(test.worker, test.ts); got != test.stamp {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.stamp)
+		}
+	}
+}
+
+// two workers share the oplog. worker 0 holds op 2 in its buffer while
+// worker 1 sends op 3, so op 3 may not be resumed after
+func TestOpBufCheckpoint(t *testing.T) {
+	ctx := &OpCtx{
+		OpC:   make(OpChan, 10),
+		stats: &ctxStats{},
+		marks: newWorkerMarks(2),
+	}
+	options := &Options{}
+	bufs := []*OpBuf{{worker: 0}, {worker: 1}}
+	owner := map[bson.MongoTimestamp]int{1: 1, 2: 0, 3: 1}
+	for ts := bson.MongoTimestamp(1); ts <= 3; ts++ {
+		op := oplogOp(ts)
+		for _, buf := range bufs {
+			if owner[ts] == buf.worker {
+				buf.Append(op)
+			}
+			buf.seen(ctx, op)
+		}
+	}
+	flush := func(buf *OpBuf) {
+		for _, op := range buf.Entries {
+			buf.send(ctx, op, options)
+		}
+		buf.Entries = nil
+		buf.mark(ctx)
+	}
+	flush(bufs[1])
+	flush(bufs[0])
+	want := map[bson.MongoTimestamp]bson.MongoTimestamp{1: 1, 3: 1, 2: 2}
+	for i := 0; i < 3; i++ {
+		op := <-ctx.OpC
+		if op.Checkpoint != want[op.Timestamp] {
+			t.Errorf("op %d: checkpoint %d, want %d", op.Timestamp, op.Checkpoint, want[op.Timestamp])
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package gtm
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+type RetryStage string
+
+const (
+	TailStage          RetryStage = "tail"
+	FetchStage         RetryStage = "fetch"
+	DirectReadStage    RetryStage = "directRead"
+	ShardListenerStage RetryStage = "shardListener"
+)
+
+// how gtm waits between attempts to reach MongoDB after an error.
+// the backoff doubles from InitialBackoff up to MaxBackoff and is randomized
+// by +/- Jitter (a fraction between 0 and 1). zero MaxAttempts and Deadline
+// retry forever. Deadline is measured from the first failure since the last
+// success. when the policy is exhausted the stage gives up, or with
+// StopOnExhausted a FatalError is sent on ErrC and the context is stopped.
+// giving up on the tail stage also stops the context since it has nothing
+// left to read
+type RetryPolicy struct {
+	InitialBackoff  time.Duration
+	MaxBackoff      time.Duration
+	Jitter          float64
+	MaxAttempts     int
+	Deadline        time.Duration
+	StopOnExhausted bool
+}
+
+type FatalError struct {
+	Stage    RetryStage
+	Attempts int
+	Err      error
+}
+
+var ErrRetriesExhausted = errors.New("retry policy exhausted")
+
+var errRetryStopped = errors.New("stopped while retrying")
+
+type retrier struct {
+	policy  *RetryPolicy
+	stage   RetryStage
+	attempt int
+	started time.Time
+}
+
+func (this *FatalError) Error() string {
+	return fmt.Sprintf("Stopping after %d attempts in stage %s: %s", this.Attempts, this.Stage, this.Err)
+}
+
+func (this *FatalError) Cause() error {
+	return this.Err
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		InitialBackoff:  time.Duration(1) * time.Second,
+		MaxBackoff:      time.Duration(30) * time.Second,
+		Jitter:          0.2,
+		MaxAttempts:     0,
+		Deadline:        0,
+		StopOnExhausted: false,
+	}
+}
+
+func (this *RetryPolicy) SetDefaults() {
+	defaultPolicy := DefaultRetryPolicy()
+	if this.InitialBackoff <= 0 {
+		this.InitialBackoff = defaultPolicy.InitialBackoff
+	}
+	if this.MaxBackoff <= 0 {
+		this.MaxBackoff = defaultPolicy.MaxBackoff
+	}
+	if this.MaxBackoff < this.InitialBackoff {
+		this.MaxBackoff = this.InitialBackoff
+	}
+	if this.Jitter < 0 {
+		this.Jitter = 0
+	} else if this.Jitter > 1 {
+		this.Jitter = 1
+	}
+}
+
+// returns the policy for a stage. an entry in RetryOverrides replaces
+// RetryPolicy for that stage
+func (this *Options) retryPolicy(stage RetryStage) *RetryPolicy {
+	if policy, ok := this.RetryOverrides[stage]; ok && policy != nil {
+		return policy
+	}
+	if this.RetryPolicy == nil {
+		return DefaultRetryPolicy()
+	}
+	return this.RetryPolicy
+}
+
+func (this *Options) retrier(stage RetryStage) *retrier {
+	return &retrier{
+		policy: this.retryPolicy(stage),
+		stage:  stage,
+	}
+}
+
+func (this *retrier) reset() {
+	this.attempt = 0
+	this.started = time.Time{}
+}
+
+func (this *retrier) backoff() time.Duration {
+	d := this.policy.InitialBackoff
+	for i := 1; i < this.attempt && d < this.policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > this.policy.MaxBackoff {
+		d = this.policy.MaxBackoff
+	}
+	if this.policy.Jitter > 0 {
+		d += time.Duration(float64(d) * this.policy.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// sleeps before the next attempt. returns errRetryStopped if stopC closes
+// first or a FatalError when the policy does not allow another attempt
+func (this *retrier) wait(stopC chan bool) error {
+	now := time.Now()
+	if this.started.IsZero() {
+		this.started = now
+	}
+	this.attempt++
+	max := this.policy.MaxAttempts
+	deadline := this.policy.Deadline
+	if (max > 0 && this.attempt > max) || (deadline > 0 && now.Sub(this.started) >= deadline) {
+		return &FatalError{
+			Stage:    this.stage,
+			Attempts: this.attempt - 1,
+			Err:      ErrRetriesExhausted,
+		}
+	}
+	d := this.backoff()
+	if deadline > 0 {
+		if left := deadline - now.Sub(this.started); d > left {
+			d = left
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-stopC:
+		return errRetryStopped
+	case <-t.C:
+		return nil
+	}
+}
+
+// reports an exhausted retry policy and stops the context if asked to or
+// if the tail gave up
+func (ctx *OpCtx) giveUp(r *retrier, err error) {
+	if r.policy.StopOnExhausted {
+		ctx.ErrC <- err
+		go ctx.Stop()
+	} else {
+		ctx.ErrC <- errors.Wrap(ErrRetriesExhausted, fmt.Sprintf("Giving up on stage %s", r.stage))
+		if r.stage == TailStage {
+			go ctx.Stop()
+		}
+	}
+}
+
+// waits until the session can reach MongoDB again. returns false when stopC
+// closes or the retry policy is exhausted
+func (ctx *OpCtx) waitForConnection(session *mgo.Session, r *retrier, stopC chan bool) bool {
+	for {
+		if err := r.wait(stopC); err != nil {
+			if err != errRetryStopped {
+				ctx.giveUp(r, err)
+			}
+			return false
+		}
+		s := session.Copy()
+		err := s.Ping()
+		s.Close()
+		if err == nil {
+			return true
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package gtm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetrierBackoff(t *testing.T) {
+	r := &retrier{policy: &RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}}
+	want := []time.Duration{10, 10, 20, 40, 50, 50}
+	for i, w := range want {
+		r.attempt = i
+		if got := r.backoff(); got != w*time.Millisecond {
+			t.Errorf("attempt %d: got %s, want %s", i, got, w*time.Millisecond)
+		}
+	}
+	r.policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		r.attempt = 3
+		if got := r.backoff(); got < 20*time.Millisecond || got > 60*time.Millisecond {
+			t.Fatalf("jittered backoff %s outside 20ms to 60ms", got)
+		}
+	}
+}
+
+func TestRetrierExhaustion(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int // successful waits before the policy is exhausted
+	}{
+		{"max attempts", RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxAttempts: 3}, 3},
+		{"deadline", RetryPolicy{InitialBackoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Deadline: 30 * time.Millisecond}, 2},
+	}
+	for _, test := range tests {
+		policy := test.policy
+		r := &retrier{policy: &policy, stage: FetchStage}
+		stopC := make(chan bool)
+		for i := 0; i < test.attempts; i++ {
+			if err := r.wait(stopC); err != nil {
+				t.Fatalf("%s: wait %d: %s", test.name, i+1, err)
+			}
+		}
+		err := r.wait(stopC)
+		fatal, ok := err.(*FatalError)
+		if !ok {
+			t.Fatalf("%s: got %v, want a FatalError", test.name, err)
+		}
+		if fatal.Stage != FetchStage || fatal.Attempts != test.attempts || errors.Cause(fatal) != ErrRetriesExhausted {
+			t.Errorf("%s: got %+v", test.name, fatal)
+		}
+		// a success starts the count again
+		r.reset()
+		if err := r.wait(stopC); err != nil {
+			t.Errorf("%s: wait after reset: %s", test.name, err)
+		}
+	}
+}
+
+func TestRetrierStop(t *testing.T) {
+	r := &retrier{policy: &RetryPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Minute}}
+	stopC := make(chan bool)
+	close(stopC)
+	if err := r.wait(stopC); err != errRetryStopped {
+		t.Errorf("got %v, want errRetryStopped", err)
+	}
+}
+
+func TestGiveUpOnTailStops(t *testing.T) {
+	tests := []struct {
+		stage   RetryStage
+		fatal   bool
+		stopped bool
+	}{
+		{stage: FetchStage},
+		{stage: DirectReadStage},
+		{stage: TailStage, stopped: true},
+		{stage: FetchStage, fatal: true, stopped: true},
+	}
+	for _, test := range tests {
+		ctx := stubCtx()
+		ctx.ErrC = make(chan error, 1)
+		r := &retrier{policy: &RetryPolicy{StopOnExhausted: test.fatal}, stage: test.stage}
+		ctx.giveUp(r, &FatalError{Stage: test.stage, Err: ErrRetriesExhausted})
+		err := <-ctx.ErrC
+		if _, ok := err.(*FatalError); ok != test.fatal {
+			t.Errorf("%s: got %v, fatal %v", test.stage, err, test.fatal)
+		}
+		select {
+		case <-ctx.stopC:
+			if !test.stopped {
+				t.Errorf("%s: the context stopped", test.stage)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if test.stopped {
+				t.Errorf("%s: the context is still running", test.stage)
+			}
+		}
+		ctx.Stop()
+	}
+}
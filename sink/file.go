@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rwynn/gtm"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// writes ops as lines of extended json to files in Dir, starting a new
+// file once the current one reaches MaxBytes or is older than MaxAge
+type FileSink struct {
+	Dir      string
+	Prefix   string
+	MaxBytes int64
+	MaxAge   time.Duration
+	Mode     gtm.ExtJSONMode
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func NewFileSink(dir string, prefix string) *FileSink {
+	return &FileSink{
+		Dir:      dir,
+		Prefix:   prefix,
+		MaxBytes: 64 * 1024 * 1024,
+		MaxAge:   time.Duration(1) * time.Hour,
+		Mode:     gtm.CanonicalExtJSON,
+	}
+}
+
+func (this *FileSink) shouldRotate() bool {
+	if this.file == nil {
+		return true
+	}
+	if this.MaxBytes > 0 && this.size >= this.MaxBytes {
+		return true
+	}
+	if this.MaxAge > 0 && time.Since(this.opened) >= this.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (this *FileSink) rotate() error {
+	if this.file != nil {
+		if err := this.file.Close(); err != nil {
+			return err
+		}
+		this.file = nil
+	}
+	if err := os.MkdirAll(this.Dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s%s.%09d.jsonl", this.Prefix, now.Format("20060102T150405"), now.Nanosecond())
+	f, err := os.OpenFile(filepath.Join(this.Dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	this.file = f
+	this.size = 0
+	this.opened = now
+	return nil
+}
+
+func (this *FileSink) WriteBatch(ops []*gtm.Op) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.shouldRotate() {
+		if err := this.rotate(); err != nil {
+			return errors.Wrap(err, "Error rotating sink file")
+		}
+	}
+	var lines []byte
+	for _, op := range ops {
+		b, err := op.MarshalExtJSON(this.Mode)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, b...)
+		lines = append(lines, '\n')
+	}
+	_, err := this.file.Write(lines)
+	if err == nil {
+		err = this.file.Sync()
+	}
+	if err != nil {
+		// start the retry in a fresh file rather than after a partial line
+		this.file.Close()
+		this.file = nil
+		return err
+	}
+	this.size += int64(len(lines))
+	return nil
+}
+
+func (this *FileSink) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
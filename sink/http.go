@@ -0,0 +1,68 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rwynn/gtm"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// posts each batch to URL as newline delimited extended json. any response
+// other than 2xx fails the batch so that it is retried
+type HTTPSink struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+	Mode    gtm.ExtJSONMode
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{
+		URL:     url,
+		Headers: map[string]string{},
+		Client:  &http.Client{Timeout: time.Duration(30) * time.Second},
+		Mode:    gtm.CanonicalExtJSON,
+	}
+}
+
+func (this *HTTPSink) WriteBatch(ops []*gtm.Op) error {
+	var body bytes.Buffer
+	for _, op := range ops {
+		b, err := op.MarshalExtJSON(this.Mode)
+		if err != nil {
+			return err
+		}
+		body.Write(b)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", this.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range this.Headers {
+		req.Header.Set(k, v)
+	}
+	client := this.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Webhook %s returned %s: %s", this.URL, resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (this *HTTPSink) Close() error {
+	return nil
+}
@@ -0,0 +1,165 @@
+package kafka
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/rwynn/gtm"
+	"regexp"
+	"text/template"
+)
+
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// a Kafka protocol producer. SendMessages must block until the broker
+// acknowledges every message or return an error
+type Producer interface {
+	SendMessages(msgs []*Message) error
+	Close() error
+}
+
+type Serializer func(op *gtm.Op) ([]byte, error)
+
+type KeyFunc func(op *gtm.Op) ([]byte, error)
+
+// the values available to Options.TopicTemplate
+type TopicData struct {
+	Database   string
+	Collection string
+	Namespace  string
+	Operation  string
+}
+
+type Options struct {
+	TopicTemplate string
+	Serializer    Serializer
+	KeyFunc       KeyFunc
+}
+
+// a sink.Sink which produces each op to the topic rendered from TopicTemplate.
+// since the runner only advances its checkpoint after WriteBatch returns,
+// checkpoints are only committed once the broker has acknowledged the batch
+type Sink struct {
+	producer  Producer
+	topic     *template.Template
+	serialize Serializer
+	key       KeyFunc
+}
+
+var invalidTopicChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func DefaultOptions() *Options {
+	return &Options{
+		TopicTemplate: "{{.Namespace}}",
+		Serializer:    ExtJSONSerializer(gtm.CanonicalExtJSON),
+		KeyFunc:       DocumentKey,
+	}
+}
+
+func (this *Options) SetDefaults() {
+	defaultOpts := DefaultOptions()
+	if this.TopicTemplate == "" {
+		this.TopicTemplate = defaultOpts.TopicTemplate
+	}
+	if this.Serializer == nil {
+		this.Serializer = defaultOpts.Serializer
+	}
+	if this.KeyFunc == nil {
+		this.KeyFunc = defaultOpts.KeyFunc
+	}
+}
+
+func ExtJSONSerializer(mode gtm.ExtJSONMode) Serializer {
+	return func(op *gtm.Op) ([]byte, error) {
+		return op.MarshalExtJSON(mode)
+	}
+}
+
+// keys messages by namespace and document id so every change to a document
+// lands on the same partition. this carries gtm.Document ordering into Kafka.
+// ops without an id, such as drops, are keyed by namespace alone
+func DocumentKey(op *gtm.Op) ([]byte, error) {
+	ns := namespace(op)
+	if op.Id == nil {
+		return []byte(ns), nil
+	}
+	id, err := gtm.MarshalExtJSON(op.Id, gtm.CanonicalExtJSON)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 0, len(ns)+1+len(id))
+	key = append(key, ns...)
+	key = append(key, ':')
+	return append(key, id...), nil
+}
+
+// keys messages by namespace, carrying gtm.Namespace ordering into Kafka
+func NamespaceKey(op *gtm.Op) ([]byte, error) {
+	return []byte(namespace(op)), nil
+}
+
+func namespace(op *gtm.Op) string {
+	if col, drop := op.IsDropCollection(); drop {
+		return op.GetDatabase() + "." + col
+	}
+	return op.Namespace
+}
+
+func New(producer Producer, options *Options) (*Sink, error) {
+	if options == nil {
+		options = DefaultOptions()
+	} else {
+		options.SetDefaults()
+	}
+	topic, err := template.New("topic").Option("missingkey=error").Parse(options.TopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid topic template")
+	}
+	return &Sink{
+		producer:  producer,
+		topic:     topic,
+		serialize: options.Serializer,
+		key:       options.KeyFunc,
+	}, nil
+}
+
+func (this *Sink) Topic(op *gtm.Op) (string, error) {
+	data := TopicData{
+		Database:   op.GetDatabase(),
+		Collection: op.GetCollection(),
+		Namespace:  namespace(op),
+		Operation:  op.Operation,
+	}
+	var buf bytes.Buffer
+	if err := this.topic.Execute(&buf, &data); err != nil {
+		return "", errors.Wrap(err, "Error rendering topic template")
+	}
+	return invalidTopicChars.ReplaceAllString(buf.String(), "_"), nil
+}
+
+func (this *Sink) WriteBatch(ops []*gtm.Op) error {
+	msgs := make([]*Message, 0, len(ops))
+	for _, op := range ops {
+		topic, err := this.Topic(op)
+		if err != nil {
+			return err
+		}
+		key, err := this.key(op)
+		if err != nil {
+			return errors.Wrap(err, "Error computing message key")
+		}
+		value, err := this.serialize(op)
+		if err != nil {
+			return errors.Wrap(err, "Error serializing op")
+		}
+		msgs = append(msgs, &Message{Topic: topic, Key: key, Value: value})
+	}
+	return this.producer.SendMessages(msgs)
+}
+
+func (this *Sink) Close() error {
+	return this.producer.Close()
+}
@@ -0,0 +1,209 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+	"github.com/rwynn/gtm/sink"
+)
+
+func testOp(ns string, id interface{}, ts int) *gtm.Op {
+	return &gtm.Op{
+		Id:         id,
+		Operation:  "u",
+		Namespace:  ns,
+		Source:     gtm.OplogQuerySource,
+		Timestamp:  bson.MongoTimestamp(ts),
+		Checkpoint: bson.MongoTimestamp(ts),
+	}
+}
+
+// the value of each message is the timestamp of its op
+func timestampSerializer(op *gtm.Op) ([]byte, error) {
+	return []byte(fmt.Sprintf("%d", op.Timestamp)), nil
+}
+
+func TestMemoryBrokerKeyOrdering(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyFunc KeyFunc
+		ops     []*gtm.Op
+	}{
+		{
+			name:    "document key",
+			keyFunc: DocumentKey,
+			ops: []*gtm.Op{
+				testOp("db.orders", 1, 1),
+				testOp("db.orders", 2, 2),
+				testOp("db.orders", 1, 3),
+				testOp("db.orders", 3, 4),
+				testOp("db.orders", 2, 5),
+				testOp("db.orders", 1, 6),
+				testOp("db.orders", "a", 7),
+				testOp("db.orders", "a", 8),
+			},
+		},
+		{
+			name:    "namespace key",
+			keyFunc: NamespaceKey,
+			ops: []*gtm.Op{
+				testOp("db.orders", 1, 1),
+				testOp("db.orders", 2, 2),
+				testOp("db.orders", 3, 3),
+				testOp("db.orders", 1, 4),
+			},
+		},
+	}
+	for _, test := range tests {
+		broker := NewMemoryBroker(4)
+		s, err := New(broker, &Options{Serializer: timestampSerializer, KeyFunc: test.keyFunc})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		// write in two batches to check ordering across batches
+		half := len(test.ops) / 2
+		if err := s.WriteBatch(test.ops[:half]); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := s.WriteBatch(test.ops[half:]); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		partitionOf := make(map[string]int)
+		last := make(map[string]int)
+		total := 0
+		for p := 0; p < broker.Partitions; p++ {
+			for _, msg := range broker.Messages("db.orders", p) {
+				total++
+				key := string(msg.Key)
+				if want := broker.Partition(msg.Key); want != p {
+					t.Errorf("%s: key %s stored on partition %d, want %d", test.name, key, p, want)
+				}
+				if prev, ok := partitionOf[key]; ok && prev != p {
+					t.Errorf("%s: key %s found on partitions %d and %d", test.name, key, prev, p)
+				}
+				partitionOf[key] = p
+				ts, _ := strconv.Atoi(string(msg.Value))
+				if prev, ok := last[key]; ok && ts <= prev {
+					t.Errorf("%s: key %s out of order: %d after %d", test.name, key, ts, prev)
+				}
+				last[key] = ts
+			}
+		}
+		if total != len(test.ops) {
+			t.Errorf("%s: got %d messages, want %d", test.name, total, len(test.ops))
+		}
+	}
+}
+
+func TestMemoryBrokerPartition(t *testing.T) {
+	broker := NewMemoryBroker(3)
+	for _, key := range []string{"", "a", "db.orders:1", "db.orders:\"x\""} {
+		p := broker.Partition([]byte(key))
+		if p < 0 || p >= broker.Partitions {
+			t.Errorf("key %q: partition %d out of range", key, p)
+		}
+		if again := broker.Partition([]byte(key)); again != p {
+			t.Errorf("key %q: partition %d then %d", key, p, again)
+		}
+	}
+	if NewMemoryBroker(0).Partitions != 1 {
+		t.Errorf("expected at least one partition")
+	}
+}
+
+type memoryCheckpoint struct {
+	lock  sync.Mutex
+	saved []bson.MongoTimestamp
+}
+
+func (this *memoryCheckpoint) Load() (bson.MongoTimestamp, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.saved) == 0 {
+		return 0, nil
+	}
+	return this.saved[len(this.saved)-1], nil
+}
+
+func (this *memoryCheckpoint) Save(ts bson.MongoTimestamp) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.saved = append(this.saved, ts)
+	return nil
+}
+
+func TestCheckpointAfterAck(t *testing.T) {
+	errBroker := errors.New("broker unavailable")
+	tests := []struct {
+		name       string
+		failures   int // batches rejected before the broker acknowledges
+		maxRetries int
+		checkpoint bson.MongoTimestamp
+		stored     int
+	}{
+		{name: "acknowledged", failures: 0, maxRetries: 1, checkpoint: 3, stored: 3},
+		{name: "acknowledged after a retry", failures: 1, maxRetries: 2, checkpoint: 3, stored: 3},
+		{name: "never acknowledged", failures: 10, maxRetries: 1, checkpoint: 0, stored: 0},
+	}
+	for _, test := range tests {
+		store := &memoryCheckpoint{}
+		broker := NewMemoryBroker(2)
+		failures := test.failures
+		broker.Fail = func(msgs []*Message) error {
+			// the checkpoint must not cover the batch before it is acknowledged
+			if ts, _ := store.Load(); ts != 0 {
+				t.Errorf("%s: checkpoint %d saved before the batch was acknowledged", test.name, ts)
+			}
+			if failures > 0 {
+				failures--
+				return errBroker
+			}
+			return nil
+		}
+		s, err := New(broker, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		runner := sink.NewRunner(s, &sink.Options{
+			BatchSize:      3,
+			BatchDuration:  time.Hour,
+			MaxRetries:     test.maxRetries,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			Checkpoint:     store,
+			Log:            log.New(ioutil.Discard, "", 0),
+		})
+		go func() {
+			for range runner.ErrC {
+			}
+		}()
+		opC := make(gtm.OpChan, 3)
+		opC <- testOp("db.orders", 1, 1)
+		opC <- testOp("db.orders", 2, 2)
+		opC <- testOp("db.orders", 1, 3)
+		close(opC)
+		runner.Start(opC)
+		runner.Wait()
+		if got := runner.Checkpoint(); got != test.checkpoint {
+			t.Errorf("%s: checkpoint %d, want %d", test.name, got, test.checkpoint)
+		}
+		if got, _ := store.Load(); got != test.checkpoint {
+			t.Errorf("%s: saved checkpoint %d, want %d", test.name, got, test.checkpoint)
+		}
+		stored := 0
+		for p := 0; p < broker.Partitions; p++ {
+			stored += len(broker.Messages("db.orders", p))
+		}
+		if stored != test.stored {
+			t.Errorf("%s: %d messages stored, want %d", test.name, stored, test.stored)
+		}
+	}
+}
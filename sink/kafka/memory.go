@@ -0,0 +1,91 @@
+package kafka
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+var ErrBrokerClosed = errors.New("broker is closed")
+
+// an in-process stand-in for a Kafka broker. messages are assigned to
+// partitions by hashing the key like the default sarama partitioner.
+// set Fail to inject errors, in which case no message of the batch is stored
+type MemoryBroker struct {
+	Partitions int
+	Fail       func(msgs []*Message) error
+	lock       sync.Mutex
+	topics     map[string][][]*Message
+	closed     bool
+}
+
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBroker{
+		Partitions: partitions,
+		topics:     make(map[string][][]*Message),
+	}
+}
+
+func (this *MemoryBroker) Partition(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	p := int32(h.Sum32()) % int32(this.Partitions)
+	if p < 0 {
+		p = -p
+	}
+	return int(p)
+}
+
+func (this *MemoryBroker) SendMessages(msgs []*Message) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return ErrBrokerClosed
+	}
+	if this.Fail != nil {
+		if err := this.Fail(msgs); err != nil {
+			return err
+		}
+	}
+	for _, msg := range msgs {
+		partitions, ok := this.topics[msg.Topic]
+		if !ok {
+			partitions = make([][]*Message, this.Partitions)
+			this.topics[msg.Topic] = partitions
+		}
+		p := this.Partition(msg.Key)
+		partitions[p] = append(partitions[p], msg)
+	}
+	return nil
+}
+
+// returns the messages acknowledged for a topic partition in order
+func (this *MemoryBroker) Messages(topic string, partition int) []*Message {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	partitions, ok := this.topics[topic]
+	if !ok || partition < 0 || partition >= len(partitions) {
+		return nil
+	}
+	return append([]*Message(nil), partitions[partition]...)
+}
+
+func (this *MemoryBroker) Topics() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var topics []string
+	for topic := range this.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (this *MemoryBroker) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+	return nil
+}
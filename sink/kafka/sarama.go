@@ -0,0 +1,50 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+type saramaProducer struct {
+	producer sarama.SyncProducer
+}
+
+// returns a broker config which waits for all in sync replicas and keeps
+// a single request in flight so retries cannot reorder a partition
+func NewSaramaConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Net.MaxOpenRequests = 1
+	return config
+}
+
+// returns a Producer backed by a sarama SyncProducer. a nil config uses NewSaramaConfig
+func NewSaramaProducer(brokers []string, config *sarama.Config) (Producer, error) {
+	if config == nil {
+		config = NewSaramaConfig()
+	}
+	// required by the sync producer to report acknowledgements
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &saramaProducer{producer: producer}, nil
+}
+
+func (this *saramaProducer) SendMessages(msgs []*Message) error {
+	pms := make([]*sarama.ProducerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		pms = append(pms, &sarama.ProducerMessage{
+			Topic: msg.Topic,
+			Key:   sarama.ByteEncoder(msg.Key),
+			Value: sarama.ByteEncoder(msg.Value),
+		})
+	}
+	return this.producer.SendMessages(pms)
+}
+
+func (this *saramaProducer) Close() error {
+	return this.producer.Close()
+}
@@ -0,0 +1,290 @@
+package sink
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/rwynn/gtm"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a destination for ops. WriteBatch must only return nil once every op in the
+// batch is durably accepted. a batch which returns an error is retried in full
+// so sinks must tolerate receiving the same op more than once
+type Sink interface {
+	WriteBatch(ops []*gtm.Op) error
+	Close() error
+}
+
+// persists the oplog position up to which a sink has written every entry
+type CheckpointStore interface {
+	Load() (bson.MongoTimestamp, error)
+	Save(ts bson.MongoTimestamp) error
+}
+
+type Options struct {
+	BatchSize      int
+	BatchDuration  time.Duration
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Checkpoint     CheckpointStore
+	Log            *log.Logger
+}
+
+type Runner struct {
+	ErrC       chan error // errors which do not fit in the buffer are logged instead
+	sink       Sink
+	options    *Options
+	lock       *sync.Mutex
+	wg         *sync.WaitGroup
+	stopC      chan bool
+	stopped    bool
+	checkpoint bson.MongoTimestamp
+	err        error
+}
+
+var ErrRetriesExhausted = errors.New("sink retries exhausted")
+
+func DefaultOptions() *Options {
+	return &Options{
+		BatchSize:      100,
+		BatchDuration:  time.Duration(1) * time.Second,
+		MaxRetries:     5,
+		InitialBackoff: time.Duration(500) * time.Millisecond,
+		MaxBackoff:     time.Duration(30) * time.Second,
+		Checkpoint:     nil,
+		Log:            log.New(os.Stdout, "INFO ", log.Flags()),
+	}
+}
+
+// MaxRetries below zero retries failed batches forever
+func (this *Options) SetDefaults() {
+	defaultOpts := DefaultOptions()
+	if this.BatchSize < 1 {
+		this.BatchSize = defaultOpts.BatchSize
+	}
+	if this.BatchDuration == 0 {
+		this.BatchDuration = defaultOpts.BatchDuration
+	}
+	if this.MaxRetries == 0 {
+		this.MaxRetries = defaultOpts.MaxRetries
+	}
+	if this.InitialBackoff == 0 {
+		this.InitialBackoff = defaultOpts.InitialBackoff
+	}
+	if this.MaxBackoff == 0 {
+		this.MaxBackoff = defaultOpts.MaxBackoff
+	}
+	if this.Log == nil {
+		this.Log = defaultOpts.Log
+	}
+}
+
+func NewRunner(sink Sink, options *Options) *Runner {
+	if options == nil {
+		options = DefaultOptions()
+	} else {
+		options.SetDefaults()
+	}
+	return &Runner{
+		ErrC:    make(chan error, options.BatchSize),
+		sink:    sink,
+		options: options,
+		lock:    &sync.Mutex{},
+		wg:      &sync.WaitGroup{},
+		stopC:   make(chan bool),
+	}
+}
+
+// drains opC, typically the OpC of an OpCtx or OpCtxMulti, into the sink.
+// the runner exits when opC is closed, Stop is called or retries are exhausted
+func (this *Runner) Start(opC gtm.OpChan) {
+	this.wg.Add(1)
+	go this.run(opC)
+}
+
+// stops the runner after writing any pending batch
+func (this *Runner) Stop() {
+	this.lock.Lock()
+	if !this.stopped {
+		this.stopped = true
+		close(this.stopC)
+	}
+	this.lock.Unlock()
+	this.wg.Wait()
+}
+
+// waits for the runner to exit and returns the error which stopped it, if any
+func (this *Runner) Wait() error {
+	this.wg.Wait()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.err
+}
+
+// the oplog position up to which every entry has been acknowledged by the sink
+func (this *Runner) Checkpoint() bson.MongoTimestamp {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.checkpoint
+}
+
+func (this *Runner) run(opC gtm.OpChan) {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.options.BatchDuration)
+	defer ticker.Stop()
+	var batch []*gtm.Op
+	for {
+		select {
+		case <-this.stopC:
+			this.flush(batch)
+			return
+		case <-ticker.C:
+			if !this.flush(batch) {
+				return
+			}
+			batch = nil
+		case op, open := <-opC:
+			if !open {
+				this.flush(batch)
+				return
+			}
+			batch = append(batch, op)
+			if len(batch) >= this.options.BatchSize {
+				if !this.flush(batch) {
+					return
+				}
+				batch = nil
+				ticker.Stop()
+				ticker = time.NewTicker(this.options.BatchDuration)
+			}
+		}
+	}
+}
+
+func (this *Runner) backoff(attempt int) time.Duration {
+	d := this.options.InitialBackoff
+	for i := 0; i < attempt && d < this.options.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > this.options.MaxBackoff {
+		d = this.options.MaxBackoff
+	}
+	// jitter between half and the full backoff
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (this *Runner) flush(batch []*gtm.Op) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	for attempt := 0; ; attempt++ {
+		err := this.sink.WriteBatch(batch)
+		if err == nil {
+			break
+		}
+		this.sendErr(errors.Wrap(err, "Error writing batch to sink"))
+		if this.options.MaxRetries >= 0 && attempt >= this.options.MaxRetries {
+			this.lock.Lock()
+			this.err = errors.Wrap(ErrRetriesExhausted, err.Error())
+			this.lock.Unlock()
+			return false
+		}
+		wait := this.backoff(attempt)
+		this.options.Log.Printf("Retrying batch of %d ops in %s", len(batch), wait)
+		select {
+		case <-this.stopC:
+			// the batch stays unacknowledged and is replayed from the checkpoint
+			return false
+		case <-time.After(wait):
+		}
+	}
+	this.advance(batch)
+	return true
+}
+
+// never blocks so that an undrained ErrC cannot hold up Stop
+func (this *Runner) sendErr(err error) {
+	select {
+	case this.ErrC <- err:
+	default:
+		this.options.Log.Printf("Dropped sink error: %s", err)
+	}
+}
+
+// moves the checkpoint to the highest op.Checkpoint in the batch rather than
+// the highest op.Timestamp. with several workers ops arrive out of oplog order
+// and an op's checkpoint stays behind any earlier entry still being fetched
+func (this *Runner) advance(batch []*gtm.Op) {
+	var ts bson.MongoTimestamp
+	for _, op := range batch {
+		if op.IsSourceOplog() && gtm.CompareTimestamps(op.Checkpoint, ts) > 0 {
+			ts = op.Checkpoint
+		}
+	}
+	this.lock.Lock()
+	if gtm.CompareTimestamps(ts, this.checkpoint) <= 0 {
+		this.lock.Unlock()
+		return
+	}
+	this.checkpoint = ts
+	this.lock.Unlock()
+	if this.options.Checkpoint != nil {
+		if err := this.options.Checkpoint.Save(ts); err != nil {
+			this.sendErr(errors.Wrap(err, "Error saving sink checkpoint"))
+		}
+	}
+}
+
+// returns a generator for Options.After which resumes from the checkpoint
+// in store or from the end of the oplog if no checkpoint has been saved
+func CheckpointTimestamp(store CheckpointStore) gtm.TimestampGenerator {
+	return gtm.AfterCheckpoint(store)
+}
+
+// a CheckpointStore which keeps the timestamp in a local file
+type FileCheckpoint struct {
+	Path string
+}
+
+func (this *FileCheckpoint) Load() (bson.MongoTimestamp, error) {
+	b, err := ioutil.ReadFile(this.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid checkpoint file")
+	}
+	return bson.MongoTimestamp(ts), nil
+}
+
+func (this *FileCheckpoint) Save(ts bson.MongoTimestamp) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(this.Path), filepath.Base(this.Path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.WriteString(strconv.FormatInt(int64(ts), 10)); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), this.Path)
+}
@@ -0,0 +1,113 @@
+package sink
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/rwynn/gtm"
+)
+
+type discardSink struct{}
+
+func (this *discardSink) WriteBatch(ops []*gtm.Op) error { return nil }
+
+func (this *discardSink) Close() error { return nil }
+
+type failingSink struct{}
+
+func (this *failingSink) WriteBatch(ops []*gtm.Op) error { return errors.New("unavailable") }
+
+func (this *failingSink) Close() error { return nil }
+
+func TestRunnerStopWithUndrainedErrors(t *testing.T) {
+	runner := NewRunner(&failingSink{}, &Options{
+		BatchSize:      1,
+		MaxRetries:     -1,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Log:            log.New(ioutil.Discard, "", 0),
+	})
+	opC := make(gtm.OpChan)
+	runner.Start(opC)
+	opC <- &gtm.Op{Operation: "i"}
+	// let the retries fill ErrC, which nobody reads
+	time.Sleep(20 * time.Millisecond)
+	stopped := make(chan bool)
+	go func() {
+		runner.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Stop blocked on ErrC")
+	}
+	if len(runner.ErrC) != cap(runner.ErrC) {
+		t.Errorf("expected ErrC to be full, got %d of %d", len(runner.ErrC), cap(runner.ErrC))
+	}
+}
+
+func TestRunnerCheckpoint(t *testing.T) {
+	oplogOp := func(ts, checkpoint int64) *gtm.Op {
+		return &gtm.Op{
+			Operation:  "u",
+			Source:     gtm.OplogQuerySource,
+			Timestamp:  bson.MongoTimestamp(ts),
+			Checkpoint: bson.MongoTimestamp(checkpoint),
+		}
+	}
+	tests := []struct {
+		name       string
+		ops        []*gtm.Op
+		checkpoint bson.MongoTimestamp
+	}{
+		{
+			name:       "in order",
+			ops:        []*gtm.Op{oplogOp(1, 1), oplogOp(2, 2), oplogOp(3, 3)},
+			checkpoint: 3,
+		},
+		{
+			// entry 2 is still being fetched by another worker when 3 and 4 arrive
+			name:       "out of order",
+			ops:        []*gtm.Op{oplogOp(1, 1), oplogOp(3, 1), oplogOp(4, 1)},
+			checkpoint: 1,
+		},
+		{
+			name:       "late entry releases the checkpoint",
+			ops:        []*gtm.Op{oplogOp(3, 1), oplogOp(2, 2), oplogOp(4, 4)},
+			checkpoint: 4,
+		},
+		{
+			name: "direct reads do not advance",
+			ops: []*gtm.Op{oplogOp(1, 1), {
+				Operation: "i",
+				Source:    gtm.DirectQuerySource,
+				Timestamp: bson.MongoTimestamp(9),
+			}},
+			checkpoint: 1,
+		},
+	}
+	for _, test := range tests {
+		runner := NewRunner(&discardSink{}, &Options{
+			BatchSize:     2,
+			BatchDuration: time.Hour,
+			Log:           log.New(ioutil.Discard, "", 0),
+		})
+		opC := make(gtm.OpChan, len(test.ops))
+		for _, op := range test.ops {
+			opC <- op
+		}
+		close(opC)
+		runner.Start(opC)
+		if err := runner.Wait(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := runner.Checkpoint(); got != test.checkpoint {
+			t.Errorf("%s: checkpoint %d, want %d", test.name, got, test.checkpoint)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package gtm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// zero values mean unlimited
+type RateLimit struct {
+	OpsPerSecond   float64
+	BytesPerSecond float64
+}
+
+// a snapshot of counters describing where a context spends its time.
+// a growing ConsumerBlocked means the reader of OpC is the bottleneck
+type Stats struct {
+	TailOps           int64
+	TailBytes         int64
+	DirectReadOps     int64
+	DirectReadBytes   int64
+	TailThrottled     time.Duration // waiting on Options.TailRateLimit
+	DirectThrottled   time.Duration // waiting on Options.DirectReadRateLimit
+	MemoryThrottled   time.Duration // waiting on Options.MaxBufferedBytes
+	ConsumerBlocked   time.Duration // waiting for room on OpC
+	DirectSuppressed  int64         // direct read ops dropped by Options.DirectReadDedupe
+	BufferedBytes     int64
+	ConsumerIsBlocked bool
+}
+
+type ctxStats struct {
+	tailOps          int64
+	tailBytes        int64
+	directOps        int64
+	directBytes      int64
+	tailThrottled    int64
+	directThrottled  int64
+	memoryThrottled  int64
+	consumerBlocked  int64
+	blockedSenders   int64
+	directSuppressed int64
+}
+
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+type throttle struct {
+	ops   *rateLimiter
+	bytes *rateLimiter
+}
+
+type memoryBudget struct {
+	cond   *sync.Cond
+	max    int64
+	used   int64
+	closed bool
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// takes n tokens and returns how long the caller must wait for them
+func (this *rateLimiter) reserve(n float64) time.Duration {
+	if this == nil {
+		return 0
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+	this.tokens -= n
+	if this.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
+
+func newThrottle(limit RateLimit) *throttle {
+	if limit.OpsPerSecond <= 0 && limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	return &throttle{
+		ops:   newRateLimiter(limit.OpsPerSecond),
+		bytes: newRateLimiter(limit.BytesPerSecond),
+	}
+}
+
+// blocks until one op of size bytes is allowed through. returns the time spent
+// waiting and false if stopC closed while waiting
+func (this *throttle) wait(size int, stopC chan bool) (time.Duration, bool) {
+	if this == nil {
+		return 0, true
+	}
+	d := this.ops.reserve(1)
+	if bd := this.bytes.reserve(float64(size)); bd > d {
+		d = bd
+	}
+	if d <= 0 {
+		return 0, true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-stopC:
+		return d, false
+	case <-t.C:
+		return d, true
+	}
+}
+
+func newMemoryBudget(max int64) *memoryBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &memoryBudget{
+		cond: sync.NewCond(&sync.Mutex{}),
+		max:  max,
+	}
+}
+
+// waits until n bytes fit in the budget. a single op larger than the
+// budget is admitted once nothing else is buffered
+func (this *memoryBudget) acquire(n int64) (time.Duration, bool) {
+	if this == nil {
+		return 0, true
+	}
+	var start time.Time
+	this.cond.L.Lock()
+	defer this.cond.L.Unlock()
+	for !this.closed && this.used > 0 && this.used+n > this.max {
+		if start.IsZero() {
+			start = time.Now()
+		}
+		this.cond.Wait()
+	}
+	this.used += n
+	var waited time.Duration
+	if !start.IsZero() {
+		waited = time.Since(start)
+	}
+	return waited, !this.closed
+}
+
+// accounts for bytes which are already buffered, such as fetched documents
+func (this *memoryBudget) add(n int64) {
+	if this == nil {
+		return
+	}
+	this.cond.L.Lock()
+	this.used += n
+	this.cond.L.Unlock()
+}
+
+func (this *memoryBudget) release(n int64) {
+	if this == nil || n == 0 {
+		return
+	}
+	this.cond.L.Lock()
+	this.used -= n
+	this.cond.L.Unlock()
+	this.cond.Broadcast()
+}
+
+func (this *memoryBudget) inUse() int64 {
+	if this == nil {
+		return 0
+	}
+	this.cond.L.Lock()
+	defer this.cond.L.Unlock()
+	return this.used
+}
+
+func (this *memoryBudget) close() {
+	if this == nil {
+		return
+	}
+	this.cond.L.Lock()
+	this.closed = true
+	this.cond.L.Unlock()
+	this.cond.Broadcast()
+}
+
+func (this *ctxStats) snapshot(budget *memoryBudget) Stats {
+	return Stats{
+		TailOps:           atomic.LoadInt64(&this.tailOps),
+		TailBytes:         atomic.LoadInt64(&this.tailBytes),
+		DirectReadOps:     atomic.LoadInt64(&this.directOps),
+		DirectReadBytes:   atomic.LoadInt64(&this.directBytes),
+		TailThrottled:     time.Duration(atomic.LoadInt64(&this.tailThrottled)),
+		DirectThrottled:   time.Duration(atomic.LoadInt64(&this.directThrottled)),
+		MemoryThrottled:   time.Duration(atomic.LoadInt64(&this.memoryThrottled)),
+		ConsumerBlocked:   time.Duration(atomic.LoadInt64(&this.consumerBlocked)),
+		DirectSuppressed:  atomic.LoadInt64(&this.directSuppressed),
+		BufferedBytes:     budget.inUse(),
+		ConsumerIsBlocked: atomic.LoadInt64(&this.blockedSenders) > 0,
+	}
+}
+
+func (this *Stats) add(other Stats) {
+	this.TailOps += other.TailOps
+	this.TailBytes += other.TailBytes
+	this.DirectReadOps += other.DirectReadOps
+	this.DirectReadBytes += other.DirectReadBytes
+	this.TailThrottled += other.TailThrottled
+	this.DirectThrottled += other.DirectThrottled
+	this.MemoryThrottled += other.MemoryThrottled
+	this.ConsumerBlocked += other.ConsumerBlocked
+	this.DirectSuppressed += other.DirectSuppressed
+	this.BufferedBytes += other.BufferedBytes
+	this.ConsumerIsBlocked = this.ConsumerIsBlocked || other.ConsumerIsBlocked
+}
+
+// waits for the tail rate limit before an oplog entry of size bytes enters
+// the pipeline. returns false if the context stopped
+func (ctx *OpCtx) admitTail(size int) bool {
+	atomic.AddInt64(&ctx.stats.tailOps, 1)
+	atomic.AddInt64(&ctx.stats.tailBytes, int64(size))
+	waited, ok := ctx.tailThrottle.wait(size, ctx.stopC)
+	atomic.AddInt64(&ctx.stats.tailThrottled, int64(waited))
+	return ok
+}
+
+// charges an oplog or direct read op against the memory budget until it is
+// sent on OpC or dropped. returns false if the context stopped
+func (ctx *OpCtx) bufferOp(op *Op, size int) bool {
+	waited, ok := ctx.budget.acquire(int64(size))
+	atomic.AddInt64(&ctx.stats.memoryThrottled, int64(waited))
+	op.bufferedBytes += int64(size)
+	return ok
+}
+
+// charges the fetched document of a buffered op against the memory budget.
+// this never blocks but holds back further oplog entries until released
+func (ctx *OpCtx) growOp(op *Op, size int) {
+	if ctx.budget == nil {
+		return
+	}
+	ctx.budget.add(int64(size))
+	op.bufferedBytes += int64(size)
+}
+
+func (ctx *OpCtx) releaseOp(op *Op) {
+	ctx.budget.release(op.bufferedBytes)
+	op.bufferedBytes = 0
+}
+
+// waits for the direct read rate limit. returns false if stopC closed
+func (ctx *OpCtx) admitDirect(size int, stopC chan bool) bool {
+	atomic.AddInt64(&ctx.stats.directOps, 1)
+	atomic.AddInt64(&ctx.stats.directBytes, int64(size))
+	waited, ok := ctx.directThrottle.wait(size, stopC)
+	atomic.AddInt64(&ctx.stats.directThrottled, int64(waited))
+	return ok
+}
+
+func (ctx *OpCtx) Stats() Stats {
+	return ctx.stats.snapshot(ctx.budget)
+}
+
+func (ctx *OpCtxMulti) Stats() Stats {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	var stats Stats
+	for _, child := range ctx.contexts {
+		stats.add(child.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,200 @@
+package gtm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		reserves []float64
+		// the wait expected for each reserve, give or take slack
+		waits []time.Duration
+	}{
+		{name: "within the burst", rate: 10, reserves: []float64{5, 5}, waits: []time.Duration{0, 0}},
+		{name: "past the burst", rate: 10, reserves: []float64{10, 1, 1}, waits: []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{name: "large request", rate: 100, reserves: []float64{300}, waits: []time.Duration{2 * time.Second}},
+		{name: "burst of at least one", rate: 0.5, reserves: []float64{1, 1}, waits: []time.Duration{0, 2 * time.Second}},
+	}
+	const slack = 20 * time.Millisecond
+	for _, test := range tests {
+		limiter := newRateLimiter(test.rate)
+		for i, n := range test.reserves {
+			got := limiter.reserve(n)
+			if want := test.waits[i]; got > want || got < want-slack {
+				t.Errorf("%s: reserve %d waited %s, want %s", test.name, i, got, want)
+			}
+		}
+	}
+	if newRateLimiter(0) != nil {
+		t.Errorf("expected no limiter for a zero rate")
+	}
+	var unlimited *rateLimiter
+	if d := unlimited.reserve(1e9); d != 0 {
+		t.Errorf("unlimited reserve waited %s", d)
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   RateLimit
+		sizes   []int
+		stopped bool
+		ok      bool
+		waited  bool
+	}{
+		{name: "unlimited", limit: RateLimit{}, sizes: []int{1 << 20, 1 << 20}, ok: true},
+		{name: "under the op rate", limit: RateLimit{OpsPerSecond: 100}, sizes: []int{1, 1}, ok: true},
+		{name: "over the byte rate", limit: RateLimit{BytesPerSecond: 1000}, sizes: []int{1000, 20}, ok: true, waited: true},
+		{name: "stopped while waiting", limit: RateLimit{OpsPerSecond: 1}, sizes: []int{1, 1}, stopped: true, ok: false, waited: true},
+	}
+	for _, test := range tests {
+		throttle := newThrottle(test.limit)
+		stopC := make(chan bool)
+		if test.stopped {
+			close(stopC)
+		}
+		var total time.Duration
+		ok := true
+		for _, size := range test.sizes {
+			var waited time.Duration
+			waited, ok = throttle.wait(size, stopC)
+			total += waited
+		}
+		if ok != test.ok {
+			t.Errorf("%s: ok %t, want %t", test.name, ok, test.ok)
+		}
+		if (total > 0) != test.waited {
+			t.Errorf("%s: waited %s", test.name, total)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int64
+		acquire []int64
+		add     int64
+		release int64
+		inUse   int64
+	}{
+		{name: "within the budget", max: 100, acquire: []int64{40, 60}, inUse: 100},
+		{name: "oversized op when empty", max: 10, acquire: []int64{50}, inUse: 50},
+		{name: "fetched documents", max: 100, acquire: []int64{10}, add: 500, inUse: 510},
+		{name: "released", max: 100, acquire: []int64{10, 20}, add: 30, release: 45, inUse: 15},
+	}
+	for _, test := range tests {
+		budget := newMemoryBudget(test.max)
+		for _, n := range test.acquire {
+			if waited, ok := budget.acquire(n); !ok || waited != 0 {
+				t.Errorf("%s: acquire %d returned %s %t", test.name, n, waited, ok)
+			}
+		}
+		budget.add(test.add)
+		budget.release(test.release)
+		if got := budget.inUse(); got != test.inUse {
+			t.Errorf("%s: %d bytes in use, want %d", test.name, got, test.inUse)
+		}
+	}
+}
+
+func TestMemoryBudgetBlocks(t *testing.T) {
+	budget := newMemoryBudget(100)
+	budget.acquire(80)
+	admitted := make(chan bool)
+	go func() {
+		_, ok := budget.acquire(30)
+		admitted <- ok
+	}()
+	select {
+	case <-admitted:
+		t.Fatalf("acquire over the budget did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	budget.release(80)
+	if ok := <-admitted; !ok {
+		t.Errorf("expected the acquire to succeed after a release")
+	}
+	if got := budget.inUse(); got != 30 {
+		t.Errorf("%d bytes in use, want 30", got)
+	}
+
+	budget.release(30)
+	budget.acquire(80)
+	go func() {
+		_, ok := budget.acquire(30)
+		admitted <- ok
+	}()
+	budget.close()
+	if ok := <-admitted; ok {
+		t.Errorf("expected the acquire to fail once the budget is closed")
+	}
+}
+
+func TestOpCtxBufferAccounting(t *testing.T) {
+	ctx := &OpCtx{budget: newMemoryBudget(1000), stats: &ctxStats{}}
+	first, second := &Op{}, &Op{}
+	ctx.bufferOp(first, 100)
+	ctx.bufferOp(second, 50)
+	ctx.growOp(first, 400)
+	if stats := ctx.Stats(); stats.BufferedBytes != 550 {
+		t.Errorf("%d bytes buffered, want 550", stats.BufferedBytes)
+	}
+	ctx.releaseOp(first)
+	if first.bufferedBytes != 0 {
+		t.Errorf("released op still holds %d bytes", first.bufferedBytes)
+	}
+	// releasing twice must not free the bytes of other ops
+	ctx.releaseOp(first)
+	if stats := ctx.Stats(); stats.BufferedBytes != 50 {
+		t.Errorf("%d bytes buffered, want 50", stats.BufferedBytes)
+	}
+	ctx.releaseOp(second)
+	if stats := ctx.Stats(); stats.BufferedBytes != 0 {
+		t.Errorf("%d bytes buffered, want 0", stats.BufferedBytes)
+	}
+}
+
+func TestDeltaOpsChargeBudget(t *testing.T) {
+	ctx := &OpCtx{
+		OpC:    make(OpChan),
+		ErrC:   make(chan error, 1),
+		budget: newMemoryBudget(1000),
+		stats:  &ctxStats{},
+		seek:   &seekMark{},
+		stopC:  make(chan bool),
+	}
+	doc, _ := bson.Marshal(bson.M{"$set": bson.M{"a": 1}})
+	entry := &OpLog{
+		Timestamp: bson.MongoTimestamp(1),
+		Operation: "u",
+		Namespace: "db.c",
+		Doc:       &bson.Raw{Kind: 0x03, Data: doc},
+		Update:    &bson.Raw{Kind: 0x03, Data: doc},
+	}
+	sent := make(chan bool)
+	go func() {
+		sent <- ctx.emitEntry(entry, 0, nil, &Options{UpdateDataAsDelta: true, Unmarshal: defaultUnmarshaller})
+	}()
+	// the op is charged while it waits on OpC
+	deadline := time.Now().Add(time.Second)
+	for ctx.Stats().BufferedBytes != int64(entry.size()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes buffered, want %d", ctx.Stats().BufferedBytes, entry.size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	<-ctx.OpC
+	if !<-sent {
+		t.Fatalf("expected the entry to be emitted")
+	}
+	if stats := ctx.Stats(); stats.BufferedBytes != 0 {
+		t.Errorf("%d bytes buffered after the op was sent, want 0", stats.BufferedBytes)
+	}
+}
@@ -0,0 +1,193 @@
+package gtm
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"math"
+	"time"
+)
+
+// a replication optime as reported by replSetGetStatus and isMaster
+type OpTime struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Term      int64               `bson:"t"`
+}
+
+// anything able to load a saved timestamp, such as a sink.CheckpointStore
+type CheckpointLoader interface {
+	Load() (bson.MongoTimestamp, error)
+}
+
+// the seconds and ordinal of an oplog timestamp are unsigned 32 bit values,
+// so seconds run until 2106 rather than 2038
+func NewTimestamp(seconds uint32, ordinal uint32) bson.MongoTimestamp {
+	return bson.MongoTimestamp(uint64(seconds)<<32 | uint64(ordinal))
+}
+
+// compares oplog timestamps as the server does and returns -1, 0 or 1. a
+// MongoTimestamp is a signed int64 so timestamps from 2038 on are negative
+// and must not be compared with < or >
+func CompareTimestamps(a, b bson.MongoTimestamp) int {
+	if uint64(a) < uint64(b) {
+		return -1
+	} else if uint64(a) > uint64(b) {
+		return 1
+	}
+	return 0
+}
+
+// returns the timestamp sorting before every oplog entry written at or after t.
+// times outside the range of a timestamp are clamped to it
+func TimestampForTime(t time.Time) bson.MongoTimestamp {
+	seconds := t.Unix()
+	if seconds < 0 {
+		seconds = 0
+	} else if seconds > math.MaxUint32 {
+		seconds = math.MaxUint32
+	}
+	return NewTimestamp(uint32(seconds), 0)
+}
+
+func TimestampTime(ts bson.MongoTimestamp) time.Time {
+	return time.Unix(int64(uint64(ts)>>32), 0)
+}
+
+// returns 0 without a session, e.g. when replaying files with StartFiles
+func FirstOpTimestamp(session *mgo.Session, options *Options) bson.MongoTimestamp {
+	if session == nil {
+		return 0
+	}
+	var opLog OpLog
+	collection := OpLogCollection(session, options)
+	collection.Find(nil).Sort("$natural").One(&opLog)
+	return opLog.Timestamp
+}
+
+// finds the first oplog entry at or after t. the oplogReplay flag lets the
+// server start the scan near t, using what it knows of where each part of
+// the oplog begins, rather than at the start of the oplog. returns
+// mgo.ErrNotFound when no entry is that recent
+func OpLogTimestampAt(session *mgo.Session, options *Options, t time.Time) (bson.MongoTimestamp, error) {
+	var opLog OpLog
+	collection := OpLogCollection(session, options)
+	query := bson.M{"ts": bson.M{"$gte": TimestampForTime(t)}}
+	if err := collection.Find(query).LogReplay().Sort("$natural").One(&opLog); err != nil {
+		return 0, err
+	}
+	return opLog.Timestamp, nil
+}
+
+// returns the optime of the last write applied by the member the session
+// reads from, as reported by isMaster. ops read after this call reflect at
+// least every oplog entry up to it. returns 0 when the server does not report
+// it, e.g. a standalone server, a mongos or MongoDB before 3.4
+func ClusterTime(session *mgo.Session) (bson.MongoTimestamp, error) {
+	var result struct {
+		LastWrite struct {
+			OpTime OpTime `bson:"opTime"`
+		} `bson:"lastWrite"`
+		OperationTime bson.MongoTimestamp `bson:"operationTime"`
+	}
+	if err := session.Run("isMaster", &result); err != nil {
+		return 0, err
+	}
+	if ts := result.LastWrite.OpTime.Timestamp; ts != 0 {
+		return ts, nil
+	}
+	return result.OperationTime, nil
+}
+
+// MongoDB 5.0 supports readConcern snapshot with atClusterTime outside of
+// transactions
+func SupportsSnapshotReads(session *mgo.Session) (supports bool, err error) {
+	var buildInfo *BuildInfo
+	if buildInfo, err = VersionInfo(session); err == nil && buildInfo != nil {
+		supports = buildInfo.major >= 5
+	}
+	return
+}
+
+// returns the timestamp just before ts so that tailing after it includes ts.
+// the subtraction wraps like the unsigned value for timestamps from 2038 on
+func beforeTimestamp(ts bson.MongoTimestamp) bson.MongoTimestamp {
+	if ts != 0 {
+		return ts - 1
+	}
+	return ts
+}
+
+// a TimestampGenerator which replays the whole oplog
+func StartOfOpLog(session *mgo.Session, options *Options) bson.MongoTimestamp {
+	return beforeTimestamp(FirstOpTimestamp(session, options))
+}
+
+// a TimestampGenerator which starts after a fixed timestamp
+func AfterTimestamp(ts bson.MongoTimestamp) TimestampGenerator {
+	return func(session *mgo.Session, options *Options) bson.MongoTimestamp {
+		return ts
+	}
+}
+
+// a TimestampGenerator which starts with the first oplog entry at or after t.
+// when t is before the start of the oplog a warning is logged and the whole
+// oplog is replayed. when t is in the future entries written before t are
+// skipped and tailing waits for the first one at or after t. without a
+// session the files replayed by StartFiles start at t
+func AfterTime(t time.Time) TimestampGenerator {
+	return func(session *mgo.Session, options *Options) bson.MongoTimestamp {
+		if session == nil {
+			return beforeTimestamp(TimestampForTime(t))
+		}
+		ts, err := OpLogTimestampAt(session, options, t)
+		if err != nil {
+			if err != mgo.ErrNotFound && options.Log != nil {
+				options.Log.Printf("Unable to find the oplog entry at %s: %s", t, err)
+			}
+			// the oplog query after this point starts at t all the same
+			return beforeTimestamp(TimestampForTime(t))
+		}
+		first := FirstOpTimestamp(session, options)
+		if ts == first && CompareTimestamps(TimestampForTime(t), first) < 0 && options.Log != nil {
+			options.Log.Printf("The oplog starts at %s after the requested time %s", TimestampTime(first), t)
+		}
+		return beforeTimestamp(ts)
+	}
+}
+
+// a TimestampGenerator which replays the last d of the oplog, e.g. 2 hours
+func AfterDuration(d time.Duration) TimestampGenerator {
+	return func(session *mgo.Session, options *Options) bson.MongoTimestamp {
+		return AfterTime(time.Now().Add(-d))(session, options)
+	}
+}
+
+// a TimestampGenerator which resumes from a saved checkpoint, or from the
+// end of the oplog when nothing has been saved yet
+func AfterCheckpoint(store CheckpointLoader) TimestampGenerator {
+	return func(session *mgo.Session, options *Options) bson.MongoTimestamp {
+		if ts, err := store.Load(); err == nil && ts != 0 {
+			return ts
+		} else if err != nil && options.Log != nil {
+			options.Log.Printf("Unable to load checkpoint: %s", err)
+		}
+		return LastOpTimestamp(session, options)
+	}
+}
+
+// restarts tailing with the first oplog entry at or after t
+func (ctx *OpCtx) SinceTime(t time.Time) error {
+	return ctx.Since(TimestampForTime(t))
+}
+
+// restarts tailing after the optime
+func (ctx *OpCtx) SinceOpTime(opTime OpTime) error {
+	return ctx.Since(opTime.Timestamp)
+}
+
+func (ctx *OpCtxMulti) SinceTime(t time.Time) error {
+	return ctx.Since(TimestampForTime(t))
+}
+
+func (ctx *OpCtxMulti) SinceOpTime(opTime OpTime) error {
+	return ctx.Since(opTime.Timestamp)
+}
@@ -0,0 +1,91 @@
+package gtm
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestTimestampForTime(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		ts   bson.MongoTimestamp
+	}{
+		{name: "2017", time: time.Unix(1500000000, 0), ts: NewTimestamp(1500000000, 0)},
+		{name: "after 2038", time: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), ts: NewTimestamp(2208988800, 0)},
+		{name: "before 1970", time: time.Unix(-5, 0), ts: 0},
+		{name: "after 2106", time: time.Unix(math.MaxUint32+10, 0), ts: NewTimestamp(math.MaxUint32, 0)},
+	}
+	for _, test := range tests {
+		ts := TimestampForTime(test.time)
+		if ts != test.ts {
+			t.Errorf("%s: got %d, want %d", test.name, ts, test.ts)
+		}
+		if test.time.Unix() >= 0 && test.time.Unix() <= math.MaxUint32 && !TimestampTime(ts).Equal(test.time) {
+			t.Errorf("%s: time %s, want %s", test.name, TimestampTime(ts), test.time)
+		}
+	}
+}
+
+func TestNewTimestamp(t *testing.T) {
+	tests := []struct {
+		seconds uint32
+		ordinal uint32
+		raw     uint64
+	}{
+		{seconds: 1, ordinal: 2, raw: 1<<32 | 2},
+		{seconds: 2208988800, ordinal: 7, raw: 2208988800<<32 | 7},
+		{seconds: math.MaxUint32, ordinal: math.MaxUint32, raw: math.MaxUint64},
+	}
+	for _, test := range tests {
+		if ts := NewTimestamp(test.seconds, test.ordinal); uint64(ts) != test.raw {
+			t.Errorf("%d:%d: got %d, want %d", test.seconds, test.ordinal, uint64(ts), test.raw)
+		}
+	}
+}
+
+func TestCompareTimestamps(t *testing.T) {
+	before2038 := NewTimestamp(math.MaxInt32, 5)
+	after2038 := NewTimestamp(math.MaxInt32+1, 0)
+	tests := []struct {
+		name string
+		a, b bson.MongoTimestamp
+		want int
+	}{
+		{"equal", before2038, before2038, 0},
+		{"ordinal", NewTimestamp(1, 1), NewTimestamp(1, 2), -1},
+		{"seconds", NewTimestamp(2, 0), NewTimestamp(1, 9), 1},
+		{"across 2038", after2038, before2038, 1},
+		{"across 2038 reversed", before2038, after2038, -1},
+		{"end of range", NewTimestamp(math.MaxUint32, math.MaxUint32), after2038, 1},
+	}
+	for _, test := range tests {
+		if got := CompareTimestamps(test.a, test.b); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+	if after2038 >= 0 {
+		t.Fatalf("expected a timestamp after 2038 to be negative as an int64")
+	}
+	if got := beforeTimestamp(after2038); got != NewTimestamp(math.MaxInt32, math.MaxUint32) {
+		t.Errorf("got %d:%d before the first 2038 timestamp", uint64(got)>>32, uint32(got))
+	}
+	if got := beforeTimestamp(0); got != 0 {
+		t.Errorf("got %d before the zero timestamp, want 0", got)
+	}
+}
+
+func TestUntilAfter2038(t *testing.T) {
+	later := time.Unix(math.MaxInt32+100, 0)
+	options := &Options{Until: NewTimestamp(math.MaxInt32+200, 0), UntilTime: later}
+	if got := options.until(); got != beforeTimestamp(TimestampForTime(later)) {
+		t.Errorf("got until %d, want the earlier UntilTime", uint64(got)>>32)
+	}
+	options = &Options{Until: NewTimestamp(1500000000, 0), UntilTime: later}
+	if got := options.until(); got != options.Until {
+		t.Errorf("got until %d, want the earlier Until", uint64(got)>>32)
+	}
+}